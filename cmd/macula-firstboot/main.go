@@ -15,8 +15,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/firewall"
+	"github.com/macula-io/macula-os/pkg/httpclient"
 	"github.com/skip2/go-qrcode"
 )
 
@@ -51,6 +55,7 @@ func main() {
 	// Check if already configured
 	if !forceRun && isConfigured() {
 		log.Println("System already configured. Use -force to run anyway.")
+		closeFirewall()
 		os.Exit(0)
 	}
 
@@ -65,6 +70,14 @@ func main() {
 	// Print banner to console
 	printBanner(hostname, pairingCode, localURL)
 
+	// Let the pairing page through the firewall
+	rules := []config.FirewallRule{{Port: strconv.Itoa(port), Protocol: "tcp"}}
+	if err := firewall.Register("firstboot", rules); err != nil {
+		log.Printf("Failed to open port %d: %v", port, err)
+	} else if err := firewall.Reload(); err != nil {
+		log.Printf("Failed to open port %d: %v", port, err)
+	}
+
 	// Start HTTP server
 	server := NewFirstbootServer(pairingCode, hostname, localURL)
 	addr := fmt.Sprintf(":%d", port)
@@ -171,6 +184,7 @@ func (s *FirstbootServer) handlePair(w http.ResponseWriter, r *http.Request) {
 	if err := markConfigured(); err != nil {
 		log.Printf("Failed to mark configured: %v", err)
 	}
+	closeFirewall()
 
 	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"success":  true,
@@ -226,7 +240,7 @@ func exchangeCodesWithPortal(portalCode, nodeCode string) (*PairingResult, error
 	}
 
 	url := fmt.Sprintf("%s/api/console/pair", portalHost)
-	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	resp, err := httpclient.Post(url, "application/json", bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to contact Portal: %w", err)
 	}
@@ -270,6 +284,15 @@ func storeCredentials(result *PairingResult) error {
 	return os.WriteFile(credPath, data, 0600)
 }
 
+// closeFirewall removes the rule that opens the pairing page
+func closeFirewall() {
+	if err := firewall.Unregister("firstboot"); err != nil {
+		log.Printf("Failed to close port %d: %v", port, err)
+	} else if err := firewall.Reload(); err != nil {
+		log.Printf("Failed to close port %d: %v", port, err)
+	}
+}
+
 func isConfigured() bool {
 	_, err := os.Stat(configuredFlag)
 	return err == nil
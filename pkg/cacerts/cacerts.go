@@ -0,0 +1,254 @@
+// Package cacerts installs the CAs of the config, and the ones added with
+// maculaos ca add, into the system trust bundle, which k3s and containerd
+// read, and into the trust of the shared HTTP client of maculaos.
+package cacerts
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/httpclient"
+	"github.com/macula-io/macula-os/pkg/services"
+	"github.com/macula-io/macula-os/pkg/system"
+	"github.com/macula-io/macula-os/pkg/util"
+)
+
+const (
+	// blockName marks the certificates of the config in SystemBundle
+	blockName = "ca-certs"
+
+	// Sources of certificates
+	SourceConfig = "config"
+	SourceAdded  = "added"
+)
+
+var (
+	// StoreDir holds the certificates added with maculaos ca add
+	StoreDir = system.LocalPath("ca-certs.d")
+	// SystemBundle is the trust bundle of the system, which the certificates
+	// are appended to
+	SystemBundle = "/etc/ssl/certs/ca-certificates.crt"
+
+	validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// Cert is a CA certificate trusted beyond the ones of the system
+type Cert struct {
+	Name        string    `json:"name"` // the file in StoreDir, or the path or index of a config entry
+	Source      string    `json:"source"`
+	Subject     string    `json:"subject"`
+	NotAfter    time.Time `json:"notAfter"`
+	Fingerprint string    `json:"fingerprint"` // sha256 of the certificate
+
+	pem []byte
+}
+
+// ApplyCACerts writes the certificates to the system bundle and the trust
+// file of the HTTP client. With restart, a running k3s is restarted when they
+// changed, so that containerd pulls from registries with a private CA.
+func ApplyCACerts(cfg *config.CloudConfig, restart bool) error {
+	certs, err := Certs(cfg)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	for _, c := range certs {
+		fmt.Fprintf(buf, "# %s (%s %s)\n", c.Subject, c.Source, c.Name)
+		buf.Write(c.pem)
+	}
+
+	old, err := effects.ReadFile(httpclient.TrustFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	changed := !bytes.Equal(old, buf.Bytes())
+	if changed {
+		if buf.Len() == 0 {
+			err = effects.Remove(httpclient.TrustFile)
+		} else if err = effects.MkdirAll(filepath.Dir(httpclient.TrustFile), 0755); err == nil {
+			err = effects.WriteFile(httpclient.TrustFile, buf.Bytes(), 0644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	bundleChanged, err := writeBundle(buf.String())
+	if err != nil {
+		return err
+	}
+	if (changed || bundleChanged) && restart {
+		return services.RestartIfRunning(services.K3s, "the new CA certificates")
+	}
+	return nil
+}
+
+// Certs returns the certificates of the config followed by the ones added,
+// without duplicates
+func Certs(cfg *config.CloudConfig) ([]Cert, error) {
+	var result []Cert
+	seen := map[string]bool{}
+	add := func(source, name string, data []byte) error {
+		certs, err := parse(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		for _, c := range certs {
+			if seen[c.Fingerprint] {
+				continue
+			}
+			seen[c.Fingerprint] = true
+			c.Source, c.Name = source, name
+			result = append(result, c)
+		}
+		return nil
+	}
+
+	var errors []string
+	for i, entry := range cfg.CACerts {
+		name := fmt.Sprintf("caCerts[%d]", i)
+		data := []byte(entry)
+		if !strings.Contains(entry, "-----BEGIN") {
+			name = entry
+			var err error
+			if data, err = readPath(cfg, entry); err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+		}
+		if err := add(SourceConfig, name, data); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	entries, err := ioutil.ReadDir(StoreDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(StoreDir, entry.Name()))
+		if err == nil {
+			err = add(SourceAdded, strings.TrimSuffix(entry.Name(), ".pem"), data)
+		}
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if len(errors) > 0 {
+		return nil, fmt.Errorf("caCerts: %s", strings.Join(errors, "; "))
+	}
+	return result, nil
+}
+
+// Add stores the certificates of a PEM file under name, which defaults to
+// the start of the fingerprint of the first one. They take effect at the next
+// ApplyCACerts.
+func Add(name string, data []byte) (string, error) {
+	certs, err := parse(data)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = certs[0].Fingerprint[:16]
+	}
+	if !validName.MatchString(name) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+
+	buf := &bytes.Buffer{}
+	for _, c := range certs {
+		buf.Write(c.pem)
+	}
+	if err := os.MkdirAll(StoreDir, 0755); err != nil {
+		return "", err
+	}
+	return name, util.WriteFileAtomic(filepath.Join(StoreDir, name+".pem"), buf.Bytes(), 0644)
+}
+
+// Remove removes the added certificates stored under name, or the ones
+// holding a certificate with a fingerprint starting with name
+func Remove(cfg *config.CloudConfig, name string) error {
+	certs, err := Certs(cfg)
+	if err != nil {
+		return err
+	}
+	for _, c := range certs {
+		if c.Name != name && !(len(name) >= 8 && strings.HasPrefix(c.Fingerprint, strings.ToLower(name))) {
+			continue
+		}
+		if c.Source == SourceConfig {
+			return fmt.Errorf("%s comes from caCerts in the config, remove it there", c.Subject)
+		}
+		return os.Remove(filepath.Join(StoreDir, c.Name+".pem"))
+	}
+	return fmt.Errorf("no CA certificate %s", name)
+}
+
+// parse returns the certificates of PEM data, which must hold at least one
+// and nothing else
+func parse(data []byte) ([]Cert, error) {
+	var result []Cert
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected %s, only certificates can be trusted", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(cert.Raw)
+		result = append(result, Cert{
+			Subject:     cert.Subject.String(),
+			NotAfter:    cert.NotAfter,
+			Fingerprint: hex.EncodeToString(sum[:]),
+			pem:         pem.EncodeToMemory(block),
+		})
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return result, nil
+}
+
+// readPath reads a PEM file, from writeFiles if it is written there, since
+// the certificates are installed before writeFiles runs at boot
+func readPath(cfg *config.CloudConfig, path string) ([]byte, error) {
+	for _, f := range cfg.WriteFiles {
+		if f.Path == path {
+			return util.DecodeContent(f.Content, f.Encoding)
+		}
+	}
+	return effects.ReadFile(path)
+}
+
+// writeBundle replaces the block of the system bundle that holds the
+// certificates, keeping the CAs of the system, and reports whether it changed
+func writeBundle(certs string) (bool, error) {
+	var lines []string
+	if certs != "" {
+		lines = strings.Split(strings.TrimSuffix(certs, "\n"), "\n")
+	}
+	return effects.WriteBlock(SystemBundle, blockName, lines, 0644)
+}
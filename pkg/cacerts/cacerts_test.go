@@ -0,0 +1,102 @@
+package cacerts
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/certtest"
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/httpclient"
+)
+
+func TestApplyCACerts(t *testing.T) {
+	dir := t.TempDir()
+	defer func(store, bundle, trust string) {
+		StoreDir, SystemBundle, httpclient.TrustFile = store, bundle, trust
+	}(StoreDir, SystemBundle, httpclient.TrustFile)
+	StoreDir = filepath.Join(dir, "ca-certs.d")
+	SystemBundle = filepath.Join(dir, "ca-certificates.crt")
+	httpclient.TrustFile = filepath.Join(dir, "local", "ca-certs.pem")
+
+	system := certtest.CA(t, "system")
+	if err := ioutil.WriteFile(SystemBundle, []byte(system), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inline, portal, added := certtest.CA(t, "inline"), certtest.CA(t, "portal"), certtest.CA(t, "added")
+	cfg := &config.CloudConfig{
+		CACerts: []string{inline, "/etc/ssl/portal.pem", inline},
+		WriteFiles: []config.File{{
+			Path:     "/etc/ssl/portal.pem",
+			Encoding: "b64",
+			Content:  base64.StdEncoding.EncodeToString([]byte(portal)),
+		}},
+	}
+	name, err := Add("", []byte(added))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyCACerts(cfg, false); err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := Certs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range certs {
+		names = append(names, c.Source+" "+c.Name+" "+c.Subject)
+	}
+	want := []string{"config caCerts[0] CN=inline", "config /etc/ssl/portal.pem CN=portal", "added " + name + " CN=added"}
+	if strings.Join(names, ", ") != strings.Join(want, ", ") {
+		t.Errorf("expected %v, got %v", want, names)
+	}
+
+	bundle, err := ioutil.ReadFile(SystemBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust, err := ioutil.ReadFile(httpclient.TrustFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(bundle), system+"# BEGIN maculaos ca-certs\n") || !strings.HasSuffix(string(bundle), "# END maculaos ca-certs\n") {
+		t.Errorf("unexpected bundle:\n%s", bundle)
+	}
+	for _, cert := range []string{inline, portal, added} {
+		if strings.Count(string(bundle), cert) != 1 || !strings.Contains(string(trust), cert) {
+			t.Error("every certificate should be in the bundle once and trusted by the HTTP client")
+		}
+	}
+
+	if err := Remove(cfg, "caCerts[0]"); err == nil || !strings.Contains(err.Error(), "remove it there") {
+		t.Errorf("certificates of the config should not be removed, got %v", err)
+	}
+	if err := Remove(cfg, certs[2].Fingerprint[:12]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyCACerts(&config.CloudConfig{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if bundle, _ := ioutil.ReadFile(SystemBundle); string(bundle) != system {
+		t.Errorf("the bundle should be restored, got:\n%s", bundle)
+	}
+	if _, err := ioutil.ReadFile(httpclient.TrustFile); err == nil {
+		t.Error("the trust file should be removed without certificates")
+	}
+}
+
+func TestParse(t *testing.T) {
+	if _, err := parse([]byte("not a certificate")); err == nil {
+		t.Error("expected data without certificates to be refused")
+	}
+	key := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")}))
+	if _, err := parse([]byte(certtest.CA(t, "ca") + key)); err == nil || !strings.Contains(err.Error(), "unexpected PRIVATE KEY") {
+		t.Errorf("expected a private key to be refused, got %v", err)
+	}
+}
@@ -1,19 +1,53 @@
 package cc
 
 import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
 	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
 type applier func(cfg *config.CloudConfig) error
 
-func runApplies(cfg *config.CloudConfig, appliers ...applier) error {
-	var errors []error
+// Phases the appliers run in
+const (
+	PhaseInitrd  = "initrd"
+	PhaseBoot    = "boot"
+	PhaseRun     = "run"
+	PhaseInstall = "install"
+)
+
+// Result is the outcome of running an applier
+type Result struct {
+	Name     string        `json:"name"`
+	Phase    string        `json:"phase"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Changed  bool          `json:"changed"`
+	Error    string        `json:"error,omitempty"`
+	Paths    []string      `json:"paths,omitempty"`
 
-	for _, a := range appliers {
-		err := a(cfg)
-		if err != nil {
-			errors = append(errors, err)
+	// Diff holds the changes the applier made, or would make when planned
+	Diff string `json:"-"`
+	err  error
+}
+
+func runApplies(phase string, cfg *config.CloudConfig) error {
+	results := applyAll(phase, false, true, nil, cfg)
+	if err := writeJournal(results); err != nil {
+		logrus.Warnf("failed to write the apply journal: %v", err)
+	}
+
+	var errors []error
+	for _, r := range results {
+		if r.err != nil {
+			errors = append(errors, r.err)
 		}
 	}
 
@@ -24,53 +58,180 @@ func runApplies(cfg *config.CloudConfig, appliers ...applier) error {
 	return nil
 }
 
-func RunApply(cfg *config.CloudConfig) error {
-	return runApplies(cfg,
+// Plan runs the appliers of a phase without changing the system and returns
+// the changes each of them would make. Unless showSecrets, the contents of
+// files that others cannot read or that hold secrets of the config are left
+// out of the diffs.
+func Plan(phase string, cfg *config.CloudConfig, showSecrets bool) ([]Result, error) {
+	if _, ok := phases[phase]; !ok {
+		return nil, fmt.Errorf("unknown phase %s", phase)
+	}
+	secrets, err := config.Secrets(*cfg)
+	if err != nil {
+		return nil, err
+	}
+	return applyAll(phase, true, !showSecrets, secrets, cfg), nil
+}
+
+// applyAll runs the appliers of a phase. With redact, the diffs of the results
+// leave out the contents of files that are private or hold one of secrets.
+func applyAll(phase string, dryRun, redact bool, secrets []string, cfg *config.CloudConfig) []Result {
+	var results []Result
+	for _, a := range phases[phase] {
+		result := Result{
+			Name:  applierName(a),
+			Phase: phase,
+			Time:  time.Now().UTC(),
+		}
+
+		recorder := effects.Record(dryRun)
+		result.err = a(cfg)
+		recorder.Stop()
+
+		result.Duration = time.Since(result.Time)
+		result.Changed = recorder.Changed()
+		result.Paths = recorder.Paths()
+		result.Diff = recorder.Diff(redact, secrets)
+		if result.err != nil {
+			result.Error = result.err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// applierName returns the name of an applier function, such as ApplyModules
+func applierName(a applier) string {
+	name := runtime.FuncForPC(reflect.ValueOf(a).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// keyAppliers maps config keys to the applier that puts them into effect, so
+// that a single change can be applied without a full RunApply
+var keyAppliers = map[string]applier{
+	"hostname":                  ApplyHostname,
+	"sshAuthorizedKeys":         ApplySSHKeysWithNet,
+	"users":                     ApplyUsersWithNet,
+	"network":                   ApplyNetwork,
+	"services":                  ApplyServices,
+	"mounts":                    ApplyMounts,
+	"swap":                      ApplySwap,
+	"firewall":                  ApplyFirewall,
+	"proxy":                     ApplyProxy,
+	"caCerts":                   ApplyCACertsAndProxy,
+	"registries":                ApplyRegistries,
+	"k3s":                       ApplyK3SWithRestart,
+	"manifests":                 ApplyManifestsWithNet,
+	"helmCharts":                ApplyManifestsWithNet,
+	"images":                    ApplyImages,
+	"writeFiles":                ApplyWriteFiles,
+	"maculaos.dataSources":      ApplyDataSource,
+	"maculaos.modules":          ApplyModules,
+	"maculaos.blacklistModules": ApplyModules,
+	"maculaos.sysctls":          ApplySysctls,
+	"maculaos.ntpServers":       ApplyDNS,
+	"maculaos.timezone":         ApplyTimezone,
+	"maculaos.dnsNameservers":   ApplyDNS,
+	"maculaos.wifi":             ApplyWifi,
+	"maculaos.password":         ApplyPassword,
+	"maculaos.serverUrl":        ApplyK3SWithRestart,
+	"maculaos.token":            ApplyK3SWithRestart,
+	"maculaos.labels":           ApplyK3SWithRestart,
+	"maculaos.k3sArgs":          ApplyK3SWithRestart,
+	"maculaos.environment":      ApplyEnvironment,
+	"maculaos.taints":           ApplyK3SWithRestart,
+}
+
+// KeyApplier returns the applier for a canonical dotted config key, such as
+// the one config.Set returns, or false if the key only takes effect at boot
+func KeyApplier(key string) (func(cfg *config.CloudConfig) error, bool) {
+	for parts := strings.Split(key, "."); len(parts) > 0; parts = parts[:len(parts)-1] {
+		if a, ok := keyAppliers[strings.Join(parts, ".")]; ok {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// phases lists the appliers of each phase, in the order they run
+var phases = map[string][]applier{
+	PhaseRun: {
 		ApplyModules,
 		ApplySysctls,
 		ApplyHostname,
+		ApplyTimezone,
 		ApplyDNS,
+		ApplyNetwork,
 		ApplyWifi,
+		ApplyCACerts,
+		ApplyProxy,
 		ApplyPassword,
+		ApplyUsersWithNet,
 		ApplySSHKeysWithNet,
+		ApplyMounts,
+		ApplySwap,
 		ApplyWriteFiles,
 		ApplyEnvironment,
+		ApplyServices,
 		ApplyRuncmd,
 		ApplyInstall,
+		ApplyRegistries,
+		ApplyImages,
 		ApplyK3SInstall,
-	)
-}
-
-func InstallApply(cfg *config.CloudConfig) error {
-	return runApplies(cfg,
+		ApplyManifestsWithNet,
+		ApplyFirewall,
+	},
+	PhaseInstall: {
 		ApplyK3SWithRestart,
-	)
-}
-
-func BootApply(cfg *config.CloudConfig) error {
-	return runApplies(cfg,
+	},
+	PhaseBoot: {
 		ApplyDataSource,
 		ApplyModules,
 		ApplySysctls,
 		ApplyHostname,
+		ApplyTimezone,
 		ApplyDNS,
+		ApplyNetworkNoRollback,
 		ApplyWifi,
+		ApplyCACertsNoRestart,
+		ApplyProxyNoRestart,
 		ApplyPassword,
+		ApplyUsers,
 		ApplySSHKeys,
+		ApplyRegistriesNoRestart,
 		ApplyK3SNoRestart,
+		ApplyMounts,
+		ApplySwap,
 		ApplyWriteFiles,
+		ApplyImages,
+		ApplyManifests,
 		ApplyEnvironment,
+		ApplyServicesNoRestart,
+		ApplyFirewall,
 		ApplyBootcmd,
-	)
-}
-
-func InitApply(cfg *config.CloudConfig) error {
-	return runApplies(cfg,
+	},
+	PhaseInitrd: {
 		ApplyModules,
 		ApplySysctls,
 		ApplyHostname,
 		ApplyWriteFiles,
 		ApplyEnvironment,
 		ApplyInitcmd,
-	)
+	},
+}
+
+func RunApply(cfg *config.CloudConfig) error {
+	return runApplies(PhaseRun, cfg)
+}
+
+func InstallApply(cfg *config.CloudConfig) error {
+	return runApplies(PhaseInstall, cfg)
+}
+
+func BootApply(cfg *config.CloudConfig) error {
+	return runApplies(PhaseBoot, cfg)
+}
+
+func InitApply(cfg *config.CloudConfig) error {
+	return runApplies(PhaseInitrd, cfg)
 }
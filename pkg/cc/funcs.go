@@ -4,23 +4,34 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/macula-io/macula-os/pkg/cacerts"
 	"github.com/macula-io/macula-os/pkg/command"
 	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/firewall"
 	"github.com/macula-io/macula-os/pkg/hostname"
+	"github.com/macula-io/macula-os/pkg/images"
+	"github.com/macula-io/macula-os/pkg/k3s"
+	"github.com/macula-io/macula-os/pkg/manifests"
 	"github.com/macula-io/macula-os/pkg/mode"
 	"github.com/macula-io/macula-os/pkg/module"
+	"github.com/macula-io/macula-os/pkg/mounts"
+	"github.com/macula-io/macula-os/pkg/network"
+	"github.com/macula-io/macula-os/pkg/proxy"
+	"github.com/macula-io/macula-os/pkg/registry"
+	"github.com/macula-io/macula-os/pkg/services"
 	"github.com/macula-io/macula-os/pkg/ssh"
+	"github.com/macula-io/macula-os/pkg/swap"
 	"github.com/macula-io/macula-os/pkg/sysctl"
-	"github.com/macula-io/macula-os/pkg/version"
+	"github.com/macula-io/macula-os/pkg/users"
 	"github.com/macula-io/macula-os/pkg/writefile"
-	"github.com/sirupsen/logrus"
 )
 
 func ApplyModules(cfg *config.CloudConfig) error {
@@ -36,7 +47,31 @@ func ApplyHostname(cfg *config.CloudConfig) error {
 }
 
 func ApplyPassword(cfg *config.CloudConfig) error {
-	return command.SetPassword(cfg.Maculaos.Password)
+	return command.SetPassword("macula", cfg.Maculaos.Password)
+}
+
+func ApplyUsers(cfg *config.CloudConfig) error {
+	return users.ApplyUsers(cfg, false)
+}
+
+func ApplyUsersWithNet(cfg *config.CloudConfig) error {
+	return users.ApplyUsers(cfg, true)
+}
+
+func ApplyMounts(cfg *config.CloudConfig) error {
+	return mounts.ApplyMounts(cfg)
+}
+
+func ApplySwap(cfg *config.CloudConfig) error {
+	return swap.ApplySwap(cfg)
+}
+
+func ApplyServices(cfg *config.CloudConfig) error {
+	return services.ApplyServices(cfg, true)
+}
+
+func ApplyServicesNoRestart(cfg *config.CloudConfig) error {
+	return services.ApplyServices(cfg, false)
 }
 
 func ApplyRuncmd(cfg *config.CloudConfig) error {
@@ -77,89 +112,56 @@ func ApplyK3SNoRestart(cfg *config.CloudConfig) error {
 }
 
 func ApplyK3S(cfg *config.CloudConfig, restart, install bool) error {
-	mode, err := mode.Get()
-	if err != nil {
-		return err
-	}
-	if mode == "install" {
-		return nil
-	}
-
-	k3sExists := false
-	k3sLocalExists := false
-	if _, err := os.Stat("/sbin/k3s"); err == nil {
-		k3sExists = true
-	}
-	if _, err := os.Stat("/usr/local/bin/k3s"); err == nil {
-		k3sLocalExists = true
-	}
+	return k3s.ApplyK3S(cfg, restart, install)
+}
 
-	args := cfg.Maculaos.K3sArgs
-	vars := []string{
-		"INSTALL_K3S_NAME=service",
-	}
+func ApplyImages(cfg *config.CloudConfig) error {
+	return images.ApplyImages(cfg)
+}
 
-	if !k3sExists && !restart {
-		return nil
-	}
+func ApplyManifests(cfg *config.CloudConfig) error {
+	return manifests.ApplyManifests(cfg, false)
+}
 
-	if k3sExists {
-		vars = append(vars, "INSTALL_K3S_SKIP_DOWNLOAD=true")
-		vars = append(vars, "INSTALL_K3S_BIN_DIR=/sbin")
-		vars = append(vars, "INSTALL_K3S_BIN_DIR_READ_ONLY=true")
-	} else if k3sLocalExists {
-		vars = append(vars, "INSTALL_K3S_SKIP_DOWNLOAD=true")
-	} else if !install {
-		return nil
-	}
+func ApplyManifestsWithNet(cfg *config.CloudConfig) error {
+	return manifests.ApplyManifests(cfg, true)
+}
 
-	if !restart {
-		vars = append(vars, "INSTALL_K3S_SKIP_START=true")
-	}
+func ApplyCACerts(cfg *config.CloudConfig) error {
+	return cacerts.ApplyCACerts(cfg, true)
+}
 
-	if cfg.Maculaos.ServerURL == "" {
-		if len(args) == 0 {
-			args = append(args, "server")
-		}
-	} else {
-		vars = append(vars, fmt.Sprintf("K3S_URL=%s", cfg.Maculaos.ServerURL))
-		if len(args) == 0 {
-			args = append(args, "agent")
-		}
+// ApplyCACertsAndProxy installs the CA certificates, then the proxy settings
+// again, since the bundle of the proxy for k3s is built from the system one
+func ApplyCACertsAndProxy(cfg *config.CloudConfig) error {
+	if err := ApplyCACerts(cfg); err != nil {
+		return err
 	}
+	return ApplyProxy(cfg)
+}
 
-	if strings.HasPrefix(cfg.Maculaos.Token, "K10") {
-		vars = append(vars, fmt.Sprintf("K3S_TOKEN=%s", cfg.Maculaos.Token))
-	} else if cfg.Maculaos.Token != "" {
-		vars = append(vars, fmt.Sprintf("K3S_CLUSTER_SECRET=%s", cfg.Maculaos.Token))
-	}
+func ApplyCACertsNoRestart(cfg *config.CloudConfig) error {
+	return cacerts.ApplyCACerts(cfg, false)
+}
 
-	var labels []string
-	for k, v := range cfg.Maculaos.Labels {
-		labels = append(labels, fmt.Sprintf("%s=%s", k, v))
-	}
-	if mode != "" {
-		labels = append(labels, fmt.Sprintf("macula.io/mode=%s", mode))
-	}
-	labels = append(labels, fmt.Sprintf("macula.io/version=%s", version.Version))
-	sort.Strings(labels)
+func ApplyProxy(cfg *config.CloudConfig) error {
+	return proxy.ApplyProxy(cfg, true)
+}
 
-	for _, l := range labels {
-		args = append(args, "--node-label", l)
-	}
+func ApplyProxyNoRestart(cfg *config.CloudConfig) error {
+	return proxy.ApplyProxy(cfg, false)
+}
 
-	for _, taint := range cfg.Maculaos.Taints {
-		args = append(args, "--kubelet-arg", "register-with-taints="+taint)
-	}
+func ApplyRegistries(cfg *config.CloudConfig) error {
+	return registry.ApplyRegistries(cfg, true)
+}
 
-	cmd := exec.Command("/usr/libexec/macula/k3s-install.sh", args...)
-	cmd.Env = append(os.Environ(), vars...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
-	logrus.Debugf("Running %s %v %v", cmd.Path, cmd.Args, vars)
+func ApplyRegistriesNoRestart(cfg *config.CloudConfig) error {
+	return registry.ApplyRegistries(cfg, false)
+}
 
-	return cmd.Run()
+func ApplyFirewall(cfg *config.CloudConfig) error {
+	return firewall.Apply(cfg)
 }
 
 func ApplyInstall(cfg *config.CloudConfig) error {
@@ -175,7 +177,7 @@ func ApplyInstall(cfg *config.CloudConfig) error {
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
-	return cmd.Run()
+	return effects.Run(cmd)
 }
 
 func ApplyDNS(cfg *config.CloudConfig) error {
@@ -199,7 +201,7 @@ func ApplyDNS(cfg *config.CloudConfig) error {
 		buf.WriteString("\n")
 	}
 
-	err := ioutil.WriteFile("/etc/connman/main.conf", buf.Bytes(), 0644)
+	err := effects.WriteFile("/etc/connman/main.conf", buf.Bytes(), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write /etc/connman/main.conf: %v", err)
 	}
@@ -207,51 +209,32 @@ func ApplyDNS(cfg *config.CloudConfig) error {
 	return nil
 }
 
-func ApplyWifi(cfg *config.CloudConfig) error {
-	if len(cfg.Maculaos.Wifi) == 0 {
-		return nil
-	}
-
-	buf := &bytes.Buffer{}
+func ApplyNetwork(cfg *config.CloudConfig) error {
+	return network.ApplyNetwork(cfg, true)
+}
 
-	buf.WriteString("[WiFi]\n")
-	buf.WriteString("Enable=true\n")
-	buf.WriteString("Tethering=false\n")
+func ApplyNetworkNoRollback(cfg *config.CloudConfig) error {
+	return network.ApplyNetwork(cfg, false)
+}
 
-	if buf.Len() > 0 {
-		if err := os.MkdirAll("/var/lib/connman", 0755); err != nil {
-			return fmt.Errorf("failed to mkdir /var/lib/connman: %v", err)
-		}
-		if err := ioutil.WriteFile("/var/lib/connman/settings", buf.Bytes(), 0644); err != nil {
-			return fmt.Errorf("failed to write to /var/lib/connman/settings: %v", err)
-		}
+func ApplyTimezone(cfg *config.CloudConfig) error {
+	if cfg.Maculaos.Timezone == "" {
+		return nil
 	}
 
-	buf = &bytes.Buffer{}
-
-	buf.WriteString("[global]\n")
-	buf.WriteString("Name=cloud-config\n")
-	buf.WriteString("Description=Services defined in the cloud-config\n")
-
-	for i, w := range cfg.Maculaos.Wifi {
-		name := fmt.Sprintf("wifi%d", i)
-		buf.WriteString("[service_")
-		buf.WriteString(name)
-		buf.WriteString("]\n")
-		buf.WriteString("Type=wifi\n")
-		buf.WriteString("Passphrase=")
-		buf.WriteString(w.Passphrase)
-		buf.WriteString("\n")
-		buf.WriteString("Name=")
-		buf.WriteString(w.Name)
-		buf.WriteString("\n")
+	zoneinfo := filepath.Join("/usr/share/zoneinfo", cfg.Maculaos.Timezone)
+	if _, err := os.Stat(zoneinfo); err != nil {
+		return fmt.Errorf("unknown timezone %s: %v", cfg.Maculaos.Timezone, err)
 	}
 
-	if buf.Len() > 0 {
-		return ioutil.WriteFile("/var/lib/connman/cloud-config.config", buf.Bytes(), 0644)
+	if err := effects.Symlink(zoneinfo, "/etc/localtime"); err != nil {
+		return fmt.Errorf("failed to link /etc/localtime: %v", err)
 	}
+	return effects.WriteFile("/etc/timezone", []byte(cfg.Maculaos.Timezone+"\n"), 0644)
+}
 
-	return nil
+func ApplyWifi(cfg *config.CloudConfig) error {
+	return network.ApplyWifi(cfg)
 }
 
 func ApplyDataSource(cfg *config.CloudConfig) error {
@@ -262,11 +245,11 @@ func ApplyDataSource(cfg *config.CloudConfig) error {
 	args := strings.Join(cfg.Maculaos.DataSources, " ")
 	buf := &bytes.Buffer{}
 
-	buf.WriteString("command_args=\"")
+	buf.WriteString("datasources=\"")
 	buf.WriteString(args)
 	buf.WriteString("\"\n")
 
-	if err := ioutil.WriteFile("/etc/conf.d/cloud-config", buf.Bytes(), 0644); err != nil {
+	if err := effects.WriteFile("/etc/conf.d/cloud-config", buf.Bytes(), 0644); err != nil {
 		return fmt.Errorf("failed to write to /etc/conf.d/cloud-config: %v", err)
 	}
 
@@ -278,7 +261,7 @@ func ApplyEnvironment(cfg *config.CloudConfig) error {
 		return nil
 	}
 	env := make(map[string]string, len(cfg.Maculaos.Environment))
-	if buf, err := ioutil.ReadFile("/etc/environment"); err == nil {
+	if buf, err := effects.ReadFile("/etc/environment"); err == nil {
 		scanner := bufio.NewScanner(bytes.NewReader(buf))
 		for scanner.Scan() {
 			line := scanner.Text()
@@ -304,14 +287,20 @@ func ApplyEnvironment(cfg *config.CloudConfig) error {
 	for key, val := range cfg.Maculaos.Environment {
 		env[key] = val
 	}
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 	buf := &bytes.Buffer{}
-	for key, val := range env {
+	for _, key := range keys {
+		val := env[key]
 		buf.WriteString(key)
 		buf.WriteString("=")
 		buf.WriteString(strconv.Quote(val))
 		buf.WriteString("\n")
 	}
-	if err := ioutil.WriteFile("/etc/environment", buf.Bytes(), 0644); err != nil {
+	if err := effects.WriteFile("/etc/environment", buf.Bytes(), 0644); err != nil {
 		return fmt.Errorf("failed to write to /etc/environment: %v", err)
 	}
 
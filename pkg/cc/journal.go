@@ -0,0 +1,131 @@
+package cc
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/macula-io/macula-os/pkg/system"
+	"github.com/sirupsen/logrus"
+)
+
+// journalMaxSize is the size at which the persistent journal is rotated
+const journalMaxSize = 1 << 20
+
+var (
+	// RunJournal holds the applier results of the current boot
+	RunJournal = system.StatePath("apply.jsonl")
+	// LocalJournal keeps the applier results across boots
+	LocalJournal = system.LocalPath("apply.jsonl")
+)
+
+// writeJournal appends results to both journals. The local one may not be
+// mounted yet in the initrd, which is what the run journal is for.
+func writeJournal(results []Result) error {
+	var data []byte
+	for _, r := range results {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	runErr := appendJournal(RunJournal, data)
+	if err := appendJournal(LocalJournal, data); err != nil {
+		logrus.Debugf("failed to write %s: %v", LocalJournal, err)
+	}
+	return runErr
+}
+
+func appendJournal(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() > journalMaxSize {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// Journal returns the applier results recorded in both journals, oldest
+// first
+func Journal() ([]Result, error) {
+	type key struct {
+		name, phase string
+		time        int64
+	}
+	seen := map[key]bool{}
+
+	var results []Result
+	for _, path := range []string{LocalJournal + ".1", LocalJournal, RunJournal} {
+		entries, err := readJournal(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range entries {
+			k := key{r.Name, r.Phase, r.Time.UnixNano()}
+			if !seen[k] {
+				seen[k] = true
+				results = append(results, r)
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Time.Before(results[j].Time)
+	})
+	return results, nil
+}
+
+func readJournal(path string) ([]Result, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var results []Result
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := Result{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// a line cut short by a crash
+			continue
+		}
+		results = append(results, r)
+	}
+	return results, scanner.Err()
+}
+
+// LastResults returns the latest result of every applier of a phase, in the
+// order the phase runs them
+func LastResults(journal []Result, phase string) []Result {
+	latest := map[string]Result{}
+	for _, r := range journal {
+		if r.Phase == phase {
+			latest[r.Name] = r
+		}
+	}
+
+	var results []Result
+	for _, a := range phases[phase] {
+		name := applierName(a)
+		if r, ok := latest[name]; ok {
+			results = append(results, r)
+		}
+	}
+	return results
+}
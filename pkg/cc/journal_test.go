@@ -0,0 +1,54 @@
+package cc
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	defer func(run, local string) { RunJournal, LocalJournal = run, local }(RunJournal, LocalJournal)
+	RunJournal = filepath.Join(dir, "run", "apply.jsonl")
+	LocalJournal = filepath.Join(dir, "local", "apply.jsonl")
+
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// the initrd runs before the local journal is writable
+	if err := appendJournal(RunJournal, []byte(fmt.Sprintf(`{"name":"ApplyHostname","phase":"initrd","time":%q,"changed":true,"paths":["/etc/hostname"]}`+"\n", at.Format(time.RFC3339)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJournal([]Result{
+		{Name: "ApplySysctls", Phase: PhaseBoot, Time: at.Add(time.Second), Error: "permission denied"},
+		{Name: "ApplyModules", Phase: PhaseBoot, Time: at.Add(2 * time.Second)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJournal([]Result{
+		{Name: "ApplyModules", Phase: PhaseBoot, Time: at.Add(time.Minute), Changed: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := Journal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal) != 4 {
+		t.Fatalf("expected 4 results without duplicates, got %d", len(journal))
+	}
+
+	boot := LastResults(journal, PhaseBoot)
+	if len(boot) != 2 || boot[0].Name != "ApplyModules" || !boot[0].Changed || boot[1].Error != "permission denied" {
+		t.Errorf("unexpected boot results: %+v", boot)
+	}
+	if initrd := LastResults(journal, PhaseInitrd); len(initrd) != 1 || initrd[0].Paths[0] != "/etc/hostname" {
+		t.Errorf("unexpected initrd results: %+v", initrd)
+	}
+}
+
+func TestApplierName(t *testing.T) {
+	if name := applierName(ApplyK3SWithRestart); name != "ApplyK3SWithRestart" {
+		t.Errorf("applier name is %s", name)
+	}
+}
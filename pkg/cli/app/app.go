@@ -4,14 +4,20 @@ import (
 	"fmt"
 
 	"github.com/macula-io/macula-os/pkg/cli/backup"
+	"github.com/macula-io/macula-os/pkg/cli/ca"
 	"github.com/macula-io/macula-os/pkg/cli/config"
+	"github.com/macula-io/macula-os/pkg/cli/datasource"
 	"github.com/macula-io/macula-os/pkg/cli/diag"
 	"github.com/macula-io/macula-os/pkg/cli/encrypt"
+	"github.com/macula-io/macula-os/pkg/cli/firewall"
 	"github.com/macula-io/macula-os/pkg/cli/health"
+	"github.com/macula-io/macula-os/pkg/cli/images"
 	"github.com/macula-io/macula-os/pkg/cli/install"
 	"github.com/macula-io/macula-os/pkg/cli/mesh"
 	"github.com/macula-io/macula-os/pkg/cli/rc"
+	"github.com/macula-io/macula-os/pkg/cli/registry"
 	"github.com/macula-io/macula-os/pkg/cli/reset"
+	"github.com/macula-io/macula-os/pkg/cli/sysctl"
 	"github.com/macula-io/macula-os/pkg/cli/upgrade"
 	"github.com/macula-io/macula-os/pkg/version"
 	"github.com/sirupsen/logrus"
@@ -44,6 +50,7 @@ func New() *cli.App {
 	app.Commands = []cli.Command{
 		rc.Command(),
 		config.Command(),
+		datasource.Command(),
 		install.Command(),
 		upgrade.Command(),
 		diag.Command(),
@@ -52,6 +59,11 @@ func New() *cli.App {
 		mesh.Command(),
 		health.Command(),
 		backup.Command(),
+		sysctl.Command(),
+		firewall.Command(),
+		registry.Command(),
+		images.Command(),
+		ca.Command(),
 	}
 
 	app.Before = func(c *cli.Context) error {
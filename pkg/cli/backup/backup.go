@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/macula-io/macula-os/pkg/config"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"gopkg.in/yaml.v2"
@@ -30,6 +31,7 @@ const (
 	backupDir    = "/var/lib/maculaos/backups"
 	configDir    = "/var/lib/maculaos"
 	defaultPaths = "/var/lib/maculaos"
+	cronFile     = "/etc/cron.d/maculaos-backup"
 )
 
 // Command returns the `backup` sub-command for backup and restore
@@ -331,7 +333,10 @@ func restoreAction(c *cli.Context) error {
 	}
 
 	// Extract tarball
-	if err := extractTarball(backupPath, "/"); err != nil {
+	err := config.Track(config.Command(), func() error {
+		return extractTarball(backupPath, "/")
+	})
+	if err != nil {
 		return fmt.Errorf("restore failed: %v", err)
 	}
 
@@ -402,9 +407,7 @@ func scheduleAction(c *cli.Context) error {
 		return fmt.Errorf("failed to save config: %v", err)
 	}
 
-	// Install cron job
-	cronEntry := fmt.Sprintf("%s root /usr/bin/maculaos backup create --target=local\n", cfg.Schedule)
-	if err := os.WriteFile("/etc/cron.d/maculaos-backup", []byte(cronEntry), 0644); err != nil {
+	if err := installCron(cfg); err != nil {
 		logrus.Warnf("failed to install cron job: %v", err)
 	}
 
@@ -416,6 +419,27 @@ func scheduleAction(c *cli.Context) error {
 	return nil
 }
 
+// ApplySchedule installs the cron job of backup.yaml, or removes it when
+// automatic backups are not configured
+func ApplySchedule() error {
+	cfg, err := readBackupConfig()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if cfg == nil || !cfg.Enabled {
+		if err := os.Remove(cronFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return installCron(cfg)
+}
+
+func installCron(cfg *BackupConfig) error {
+	cronEntry := fmt.Sprintf("%s root /usr/bin/maculaos backup create --target=local\n", cfg.Schedule)
+	return os.WriteFile(cronFile, []byte(cronEntry), 0644)
+}
+
 // Helper functions
 
 func createTarball(dest string, paths []string, excludes []string) error {
@@ -638,7 +662,9 @@ func writeBackupConfig(cfg *BackupConfig) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile("/var/lib/maculaos/backup.yaml", data, 0644)
+	return config.Track(config.Command(), func() error {
+		return os.WriteFile("/var/lib/maculaos/backup.yaml", data, 0644)
+	})
 }
 
 func formatSize(bytes int64) string {
@@ -0,0 +1,146 @@
+package ca
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/macula-io/macula-os/pkg/cacerts"
+	"github.com/macula-io/macula-os/pkg/cc"
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/urfave/cli"
+)
+
+// Command returns the `ca` sub-command
+func Command() cli.Command {
+	return cli.Command{
+		Name:  "ca",
+		Usage: "manage the CA certificates trusted beyond the ones of the system",
+		Description: `
+CA certificates come from caCerts in the config and from the ones added with
+"maculaos ca add", which are kept in ` + cacerts.StoreDir + `.
+They are appended to ` + cacerts.SystemBundle + `, which
+k3s and containerd read, and trusted by every download and API call of
+maculaos, so that private registries, S3 endpoints and TLS-inspecting proxies
+can be reached.`,
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "list the CA certificates and where they come from",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "output in JSON format",
+					},
+				},
+				Action: listAction,
+			},
+			{
+				Name:      "add",
+				Usage:     "trust the CA certificates of a PEM file, or of stdin with -",
+				ArgsUsage: "<file|->",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "name",
+						Usage: "name to store the certificates under, default the start of the fingerprint",
+					},
+				},
+				Action: addAction,
+			},
+			{
+				Name:      "remove",
+				Usage:     "stop trusting CA certificates added before",
+				ArgsUsage: "<name|fingerprint>",
+				Action:    removeAction,
+			},
+		},
+	}
+}
+
+func listAction(c *cli.Context) error {
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+	certs, err := cacerts.Certs(&cfg)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		if certs == nil {
+			certs = []cacerts.Cert{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(certs)
+	}
+
+	fmt.Println("\033[1;36m=== CA Certificates ===\033[0m")
+	if len(certs) == 0 {
+		fmt.Println("  none")
+	}
+	for _, cert := range certs {
+		expiry := cert.NotAfter.Format("2006-01-02")
+		if time.Now().After(cert.NotAfter) {
+			expiry = "\033[1;31mexpired " + expiry + "\033[0m"
+		}
+		fmt.Printf("  %s\n", cert.Subject)
+		fmt.Printf("    %s %s, expires %s\n", cert.Source, cert.Name, expiry)
+		fmt.Printf("    sha256 %s\n", cert.Fingerprint)
+	}
+	return nil
+}
+
+func addAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: maculaos ca add <file|->")
+	}
+	if os.Getuid() != 0 {
+		return fmt.Errorf("must be run as root")
+	}
+
+	var data []byte
+	var err error
+	if c.Args().First() == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(c.Args().First())
+	}
+	if err != nil {
+		return err
+	}
+
+	name, err := cacerts.Add(c.String("name"), data)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added %s\n", name)
+	return apply()
+}
+
+func removeAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: maculaos ca remove <name|fingerprint>")
+	}
+	if os.Getuid() != 0 {
+		return fmt.Errorf("must be run as root")
+	}
+
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+	if err := cacerts.Remove(&cfg, c.Args().First()); err != nil {
+		return err
+	}
+	return apply()
+}
+
+func apply() error {
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+	return cc.ApplyCACertsAndProxy(&cfg)
+}
@@ -17,6 +17,8 @@ var (
 	installPhase = false
 	dump         = false
 	dumpJSON     = false
+	showSecrets  = false
+	plan         = false
 )
 
 // Command `config`
@@ -54,39 +56,121 @@ func Command() cli.Command {
 				Destination: &dumpJSON,
 				Usage:       "Print current configuration in json",
 			},
+			cli.BoolFlag{
+				Name:        "plan",
+				Destination: &plan,
+				Usage:       "Print the changes the stage would make without making them",
+			},
+			cli.BoolFlag{
+				Name:        "show-secrets",
+				Destination: &showSecrets,
+				Usage:       "Print secrets in plaintext with --dump and --dump-json, and the contents of private files and files holding secrets with --plan",
+			},
 		},
-		Before: func(c *cli.Context) error {
-			if os.Getuid() != 0 {
-				return fmt.Errorf("must be run as root")
-			}
-			return nil
+		Subcommands: []cli.Command{
+			validateCommand(),
+			schemaCommand(),
+			explainCommand(),
+			getCommand(),
+			setCommand(),
+			unsetCommand(),
+			encryptValueCommand(),
+			rekeyCommand(),
+			historyCommand(),
+			diffCommand(),
+			rollbackCommand(),
+			statusCommand(),
 		},
-		Action: func(*cli.Context) {
+		Action: func(c *cli.Context) error {
+			if err := requireRoot(c); err != nil {
+				return err
+			}
 			if err := Main(); err != nil {
 				logrus.Error(err)
 			}
+			return nil
 		},
 	}
 }
 
+func requireRoot(c *cli.Context) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("must be run as root")
+	}
+	return nil
+}
+
 // Main `config`
 func Main() error {
+	config.PreferIncludeCache = initrd || bootPhase
 	cfg, err := config.ReadConfig()
 	if err != nil {
 		return err
 	}
 
+	if !initrd && !dump && !dumpJSON && !plan {
+		// keep hand edits made since the last revision in the history
+		if _, err := config.Record(config.ManualEdit); err != nil {
+			logrus.Warnf("failed to record config history: %v", err)
+		}
+	}
+
+	if plan {
+		return planApply(&cfg)
+	}
+
 	if initrd {
 		return cc.InitApply(&cfg)
 	} else if bootPhase {
 		return cc.BootApply(&cfg)
 	} else if installPhase {
 		return cc.InstallApply(&cfg)
-	} else if dump {
-		return config.Write(cfg, os.Stdout)
-	} else if dumpJSON {
+	} else if dump || dumpJSON {
+		// only the output is redacted, never a config that is applied
+		if !showSecrets {
+			if cfg, err = config.Redact(cfg); err != nil {
+				return err
+			}
+		}
+		if dump {
+			return config.Write(cfg, os.Stdout)
+		}
 		return json.NewEncoder(os.Stdout).Encode(&cfg)
 	}
 
 	return cc.RunApply(&cfg)
 }
+
+// planApply runs the appliers of the selected stage in dry-run mode and
+// prints the changes they would make
+func planApply(cfg *config.CloudConfig) error {
+	phase := cc.PhaseRun
+	if initrd {
+		phase = cc.PhaseInitrd
+	} else if bootPhase {
+		phase = cc.PhaseBoot
+	} else if installPhase {
+		phase = cc.PhaseInstall
+	}
+
+	results, err := cc.Plan(phase, cfg, showSecrets)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, r := range results {
+		if r.Error != "" {
+			logrus.Warnf("%s: planning failed in part: %s", r.Name, r.Error)
+		}
+		if r.Diff == "" {
+			continue
+		}
+		changed = true
+		fmt.Printf("# %s\n%s", r.Name, r.Diff)
+	}
+	if !changed {
+		fmt.Println("No changes")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/ghodss/yaml"
+	"github.com/macula-io/macula-os/pkg/cc"
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/urfave/cli"
+)
+
+const pathHelp = `
+Keys are dotted paths in any spelling the config files accept, such as
+maculaos.labels, maculaos.k3s_args or writeFiles[0].path. A list index of [+]
+appends an item to the list of the other layers, as a +key does.`
+
+func getCommand() cli.Command {
+	return cli.Command{
+		Name:        "get",
+		Usage:       "print a configuration value",
+		ArgsUsage:   "[key]",
+		Description: "\nPrint the value of a key in the merged configuration, or all of it.\n" + pathHelp,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "output in JSON format",
+			},
+			cli.BoolFlag{
+				Name:  "show-secrets",
+				Usage: "print secrets in plaintext",
+			},
+		},
+		Before: requireRoot,
+		Action: getAction,
+	}
+}
+
+func setCommand() cli.Command {
+	return cli.Command{
+		Name:      "set",
+		Usage:     "set a configuration value",
+		ArgsUsage: "<key> <value>",
+		// values such as --disable=traefik are not flags of set
+		SkipArgReorder: true,
+		Description: `
+Set a key in ` + config.OverrideConfig + `, which overrides the other
+configuration files. Values are read as YAML unless the key is a string, so
+lists and maps can be given as [a, b] and {a: b}. The result is validated
+before it is written, and --apply puts the change into effect right away.
+` + pathHelp,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "apply",
+				Usage: "apply the change now",
+			},
+		},
+		Before: requireRoot,
+		Action: setAction,
+	}
+}
+
+func unsetCommand() cli.Command {
+	return cli.Command{
+		Name:      "unset",
+		Usage:     "remove a configuration value",
+		ArgsUsage: "<key>",
+		Description: `
+Remove a key from ` + config.OverrideConfig + `. Values set by other
+configuration files are left alone, and --apply puts the change into effect
+right away.
+` + pathHelp,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "apply",
+				Usage: "apply the change now",
+			},
+		},
+		Before: requireRoot,
+		Action: unsetAction,
+	}
+}
+
+func getAction(c *cli.Context) error {
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+	if !c.Bool("show-secrets") {
+		if cfg, err = config.Redact(cfg); err != nil {
+			return err
+		}
+	}
+	cfg.Maculaos.Install = nil
+
+	value, err := config.Get(cfg, c.Args().First())
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return fmt.Errorf("%s is not set", c.Args().First())
+	}
+
+	if c.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(value)
+	}
+	switch v := value.(type) {
+	case string:
+		fmt.Println(v)
+	case []interface{}, map[string]interface{}:
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(data))
+	default:
+		fmt.Println(v)
+	}
+	return nil
+}
+
+func setAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("usage: maculaos config set [--apply] <key> <value>")
+	}
+
+	key, err := config.Set(c.Args().Get(0), c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\033[1;32m✓\033[0m Set %s in %s\n", key, config.OverrideConfig)
+	return applyKey(c, key)
+}
+
+func unsetAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: maculaos config unset [--apply] <key>")
+	}
+
+	key, err := config.Unset(c.Args().First())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\033[1;32m✓\033[0m Removed %s from %s\n", key, config.OverrideConfig)
+
+	if provenance, err := config.Explain(); err == nil {
+		if keys := provenance.Keys(key); len(keys) > 0 {
+			origins := provenance[keys[0]]
+			fmt.Printf("  \033[1;33mNote:\033[0m %s is still set by %s\n", key, origins[len(origins)-1].Source)
+		}
+	}
+	return applyKey(c, key)
+}
+
+func applyKey(c *cli.Context, key string) error {
+	apply, ok := cc.KeyApplier(key)
+	if !c.Bool("apply") {
+		if ok {
+			fmt.Println("  Run 'maculaos config' or use --apply to apply it now")
+		} else {
+			fmt.Println("  The change takes effect at the next boot")
+		}
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("%s cannot be applied at runtime, it takes effect at the next boot", key)
+	}
+
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+	if err := apply(&cfg); err != nil {
+		return err
+	}
+	fmt.Printf("\033[1;32m✓\033[0m Applied %s\n", key)
+	return nil
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/urfave/cli"
+)
+
+func explainCommand() cli.Command {
+	return cli.Command{
+		Name:      "explain",
+		Usage:     "show which layer set each configuration value",
+		ArgsUsage: "[dotted.key]",
+		Description: `
+Merge the configuration layers the way the appliers see them and show, for
+every value at or below the given key, the file or reader that set it and the
+lower priority values it overrode or extended with a merge directive.`,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "output in JSON format",
+			},
+		},
+		Before: requireRoot,
+		Action: explainAction,
+	}
+}
+
+func explainAction(c *cli.Context) error {
+	provenance, err := config.Explain()
+	if err != nil {
+		return err
+	}
+
+	keys := provenance.Keys(c.Args().First())
+	if len(keys) == 0 {
+		return fmt.Errorf("%s is not set by any layer", c.Args().First())
+	}
+
+	if c.Bool("json") {
+		result := config.Provenance{}
+		for _, key := range keys {
+			result[key] = provenance[key]
+		}
+		return json.NewEncoder(os.Stdout).Encode(result)
+	}
+
+	for _, key := range keys {
+		origins := provenance[key]
+		effective := origins[len(origins)-1]
+		fmt.Printf("\033[1;36m%s\033[0m = %s\n", key, formatValue(effective.Value))
+		fmt.Printf("    %s by %s\n", mergeVerb(effective.Merge), effective.Source)
+		for i := len(origins) - 2; i >= 0; i-- {
+			relation := "overrides"
+			if origins[i+1].Merge != "" {
+				relation = "extends"
+			}
+			fmt.Printf("    \033[1;90m%s %s from %s\033[0m\n", relation, formatValue(origins[i].Value), origins[i].Source)
+		}
+	}
+	return nil
+}
+
+func mergeVerb(directive string) string {
+	switch directive {
+	case config.MergeAppend:
+		return "appended"
+	case config.MergePrepend:
+		return "prepended"
+	case config.MergeUnion:
+		return "merged"
+	}
+	return "set"
+}
+
+func formatValue(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
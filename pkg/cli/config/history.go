@@ -0,0 +1,183 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/cc"
+	"github.com/macula-io/macula-os/pkg/cli/backup"
+	"github.com/macula-io/macula-os/pkg/cli/mesh"
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/services"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// healthService runs maculaos health watch, which reads health.yaml when it
+// starts
+const healthService = "health-daemon"
+
+func historyCommand() cli.Command {
+	return cli.Command{
+		Name:  "history",
+		Usage: "list the recorded revisions of the local configuration",
+		Description: `
+List the revisions of config.yaml, config.d and the mesh, health and backup
+configs kept in ` + config.HistoryDir + `, with the command that made each
+change. Changes made by hand are recorded as "` + config.ManualEdit + `".`,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "output in JSON format",
+			},
+		},
+		Before: requireRoot,
+		Action: historyAction,
+	}
+}
+
+func diffCommand() cli.Command {
+	return cli.Command{
+		Name:      "diff",
+		Usage:     "show the changes between two revisions",
+		ArgsUsage: "<rev> [<rev>]",
+		Description: `
+Show a unified diff of the local configuration from the first revision to the
+second, or to the files as they are now when only one is given.`,
+		Before: requireRoot,
+		Action: diffAction,
+	}
+}
+
+func rollbackCommand() cli.Command {
+	return cli.Command{
+		Name:      "rollback",
+		Usage:     "restore the local configuration of a revision and apply it",
+		ArgsUsage: "<rev>",
+		Description: `
+Restore config.yaml, config.d and the mesh, health and backup configs as they
+were at a revision, with their permissions, record the result as a new
+revision and apply it. Mesh apply, the health daemon and the backup schedule
+are re-run when their configs changed. The state before the rollback stays in
+the history, so a rollback can be undone by rolling back again.`,
+		Before: requireRoot,
+		Action: rollbackAction,
+	}
+}
+
+func historyAction(c *cli.Context) error {
+	// hand edits made since the last revision show up as a revision of their own
+	if _, err := config.Record(config.ManualEdit); err != nil {
+		logrus.Warnf("failed to record config history: %v", err)
+	}
+
+	revisions, err := config.History()
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(revisions)
+	}
+
+	if len(revisions) == 0 {
+		fmt.Println("No configuration changes recorded")
+		return nil
+	}
+
+	fmt.Printf("\033[1;36m%-5s %-20s %s\033[0m\n", "REV", "TIME", "COMMAND")
+	for i := len(revisions) - 1; i >= 0; i-- {
+		rev := revisions[i]
+		fmt.Printf("%-5d %-20s %s\n", rev.ID, rev.Time.Local().Format("2006-01-02 15:04:05"), rev.Command)
+		fmt.Printf("      \033[1;90m%s\033[0m\n", strings.Join(rev.Files, ", "))
+	}
+	return nil
+}
+
+func diffAction(c *cli.Context) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		return fmt.Errorf("usage: maculaos config diff <rev> [<rev>]")
+	}
+
+	from, err := parseRevision(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	to := 0
+	if c.NArg() == 2 {
+		if to, err = parseRevision(c.Args().Get(1)); err != nil {
+			return err
+		}
+	}
+
+	diff, err := config.Diff(from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Print(diff)
+	return nil
+}
+
+func rollbackAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: maculaos config rollback <rev>")
+	}
+
+	id, err := parseRevision(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	rev, err := config.Rollback(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\033[1;32m✓\033[0m Restored revision %d as revision %d\n", id, rev.ID)
+
+	// a failed applier does not keep the mesh, health and backup configs from
+	// being applied, they are restored all the same
+	var errors []error
+	cfg, err := config.ReadConfig()
+	if err == nil {
+		err = cc.RunApply(&cfg)
+	}
+	if err != nil {
+		errors = append(errors, err)
+	}
+
+	// the mesh, health and backup configs are applied by their own commands
+	changed, err := config.ChangedFiles(rev.ID-1, rev.ID)
+	if err != nil {
+		errors = append(errors, err)
+	}
+	for _, name := range changed {
+		err = nil
+		switch name {
+		case "mesh.yaml":
+			err = mesh.Apply()
+		case "health.yaml":
+			err = services.RestartIfRunning(healthService, "the restored config")
+		case "backup.yaml":
+			err = backup.ApplySchedule()
+		}
+		if err != nil {
+			errors = append(errors, fmt.Errorf("applying %s: %v", name, err))
+		}
+	}
+
+	if len(errors) > 0 {
+		return cli.NewMultiError(errors...)
+	}
+	return nil
+}
+
+func parseRevision(arg string) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(arg, "r"))
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid revision %q", arg)
+	}
+	return id, nil
+}
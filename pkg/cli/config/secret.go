@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/urfave/cli"
+)
+
+var (
+	recipient     = ""
+	showRecipient = false
+)
+
+func encryptValueCommand() cli.Command {
+	return cli.Command{
+		Name:      "encrypt-value",
+		Usage:     "encrypt a secret for use in config.yaml",
+		ArgsUsage: "[value]",
+		Description: `
+Encrypt a value, read from stdin when not given, and print it as an ENC[...]
+string that can replace the plaintext in any config layer. Values are
+encrypted for this node's key unless --recipient names another node's key,
+as printed on that node by --show-recipient.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "recipient",
+				Destination: &recipient,
+				Usage:       "public key to encrypt for (default: this node)",
+			},
+			cli.BoolFlag{
+				Name:        "show-recipient",
+				Destination: &showRecipient,
+				Usage:       "print this node's public key and exit",
+			},
+		},
+		Action: encryptValueAction,
+	}
+}
+
+func encryptValueAction(c *cli.Context) error {
+	if recipient == "" || showRecipient {
+		if err := requireRoot(c); err != nil {
+			return err
+		}
+		nodeRecipient, err := config.Recipient()
+		if err != nil {
+			return err
+		}
+		if showRecipient {
+			fmt.Println(nodeRecipient)
+			return nil
+		}
+		recipient = nodeRecipient
+	}
+
+	value := c.Args().First()
+	if !c.Args().Present() {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	}
+
+	encrypted, err := config.EncryptValue(recipient, value)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encrypted)
+	return nil
+}
+
+func rekeyCommand() cli.Command {
+	return cli.Command{
+		Name:      "rekey",
+		Usage:     "rotate the node key and re-encrypt config secrets",
+		ArgsUsage: "[file...]",
+		Description: `
+Generate a new node key and re-encrypt every ENC[...] value in the given
+files, or in /var/lib/maculaos/config.yaml and config.d by default. Files
+keep their layout and comments, and nothing is changed unless every value
+can be decrypted with the current key.`,
+		Before: requireRoot,
+		Action: rekeyAction,
+	}
+}
+
+func rekeyAction(c *cli.Context) error {
+	files := []string(c.Args())
+	if len(files) == 0 {
+		files = config.LocalFiles()
+	}
+
+	if err := config.Rekey(files); err != nil {
+		return err
+	}
+
+	nodeRecipient, err := config.Recipient()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\033[1;32m✓\033[0m Re-encrypted secrets for %s\n", nodeRecipient)
+	return nil
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/macula-io/macula-os/pkg/cc"
+	"github.com/urfave/cli"
+)
+
+func statusCommand() cli.Command {
+	return cli.Command{
+		Name:  "status",
+		Usage: "show the result of the last apply of each stage",
+		Description: `
+Show, for the initrd, boot and run stages, the last result of every applier as
+recorded in ` + cc.RunJournal + ` and ` + cc.LocalJournal + `: whether it
+changed the system, how long it took, the files it changed and its error.`,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "output in JSON format",
+			},
+		},
+		Before: requireRoot,
+		Action: statusAction,
+	}
+}
+
+func statusAction(c *cli.Context) error {
+	journal, err := cc.Journal()
+	if err != nil {
+		return err
+	}
+
+	status := map[string][]cc.Result{}
+	phases := []string{cc.PhaseInitrd, cc.PhaseBoot, cc.PhaseRun, cc.PhaseInstall}
+	for _, phase := range phases {
+		if results := cc.LastResults(journal, phase); len(results) > 0 {
+			status[phase] = results
+		}
+	}
+
+	if c.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(status)
+	}
+
+	if len(status) == 0 {
+		fmt.Println("No applies recorded")
+		return nil
+	}
+
+	for _, phase := range phases {
+		results := status[phase]
+		if len(results) == 0 {
+			continue
+		}
+		fmt.Printf("\033[1;36m=== %s (%s) ===\033[0m\n", phase, results[len(results)-1].Time.Local().Format("2006-01-02 15:04:05"))
+		for _, r := range results {
+			mark, state := "\033[1;32m✓\033[0m", "unchanged"
+			if r.Changed {
+				state = "changed"
+			}
+			if r.Error != "" {
+				mark, state = "\033[1;31m✗\033[0m", "failed"
+			}
+			fmt.Printf("  %s %-22s %-10s %8s", mark, r.Name, state, r.Duration.Round(time.Millisecond))
+			if len(r.Paths) > 0 {
+				fmt.Printf("  %s", strings.Join(r.Paths, ", "))
+			}
+			fmt.Println()
+			if r.Error != "" {
+				fmt.Printf("      \033[1;31m%s\033[0m\n", r.Error)
+			}
+		}
+		fmt.Println()
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/urfave/cli"
+)
+
+func validateCommand() cli.Command {
+	return cli.Command{
+		Name:      "validate",
+		Usage:     "check configuration files against the schema",
+		ArgsUsage: "[file...]",
+		Description: `
+Report unknown keys, type mismatches, invalid enum values and malformed
+durations or cron expressions. Without arguments every layer that makes up
+the effective configuration is checked.`,
+		Action: validateAction,
+	}
+}
+
+func schemaCommand() cli.Command {
+	return cli.Command{
+		Name:   "schema",
+		Usage:  "print the JSON Schema of the configuration",
+		Action: schemaAction,
+	}
+}
+
+func validateAction(c *cli.Context) error {
+	var problems []config.ValidationError
+	if c.NArg() == 0 {
+		result, err := config.Validate()
+		if err != nil {
+			return err
+		}
+		problems = result
+	}
+	for _, file := range c.Args() {
+		result, err := config.ValidateFile(file)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, result...)
+	}
+
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p.Error())
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s)", len(problems))
+	}
+
+	fmt.Println("\033[1;32m✓\033[0m Configuration is valid")
+	return nil
+}
+
+func schemaAction(c *cli.Context) error {
+	data, err := config.JSONSchema()
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
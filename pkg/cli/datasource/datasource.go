@@ -0,0 +1,87 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/datasource"
+	"github.com/urfave/cli"
+)
+
+var (
+	timeout time.Duration
+	wait    time.Duration
+)
+
+// Command returns the `datasource` sub-command that fetches instance metadata
+func Command() cli.Command {
+	return cli.Command{
+		Name:      "datasource",
+		Usage:     "fetch instance metadata from cloud datasources",
+		ArgsUsage: "[provider...]",
+		Description: `
+Read the hostname, SSH keys and userdata of this instance from the first
+datasource that answers and write them to /run/config, where the config
+layers pick them up. Providers are tried in the order given, or in the order
+of maculaos.dataSources when none are given.
+
+Providers:
+  - cdrom:        NoCloud seed image labelled cidata (alias: nocloud)
+  - openstack:    OpenStack config drive labelled config-2
+  - aws:          EC2 instance metadata service (IMDSv2)
+  - gce:          Google Compute Engine metadata server
+  - digitalocean: DigitalOcean droplet metadata
+  - packet:       Equinix Metal metadata
+  - none:         do nothing`,
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:        "timeout",
+				Usage:       "time each provider has to answer",
+				Value:       datasource.DefaultTimeout,
+				Destination: &timeout,
+			},
+			cli.DurationFlag{
+				Name:        "wait",
+				Usage:       "how long to keep retrying while no provider answers",
+				Value:       datasource.DefaultWait,
+				Destination: &wait,
+			},
+		},
+		Action: run,
+	}
+}
+
+func run(c *cli.Context) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("must be run as root")
+	}
+
+	names := []string(c.Args())
+	if len(names) == 0 {
+		cfg, err := config.ReadConfig()
+		if err != nil {
+			return err
+		}
+		names = cfg.Maculaos.DataSources
+	}
+
+	providers, err := datasource.Providers(names)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	p, err := datasource.Run(ctx, providers, timeout)
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		fmt.Printf("\033[1;32m✓\033[0m Metadata read from %s\n", p)
+	}
+	return nil
+}
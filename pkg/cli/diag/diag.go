@@ -9,6 +9,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/macula-io/macula-os/pkg/httpclient"
+	"github.com/macula-io/macula-os/pkg/swap"
 	"github.com/macula-io/macula-os/pkg/version"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -134,6 +136,24 @@ func runSystem(c *cli.Context) error {
 		printStatus("Memory", memOk, fmt.Sprintf("%dMB / %dMB (%.1f%%)", usedMB, totalMB, pct))
 	}
 
+	// Swap
+	if swaps, err := swap.Swaps(); err == nil {
+		if len(swaps) == 0 {
+			printStatus("Swap", true, "none")
+		}
+		for _, s := range swaps {
+			pct := float64(0)
+			if s.Size > 0 {
+				pct = float64(s.Used) / float64(s.Size) * 100
+			}
+			printStatus("Swap ("+s.Path+")", pct < 80, fmt.Sprintf("%dMB / %dMB (%.1f%%), priority %d", s.Used/1024/1024, s.Size/1024/1024, pct, s.Priority))
+		}
+	}
+	if zram, ok := swap.Zram(); ok && zram.Original > 0 {
+		ratio := float64(zram.Original) / float64(zram.Compressed)
+		printStatus("zram", true, fmt.Sprintf("%dMB stored in %dMB of memory (%.1fx, %s)", zram.Original/1024/1024, zram.Memory/1024/1024, ratio, zram.Algorithm))
+	}
+
 	// Disk usage for root
 	var stat syscall.Statfs_t
 	if err := syscall.Statfs("/", &stat); err == nil {
@@ -208,8 +228,11 @@ func runNetwork(c *cli.Context) error {
 		printStatus("Internet (ping)", false, "unreachable")
 	}
 
-	// HTTPS connectivity
-	if err := exec.Command("curl", "-s", "-o", "/dev/null", "-w", "", "--max-time", "5", "https://boot.macula.io").Run(); err == nil {
+	// HTTPS connectivity, through the proxy if there is one
+	client := httpclient.Client()
+	client.Timeout = 5 * time.Second
+	if resp, err := client.Get("https://boot.macula.io"); err == nil {
+		resp.Body.Close()
 		printStatus("HTTPS (boot.macula.io)", true, "reachable")
 	} else {
 		printStatus("HTTPS (boot.macula.io)", false, "unreachable")
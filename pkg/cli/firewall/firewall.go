@@ -0,0 +1,77 @@
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/macula-io/macula-os/pkg/firewall"
+	"github.com/urfave/cli"
+)
+
+// Command returns the `firewall` sub-command
+func Command() cli.Command {
+	return cli.Command{
+		Name:  "firewall",
+		Usage: "inspect the firewall",
+		Subcommands: []cli.Command{
+			{
+				Name:  "status",
+				Usage: "show the live ruleset and who registered its rules",
+				Description: `
+Show the nftables table "` + firewall.Table + `" as loaded in the kernel and the
+rules that mesh roles, k3s and the firstboot server registered in
+` + firewall.RulesDir + `. Rules of the firewall section of the config are
+commented "config" in the ruleset.`,
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "output in JSON format",
+					},
+				},
+				Action: statusAction,
+			},
+		},
+	}
+}
+
+func statusAction(c *cli.Context) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("must be run as root")
+	}
+
+	ruleset, err := firewall.Status(c.Bool("json"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("json") {
+		_, err := os.Stdout.Write(ruleset)
+		return err
+	}
+
+	owners, err := firewall.Owners()
+	if err != nil {
+		return err
+	}
+	fmt.Println("\033[1;36m=== Registered Rules ===\033[0m")
+	if len(owners) == 0 {
+		fmt.Println("  none")
+	}
+	var names []string
+	for name := range owners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %s:\n", name)
+		for _, r := range owners[name] {
+			data, _ := json.Marshal(r)
+			fmt.Printf("    %s\n", data)
+		}
+	}
+
+	fmt.Println("\n\033[1;36m=== Ruleset ===\033[0m")
+	fmt.Print(string(ruleset))
+	return nil
+}
@@ -3,7 +3,6 @@ package health
 import (
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
 	"os/exec"
 	"strconv"
@@ -11,6 +10,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/httpclient"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"gopkg.in/yaml.v2"
@@ -413,7 +414,8 @@ func checkHTTP(check *HealthCheck) HealthResult {
 		}
 	}
 
-	client := &http.Client{Timeout: timeout}
+	client := httpclient.Client()
+	client.Timeout = timeout
 	resp, err := client.Get(check.URL)
 	if err != nil {
 		result.Status = "fail"
@@ -555,5 +557,7 @@ func writeHealthConfig(cfg *HealthConfig) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile("/var/lib/maculaos/health.yaml", data, 0644)
+	return config.Track(config.Command(), func() error {
+		return os.WriteFile("/var/lib/maculaos/health.yaml", data, 0644)
+	})
 }
@@ -0,0 +1,192 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/images"
+	"github.com/macula-io/macula-os/pkg/services"
+	"github.com/urfave/cli"
+)
+
+// Command returns the `images` sub-command
+func Command() cli.Command {
+	return cli.Command{
+		Name:  "images",
+		Usage: "manage the images k3s imports for air-gapped operation",
+		Subcommands: []cli.Command{
+			{
+				Name:      "import",
+				Usage:     "import image archives from a file, a directory, an ISO or a USB stick",
+				ArgsUsage: "<tar|dir|iso|usb>",
+				Description: `
+Copy archives of images, as written by docker save or ctr export, to
+` + images.Dir + `, which k3s imports when it
+starts. Archives compressed with gzip are decompressed; .tar.zst, .tar.lz4 and
+.tar.bz2 archives are copied as they are.
+
+An .iso file is mounted read-only and its ` + images.MediaDir + ` directory
+imported. With usb, the ` + images.MediaDir + ` directory of every USB stick,
+CD and ISO attached is imported, mounting them read-only if needed. A
+directory can hold
+a ` + images.SumsFile + ` file, as written by sha256sum, which every archive
+must then match. When k3s is running, the images are loaded into containerd
+right away.`,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "sha256",
+						Usage: "digest the archive must match",
+					},
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "output in JSON format",
+					},
+				},
+				Action: importAction,
+			},
+			{
+				Name:  "list",
+				Usage: "list the image archives and whether containerd holds their images",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "output in JSON format",
+					},
+				},
+				Action: listAction,
+			},
+		},
+	}
+}
+
+func importAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: maculaos images import <tar|dir|iso|usb>")
+	}
+	if os.Getuid() != 0 {
+		return fmt.Errorf("must be run as root")
+	}
+
+	sources := []string{c.Args().First()}
+	if sources[0] == "usb" {
+		if c.String("sha256") != "" {
+			return fmt.Errorf("--sha256 only applies to an archive, put a %s file on the USB stick instead", images.SumsFile)
+		}
+		dirs, release, err := images.Media()
+		if err != nil {
+			return err
+		}
+		defer release()
+		sources = dirs
+	}
+
+	var archives []images.Archive
+	var errors []string
+	for _, source := range sources {
+		result, err := images.Import(source, c.String("sha256"))
+		archives = append(archives, result...)
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if services.Running(services.K3s) {
+		for _, a := range archives {
+			if !a.Changed {
+				continue
+			}
+			if !strings.HasSuffix(a.Name, ".tar") {
+				fmt.Fprintf(os.Stderr, "%s is loaded when k3s restarts\n", a.Name)
+				continue
+			}
+			if err := images.Load(a); err != nil {
+				errors = append(errors, err.Error())
+			}
+		}
+	}
+
+	if c.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(archives); err != nil {
+			return err
+		}
+	} else {
+		for _, a := range archives {
+			state := "up to date"
+			if a.Changed {
+				state = "imported"
+			}
+			if a.Verified {
+				state += ", verified"
+			} else {
+				state += ", \033[1;33mnot verified\033[0m"
+			}
+			fmt.Printf("\033[1;32m✓\033[0m %s (%s)\n", a.Name, state)
+			for _, image := range a.Images {
+				fmt.Printf("    %s\n", image)
+			}
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+func listAction(c *cli.Context) error {
+	archives, err := images.List()
+	if err != nil {
+		return err
+	}
+	// without a running k3s only the archives are listed
+	loaded, loadedErr := images.Loaded()
+
+	if c.Bool("json") {
+		type image struct {
+			Name   string `json:"name"`
+			Loaded *bool  `json:"loaded,omitempty"`
+		}
+		type archive struct {
+			Name   string  `json:"name"`
+			Images []image `json:"images"`
+		}
+		var result []archive
+		for _, a := range archives {
+			entry := archive{Name: a.Name, Images: []image{}}
+			for _, name := range a.Images {
+				i := image{Name: name}
+				if loadedErr == nil {
+					ok := loaded[name]
+					i.Loaded = &ok
+				}
+				entry.Images = append(entry.Images, i)
+			}
+			result = append(result, entry)
+		}
+		return json.NewEncoder(os.Stdout).Encode(result)
+	}
+
+	fmt.Printf("\033[1;36m=== %s ===\033[0m\n", images.Dir)
+	if len(archives) == 0 {
+		fmt.Println("  No image archives")
+	}
+	for _, a := range archives {
+		fmt.Printf("  %s\n", a.Name)
+		for _, name := range a.Images {
+			switch {
+			case loadedErr != nil:
+				fmt.Printf("    • %s\n", name)
+			case loaded[name]:
+				fmt.Printf("    \033[1;32m✓\033[0m %s\n", name)
+			default:
+				fmt.Printf("    \033[1;31m✗\033[0m %s (not loaded)\n", name)
+			}
+		}
+	}
+	if loadedErr != nil {
+		fmt.Printf("\n  k3s is not running, the images loaded are unknown\n")
+	}
+	return nil
+}
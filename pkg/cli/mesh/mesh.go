@@ -7,6 +7,9 @@ import (
 	"os/exec"
 	"strings"
 
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/firewall"
+	"github.com/macula-io/macula-os/pkg/services"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"gopkg.in/yaml.v2"
@@ -270,6 +273,12 @@ func wizardAction(c *cli.Context) error {
 }
 
 func applyAction(c *cli.Context) error {
+	return Apply()
+}
+
+// Apply enables the mesh services of mesh.yaml, opens their ports and
+// restarts them
+func Apply() error {
 	fmt.Println("\033[1;36m=== Applying Mesh Configuration ===\033[0m")
 
 	cfg, err := readMeshConfig()
@@ -358,7 +367,9 @@ func writeMeshConfig(cfg *MeshConfig) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile("/var/lib/maculaos/mesh.yaml", data, 0644)
+	return config.Track(config.Command(), func() error {
+		return os.WriteFile("/var/lib/maculaos/mesh.yaml", data, 0644)
+	})
 }
 
 func checkService(name string) {
@@ -371,52 +382,44 @@ func checkService(name string) {
 }
 
 func enableService(name string) error {
-	// Add to default runlevel
-	cmd := exec.Command("rc-update", "add", name, "default")
-	return cmd.Run()
+	return services.Enable(name, "default")
 }
 
 func disableService(name string) error {
-	// Remove from default runlevel
-	cmd := exec.Command("rc-update", "del", name, "default")
-	return cmd.Run()
+	return services.Disable(name)
 }
 
 func restartService(name string) error {
-	cmd := exec.Command("rc-service", name, "restart")
-	return cmd.Run()
+	return services.Restart(name)
 }
 
 func configureFirewall(cfg *MeshConfig) error {
-	// Open necessary ports based on roles
-	ports := []string{}
+	// Open necessary ports based on roles, on the ports the services are
+	// configured with in conf.d. Mesh always needs outbound, which the
+	// firewall allows as it only filters input.
+	var rules []config.FirewallRule
 
-	// Mesh always needs outbound
-	// Bootstrap needs 443 for QUIC
+	// Bootstrap needs its port for QUIC
 	if cfg.Roles.Bootstrap {
-		ports = append(ports, "443/tcp", "443/udp")
+		port := services.ConfValue("macula-bootstrap", "BOOTSTRAP_PORT", "443")
+		rules = append(rules,
+			config.FirewallRule{Port: port, Protocol: "tcp"},
+			config.FirewallRule{Port: port, Protocol: "udp"})
 	}
 
-	// Gateway needs 443 and 80
+	// Gateway needs HTTP as well
 	if cfg.Roles.Gateway {
-		ports = append(ports, "443/tcp", "443/udp", "80/tcp")
+		https := services.ConfValue("macula-gateway", "GATEWAY_HTTPS_PORT", "443")
+		rules = append(rules,
+			config.FirewallRule{Port: services.ConfValue("macula-gateway", "GATEWAY_HTTP_PORT", "80"), Protocol: "tcp"},
+			config.FirewallRule{Port: https, Protocol: "tcp"},
+			config.FirewallRule{Port: https, Protocol: "udp"})
 	}
 
-	// Apply firewall rules using iptables
-	for _, port := range ports {
-		parts := strings.Split(port, "/")
-		if len(parts) != 2 {
-			continue
-		}
-		portNum, proto := parts[0], parts[1]
-
-		cmd := exec.Command("iptables", "-A", "INPUT", "-p", proto, "--dport", portNum, "-j", "ACCEPT")
-		if err := cmd.Run(); err != nil {
-			logrus.Warnf("failed to add iptables rule for %s: %v", port, err)
-		}
+	if err := firewall.Register("mesh", rules); err != nil {
+		return err
 	}
-
-	return nil
+	return firewall.Reload()
 }
 
 func boolToStatus(b bool) string {
@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/registry"
+	"github.com/urfave/cli"
+)
+
+// Command returns the `registry` sub-command
+func Command() cli.Command {
+	return cli.Command{
+		Name:  "registry",
+		Usage: "check the registries images are pulled from",
+		Subcommands: []cli.Command{
+			{
+				Name:      "test",
+				Usage:     "resolve an image at each mirror of its registry",
+				ArgsUsage: "<image>",
+				Description: `
+Resolve the manifest of an image, such as nginx:1.27 or ghcr.io/org/app:v1, at
+every endpoint containerd would try for it: the mirrors of its registry under
+registries:, then the registry itself. Each endpoint is contacted with the
+credentials and TLS settings configured for it, so that a wrong password, a
+missing CA or an image the mirror does not have shows up before k3s needs it.`,
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "output in JSON format",
+					},
+				},
+				Action: testAction,
+			},
+		},
+	}
+}
+
+func testAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: maculaos registry test <image>")
+	}
+	// the config holds the credentials of the registries
+	if os.Getuid() != 0 {
+		return fmt.Errorf("must be run as root")
+	}
+
+	image, err := registry.ParseImage(c.Args().First())
+	if err != nil {
+		return err
+	}
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	results := registry.Check(cfg.Registries, image)
+	ok := false
+	for _, r := range results {
+		ok = ok || r.Error == ""
+	}
+
+	if c.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"image":   image,
+			"results": results,
+		}); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("\033[1;36m=== %s ===\033[0m\n", image)
+		for _, r := range results {
+			if r.Error != "" {
+				fmt.Printf("  \033[1;31m✗\033[0m %s: %s\n", r.Endpoint, r.Error)
+			} else {
+				fmt.Printf("  \033[1;32m✓\033[0m %s: %s\n", r.Endpoint, r.Digest)
+			}
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("%s cannot be pulled from any endpoint", image)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package sysctl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/macula-io/macula-os/pkg/cc"
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/sysctl"
+	"github.com/macula-io/macula-os/pkg/util"
+	"github.com/urfave/cli"
+)
+
+// profilePrefix names the config.d layer of the selected profile. It is merged
+// after config.yaml and below 99-override.yaml, so that only keys set with
+// 'maculaos config set' override the ones of the profile.
+const profilePrefix = "50-sysctl-profile-"
+
+// Command returns the `sysctl` sub-command
+func Command() cli.Command {
+	return cli.Command{
+		Name:  "sysctl",
+		Usage: "manage kernel parameters",
+		Subcommands: []cli.Command{
+			{
+				Name:      "profile",
+				Usage:     "list or select a preset of sysctls",
+				ArgsUsage: "[<name>|none]",
+				Description: `
+Without arguments, list the presets and show which one is selected. With a
+name, write the preset to ` + config.LayerPath(profilePrefix+"<name>.yaml") + `
+and apply it; "none" removes it again. The profile is added to the sysctls
+of config.yaml and overrides the keys it shares with them; only the keys set
+with 'maculaos config set' take precedence over the ones of the profile.`,
+				Action: profileAction,
+			},
+		},
+	}
+}
+
+func profileAction(c *cli.Context) error {
+	active := activeProfile()
+	if c.NArg() == 0 {
+		for _, p := range sysctl.Profiles {
+			mark := " "
+			if p.Name == active {
+				mark = "\033[1;32m✓\033[0m"
+			}
+			fmt.Printf("%s \033[1;36m%s\033[0m: %s\n", mark, p.Name, p.Description)
+			var keys []string
+			for k := range p.Sysctls {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Printf("      %s = %s\n", k, p.Sysctls[k])
+			}
+		}
+		return nil
+	}
+	if c.NArg() > 1 {
+		return fmt.Errorf("usage: maculaos sysctl profile [<name>|none]")
+	}
+	if os.Getuid() != 0 {
+		return fmt.Errorf("must be run as root")
+	}
+
+	name := c.Args().First()
+	var content []byte
+	if name != "none" {
+		profile, ok := sysctl.FindProfile(name)
+		if !ok {
+			var names []string
+			for _, p := range sysctl.Profiles {
+				names = append(names, p.Name)
+			}
+			return fmt.Errorf("unknown profile %q, must be one of: %s, none", name, strings.Join(names, ", "))
+		}
+		// appended, so that the sysctls of the other layers are kept
+		var err error
+		layer := map[string]interface{}{"maculaos": map[string]interface{}{"+sysctls": profile.Sysctls}}
+		if content, err = yaml.Marshal(layer); err != nil {
+			return err
+		}
+	}
+
+	err := config.Track(config.Command(), func() error {
+		if active != "" && active != name {
+			if err := os.Remove(config.LayerPath(profilePrefix + active + ".yaml")); err != nil {
+				return err
+			}
+		}
+		if content == nil {
+			return nil
+		}
+		path := config.LayerPath(profilePrefix + name + ".yaml")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return util.WriteFileAtomic(path, content, 0600)
+	})
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+	if err := cc.ApplySysctls(&cfg); err != nil {
+		return err
+	}
+	if content == nil {
+		fmt.Println("\033[1;32m✓\033[0m Removed the sysctl profile, its values stay in effect until the next boot")
+	} else {
+		fmt.Printf("\033[1;32m✓\033[0m Applied sysctl profile %s\n", name)
+	}
+	return nil
+}
+
+// activeProfile returns the name of the selected profile, if any
+func activeProfile() string {
+	matches, _ := filepath.Glob(config.LayerPath(profilePrefix + "*.yaml"))
+	if len(matches) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(filepath.Base(matches[0]), profilePrefix), ".yaml")
+}
@@ -33,20 +33,23 @@ func Run() error {
 		return err
 	}
 
-	f, err := os.Create(config.SystemConfig)
-	if err != nil {
-		f, err = os.Create(config.LocalConfig)
+	err = config.Track(config.Command(), func() error {
+		f, err := os.Create(config.SystemConfig)
 		if err != nil {
-			return err
+			f, err = os.Create(config.LocalConfig)
+			if err != nil {
+				return err
+			}
 		}
-	}
-	defer f.Close()
+		defer f.Close()
 
-	if _, err := f.Write(bytes); err != nil {
+		_, err = f.Write(bytes)
+		return err
+	})
+	if err != nil {
 		return err
 	}
 
-	f.Close()
 	return runCCApply()
 }
 
@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"strings"
 
+	"github.com/macula-io/macula-os/pkg/effects"
 	"github.com/sirupsen/logrus"
 )
 
@@ -16,14 +17,16 @@ func ExecuteCommand(commands []string) error {
 		c := exec.Command("sh", "-c", cmd)
 		c.Stdout = os.Stdout
 		c.Stderr = os.Stderr
-		if err := c.Run(); err != nil {
+		if err := effects.Run(c); err != nil {
 			return fmt.Errorf("failed to run %s: %v", cmd, err)
 		}
 	}
 	return nil
 }
 
-func SetPassword(password string) error {
+// SetPassword sets the password of a user with chpasswd. Passwords starting
+// with $ are taken to be crypt(3) hashes.
+func SetPassword(user, password string) error {
 	if password == "" {
 		return nil
 	}
@@ -31,11 +34,11 @@ func SetPassword(password string) error {
 	if strings.HasPrefix(password, "$") {
 		cmd.Args = append(cmd.Args, "-e")
 	}
-	cmd.Stdin = strings.NewReader(fmt.Sprint("rancher:", password))
+	cmd.Stdin = strings.NewReader(fmt.Sprint(user, ":", password))
 	cmd.Stdout = os.Stdout
 	errBuffer := &bytes.Buffer{}
 	cmd.Stderr = errBuffer
-	err := cmd.Run()
+	err := effects.Run(cmd)
 	if err != nil {
 		os.Stderr.Write(errBuffer.Bytes())
 	}
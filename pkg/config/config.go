@@ -7,24 +7,26 @@ import (
 )
 
 type Maculaos struct {
-	DataSources    []string          `json:"dataSources,omitempty"`
-	Modules        []string          `json:"modules,omitempty"`
-	Sysctls        map[string]string `json:"sysctls,omitempty"`
-	NTPServers     []string          `json:"ntpServers,omitempty"`
-	DNSNameservers []string          `json:"dnsNameservers,omitempty"`
-	Wifi           []Wifi            `json:"wifi,omitempty"`
-	Password       string            `json:"password,omitempty"`
-	ServerURL      string            `json:"serverUrl,omitempty"`
-	Token          string            `json:"token,omitempty"`
-	Labels         map[string]string `json:"labels,omitempty"`
-	K3sArgs        []string          `json:"k3sArgs,omitempty"`
-	Environment    map[string]string `json:"environment,omitempty"`
-	Taints         []string          `json:"taints,omitempty"`
-	Install        *Install          `json:"install,omitempty"`
-	Mesh           *MeshConfig       `json:"mesh,omitempty"`
-	GitOps         *GitOpsConfig     `json:"gitops,omitempty"`
-	Health         *HealthConfig     `json:"health,omitempty"`
-	Backup         *BackupConfig     `json:"backup,omitempty"`
+	DataSources      []string          `json:"dataSources,omitempty"`
+	Modules          []string          `json:"modules,omitempty"` // "name param=value ..."
+	BlacklistModules []string          `json:"blacklistModules,omitempty" merge:"unique-union"`
+	Sysctls          map[string]string `json:"sysctls,omitempty"`
+	NTPServers       []string          `json:"ntpServers,omitempty"`
+	Timezone         string            `json:"timezone,omitempty"`
+	DNSNameservers   []string          `json:"dnsNameservers,omitempty"`
+	Wifi             []Wifi            `json:"wifi,omitempty"`
+	Password         string            `json:"password,omitempty" norman:"writeOnly"`
+	ServerURL        string            `json:"serverUrl,omitempty"`
+	Token            string            `json:"token,omitempty" norman:"writeOnly"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	K3sArgs          []string          `json:"k3sArgs,omitempty"`
+	Environment      map[string]string `json:"environment,omitempty"`
+	Taints           []string          `json:"taints,omitempty"`
+	Install          *Install          `json:"install,omitempty"`
+	Mesh             *MeshConfig       `json:"mesh,omitempty"`
+	GitOps           *GitOpsConfig     `json:"gitops,omitempty"`
+	Health           *HealthConfig     `json:"health,omitempty"`
+	Backup           *BackupConfig     `json:"backup,omitempty"`
 }
 
 // MeshConfig defines the Macula mesh role configuration
@@ -32,7 +34,7 @@ type MeshConfig struct {
 	Roles          MeshRoles `json:"roles,omitempty"`
 	BootstrapPeers []string  `json:"bootstrapPeers,omitempty"`
 	Realm          string    `json:"realm,omitempty"`
-	TLSMode        string    `json:"tlsMode,omitempty"` // "development" or "production"
+	TLSMode        string    `json:"tlsMode,omitempty" norman:"options=development|production"`
 }
 
 // MeshRoles defines which mesh roles are enabled
@@ -43,10 +45,10 @@ type MeshRoles struct {
 
 // GitOpsConfig defines local GitOps server configuration
 type GitOpsConfig struct {
-	Enabled      bool   `json:"enabled,omitempty"`
-	Server       string `json:"server,omitempty"`       // soft-serve, gitea, or git-daemon
-	Port         int    `json:"port,omitempty"`         // SSH port for soft-serve
-	DataPath     string `json:"dataPath,omitempty"`     // /var/lib/maculaos/git
+	Enabled      bool              `json:"enabled,omitempty"`
+	Server       string            `json:"server,omitempty" norman:"options=soft-serve|gitea|git-daemon"`
+	Port         int               `json:"port,omitempty"`     // SSH port for soft-serve
+	DataPath     string            `json:"dataPath,omitempty"` // /var/lib/maculaos/git
 	UpstreamSync *GitOpsSyncConfig `json:"upstreamSync,omitempty"`
 }
 
@@ -54,7 +56,7 @@ type GitOpsConfig struct {
 type GitOpsSyncConfig struct {
 	Enabled  bool   `json:"enabled,omitempty"`
 	URL      string `json:"url,omitempty"`
-	Interval string `json:"interval,omitempty"` // e.g., "5m"
+	Interval string `json:"interval,omitempty" norman:"type=duration"` // e.g., "5m"
 }
 
 // HealthConfig defines service health check configuration
@@ -65,26 +67,26 @@ type HealthConfig struct {
 // HealthCheck defines a single health check
 type HealthCheck struct {
 	Name             string `json:"name,omitempty"`
-	Type             string `json:"type,omitempty"` // process, http, disk
+	Type             string `json:"type,omitempty" norman:"options=process|http|disk"`
 	Process          string `json:"process,omitempty"`
 	URL              string `json:"url,omitempty"`
 	Path             string `json:"path,omitempty"`
-	Interval         string `json:"interval,omitempty"`
-	Timeout          string `json:"timeout,omitempty"`
+	Interval         string `json:"interval,omitempty" norman:"type=duration"`
+	Timeout          string `json:"timeout,omitempty" norman:"type=duration"`
 	Threshold        string `json:"threshold,omitempty"`
 	RestartOnFailure bool   `json:"restartOnFailure,omitempty"`
 	MaxRestarts      int    `json:"maxRestarts,omitempty"`
-	Action           string `json:"action,omitempty"` // alert, cleanup, restart
+	Action           string `json:"action,omitempty" norman:"options=alert|cleanup|restart"`
 }
 
 // BackupConfig defines backup and restore configuration
 type BackupConfig struct {
-	Enabled   bool     `json:"enabled,omitempty"`
-	Schedule  string   `json:"schedule,omitempty"`  // Cron expression
-	Retention int      `json:"retention,omitempty"` // Number of backups to keep
-	Target    string   `json:"target,omitempty"`    // mesh, s3, local
-	Include   []string `json:"include,omitempty"`
-	Exclude   []string `json:"exclude,omitempty"`
+	Enabled    bool              `json:"enabled,omitempty"`
+	Schedule   string            `json:"schedule,omitempty" norman:"type=cron"`
+	Retention  int               `json:"retention,omitempty"` // Number of backups to keep
+	Target     string            `json:"target,omitempty" norman:"options=local|usb|s3|mesh"`
+	Include    []string          `json:"include,omitempty"`
+	Exclude    []string          `json:"exclude,omitempty"`
 	MeshBackup *MeshBackupConfig `json:"mesh,omitempty"`
 	S3Backup   *S3BackupConfig   `json:"s3,omitempty"`
 }
@@ -99,11 +101,232 @@ type S3BackupConfig struct {
 	Endpoint string `json:"endpoint,omitempty"`
 	Bucket   string `json:"bucket,omitempty"`
 	Prefix   string `json:"prefix,omitempty"`
+
+	AccessKeyID     string `json:"accessKeyId,omitempty" norman:"writeOnly"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty" norman:"writeOnly"`
+}
+
+// Include is a config fragment that is merged before the layer including it.
+// A string is short for an include with only a path.
+type Include struct {
+	Path      string `json:"path,omitempty"`      // file, glob or https URL
+	SHA256    string `json:"sha256,omitempty"`    // pinned digest of the fragment
+	PublicKey string `json:"publicKey,omitempty"` // base64 ed25519 key the fragment is signed with
+	Signature string `json:"signature,omitempty"` // URL of the signature, default path + ".sig"
+}
+
+// User is a login account managed by ApplyUsers, in addition to the default
+// macula user
+type User struct {
+	Name              string   `json:"name,omitempty"`
+	UID               int      `json:"uid,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	Shell             string   `json:"shell,omitempty"`
+	HashedPassword    string   `json:"hashedPassword,omitempty" norman:"writeOnly"` // crypt(3) hash, as from mkpasswd
+	Sudo              []string `json:"sudo,omitempty"`                              // sudoers rules, e.g. "ALL=(ALL) NOPASSWD: ALL"
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	Locked            bool     `json:"locked,omitempty"` // disables the account, including SSH keys
+}
+
+// Service is an OpenRC service of /etc/init.d, see ApplyServices
+type Service struct {
+	Enabled  *bool             `json:"enabled,omitempty"` // unset leaves the runlevels as they are
+	Runlevel string            `json:"runlevel,omitempty" norman:"options=sysinit|boot|default|shutdown"`
+	ConfD    map[string]string `json:"confD,omitempty"` // variables set in /etc/conf.d/<name>
+}
+
+// Mount is a filesystem mounted by ApplyMounts
+type Mount struct {
+	Device  string   `json:"device,omitempty"` // LABEL=, UUID=, PARTUUID= or a path such as /dev/disk/by-path/...
+	Path    string   `json:"path,omitempty"`
+	FSType  string   `json:"fsType,omitempty"`
+	Options []string `json:"options,omitempty"` // default defaults,nofail
+	Format  bool     `json:"format,omitempty"`  // create the filesystem if the device is empty
+	Label   string   `json:"label,omitempty"`   // label of a filesystem created by format
+	Bind    string   `json:"bind,omitempty"`    // directory Path is bind mounted onto, e.g. /var/lib/rancher/k3s/storage
+}
+
+// Swap is the swap ApplySwap sets up at boot, zram, a swapfile or both
+type Swap struct {
+	Zram *ZramSwap `json:"zram,omitempty"`
+	File *SwapFile `json:"file,omitempty"`
+}
+
+// ZramSwap is compressed swap in memory
+type ZramSwap struct {
+	Percent   int    `json:"percent,omitempty"` // size as a percentage of RAM, default 50
+	Algorithm string `json:"algorithm,omitempty" norman:"options=lzo|lzo-rle|lz4|lz4hc|zstd|842"`
+	Priority  int    `json:"priority,omitempty"` // default 100, so that it is used before a swapfile
+}
+
+// SwapFile is a swapfile on the state partition
+type SwapFile struct {
+	Path     string `json:"path,omitempty"` // default /var/lib/maculaos/swapfile
+	Size     string `json:"size,omitempty"` // such as 2G
+	Priority int    `json:"priority,omitempty"`
+}
+
+// Firewall is the part of the nftables ruleset of maculaos that comes from
+// the config. Mesh roles, k3s and the firstboot server add their own rules.
+type Firewall struct {
+	DefaultPolicy string              `json:"defaultPolicy,omitempty" norman:"options=accept|drop"` // for incoming traffic, default accept
+	Zones         map[string][]string `json:"zones,omitempty"`                                      // interfaces by zone name
+	Rules         []FirewallRule      `json:"rules,omitempty"`
+	Forwards      []PortForward       `json:"forwards,omitempty"`
+}
+
+// FirewallRule matches incoming traffic. Without a port it matches all
+// traffic from its interfaces and sources.
+type FirewallRule struct {
+	Port      string `json:"port,omitempty"` // a port or a range such as 8000-8100
+	Protocol  string `json:"protocol,omitempty" norman:"options=tcp|udp"`
+	Interface string `json:"interface,omitempty"`
+	Zone      string `json:"zone,omitempty"`
+	Source    string `json:"source,omitempty"`    // address or CIDR
+	RateLimit string `json:"rateLimit,omitempty"` // new connections beyond, such as 10/minute, are dropped
+	Action    string `json:"action,omitempty" norman:"options=accept|drop|reject"`
+}
+
+// PortForward sends traffic for a port on to another address
+type PortForward struct {
+	Port      string `json:"port,omitempty"`
+	Protocol  string `json:"protocol,omitempty" norman:"options=tcp|udp"`
+	Interface string `json:"interface,omitempty"`
+	To        string `json:"to,omitempty"` // address:port
+}
+
+// Proxy routes the outbound HTTP of maculaos, k3s and containerd through a
+// proxy
+type Proxy struct {
+	HTTPProxy  string   `json:"httpProxy,omitempty"`
+	HTTPSProxy string   `json:"httpsProxy,omitempty"`
+	NoProxy    []string `json:"noProxy,omitempty"`  // hosts, domains and networks to reach directly
+	CABundle   string   `json:"caBundle,omitempty"` // PEM of the CA of an intercepting proxy, or the path of one
+}
+
+// Registries configures where containerd pulls images from, the same way as
+// the registries.yaml of k3s, which it is written to
+type Registries struct {
+	Mirrors map[string]RegistryMirror `json:"mirrors,omitempty" merge:"append"` // by registry, such as docker.io, or * for all
+	Configs map[string]RegistryConfig `json:"configs,omitempty" merge:"append"` // by registry or mirror host
+}
+
+type RegistryMirror struct {
+	Endpoints []string `json:"endpoints,omitempty"` // tried in order, before the registry itself
+}
+
+type RegistryConfig struct {
+	Auth *RegistryAuth `json:"auth,omitempty"`
+	TLS  *RegistryTLS  `json:"tls,omitempty"`
+}
+
+type RegistryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty" norman:"writeOnly"`
+	Auth          string `json:"auth,omitempty" norman:"writeOnly"` // base64 of username:password
+	IdentityToken string `json:"identityToken,omitempty" norman:"writeOnly"`
+}
+
+type RegistryTLS struct {
+	CAFile             string `json:"caFile,omitempty"`
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
 }
 
+// K3s is written to the config.yaml of k3s, along with the labels, taints,
+// server and token under maculaos
+type K3s struct {
+	Role              string   `json:"role,omitempty" norman:"options=server|agent"` // default agent with maculaos.serverUrl, else server
+	ClusterInit       bool     `json:"clusterInit,omitempty"`                        // start a new embedded etcd cluster
+	DatastoreEndpoint string   `json:"datastoreEndpoint,omitempty" norman:"writeOnly"`
+	Disable           []string `json:"disable,omitempty" merge:"unique-union"` // packaged components, such as traefik
+	FlannelBackend    string   `json:"flannelBackend,omitempty" norman:"options=none|vxlan|host-gw|wireguard-native|ipsec"`
+	TLSSAN            []string `json:"tlsSan,omitempty" merge:"unique-union"`
+	NodeIP            string   `json:"nodeIp,omitempty"`      // an address, or an IPv4 and an IPv6 one separated by a comma
+	KubeletArgs       []string `json:"kubeletArgs,omitempty"` // such as max-pods=200
+}
+
+// Manifest is a Kubernetes manifest k3s deploys from its auto-deploy
+// directory. It is given inline, as a file on the node or as an https URL,
+// which must be pinned with sha256.
+type Manifest struct {
+	Name    string `json:"name,omitempty"` // default the base name of the path or URL
+	Content string `json:"content,omitempty"`
+	Path    string `json:"path,omitempty"`
+	URL     string `json:"url,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+// HelmChart is deployed by the helm controller of k3s
+type HelmChart struct {
+	Name      string                 `json:"name,omitempty"`
+	Chart     string                 `json:"chart,omitempty"` // a chart of Repo, or an https or oci URL
+	Repo      string                 `json:"repo,omitempty"`
+	Version   string                 `json:"version,omitempty"`
+	Namespace string                 `json:"namespace,omitempty"` // the chart is installed to, default default
+	Values    map[string]interface{} `json:"values,omitempty"`
+}
+
+// Image is an archive of container images, as written by docker save or
+// ctr export, that k3s imports when it starts
+type Image struct {
+	Path   string `json:"path,omitempty"`   // .tar, .tar.gz, .tar.zst..., a directory of them, or an .iso holding a maculaos-images directory
+	SHA256 string `json:"sha256,omitempty"` // of the archive; a directory can hold a SHA256SUMS file instead
+}
+
+// Network configures wired interfaces beyond the DHCP connman does by default
+type Network struct {
+	Interfaces []NetworkInterface `json:"interfaces,omitempty"`
+	// SafeApply reverts a change made on a running system when the
+	// gateways stop answering within RollbackTimeout (default 30s)
+	SafeApply       bool   `json:"safeApply,omitempty"`
+	RollbackTimeout string `json:"rollbackTimeout,omitempty" norman:"type=duration"`
+}
+
+// NetworkInterface is an existing interface, or a VLAN or bond to create
+type NetworkInterface struct {
+	Name     string   `json:"name,omitempty"`
+	IPv4     string   `json:"ipv4,omitempty"` // dhcp (default), off or an address in CIDR form
+	Gateway  string   `json:"gateway,omitempty"`
+	IPv6     string   `json:"ipv6,omitempty"` // auto (default), off or an address in CIDR form
+	Gateway6 string   `json:"gateway6,omitempty"`
+	DNS      []string `json:"dns,omitempty"`
+	MTU      int      `json:"mtu,omitempty"`
+
+	// VLAN sub-interface of Link
+	Link   string `json:"link,omitempty"`
+	VLANID int    `json:"vlanId,omitempty"`
+
+	// bond of BondInterfaces
+	BondInterfaces []string `json:"bondInterfaces,omitempty"`
+	BondMode       string   `json:"bondMode,omitempty" norman:"options=balance-rr|active-backup|balance-xor|broadcast|802.3ad|balance-tlb|balance-alb"`
+}
+
+// Wifi is a network connman connects to. Certificates and keys are paths,
+// which writeFiles can put in place.
 type Wifi struct {
 	Name       string `json:"name,omitempty"`
-	Passphrase string `json:"passphrase,omitempty"`
+	Passphrase string `json:"passphrase,omitempty" norman:"writeOnly"` // PSK, or the password for PEAP and TTLS
+	Hidden     bool   `json:"hidden,omitempty"`
+	Priority   int    `json:"priority,omitempty"` // higher is preferred when several networks are in range
+
+	// 802.1X
+	EAP                  string `json:"eap,omitempty" norman:"options=peap|ttls|tls"`
+	Phase2               string `json:"phase2,omitempty"` // inner method, e.g. MSCHAPV2
+	Identity             string `json:"identity,omitempty"`
+	AnonymousIdentity    string `json:"anonymousIdentity,omitempty"`
+	CACert               string `json:"caCert,omitempty"`
+	ClientCert           string `json:"clientCert,omitempty"`
+	PrivateKey           string `json:"privateKey,omitempty"`
+	PrivateKeyPassphrase string `json:"privateKeyPassphrase,omitempty" norman:"writeOnly"`
+
+	// static addressing, as for network interfaces
+	IPv4     string   `json:"ipv4,omitempty"`
+	Gateway  string   `json:"gateway,omitempty"`
+	IPv6     string   `json:"ipv6,omitempty"`
+	Gateway6 string   `json:"gateway6,omitempty"`
+	DNS      []string `json:"dns,omitempty"`
 }
 
 type Install struct {
@@ -119,17 +342,31 @@ type Install struct {
 }
 
 type CloudConfig struct {
-	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
-	WriteFiles        []File   `json:"writeFiles,omitempty"`
-	Hostname          string   `json:"hostname,omitempty"`
-	Maculaos          Maculaos `json:"maculaos,omitempty"`
-	Runcmd            []string `json:"runCmd,omitempty"`
-	Bootcmd           []string `json:"bootCmd,omitempty"`
-	Initcmd           []string `json:"initCmd,omitempty"`
+	Include           []Include          `json:"include,omitempty"`
+	SSHAuthorizedKeys []string           `json:"sshAuthorizedKeys,omitempty"`
+	Users             []User             `json:"users,omitempty"`
+	Network           *Network           `json:"network,omitempty"`
+	Services          map[string]Service `json:"services,omitempty" merge:"append"`
+	Mounts            []Mount            `json:"mounts,omitempty"`
+	Swap              *Swap              `json:"swap,omitempty"`
+	Firewall          *Firewall          `json:"firewall,omitempty"`
+	Proxy             *Proxy             `json:"proxy,omitempty"`
+	Registries        *Registries        `json:"registries,omitempty"`
+	K3s               *K3s               `json:"k3s,omitempty"`
+	Manifests         []Manifest         `json:"manifests,omitempty"`
+	HelmCharts        []HelmChart        `json:"helmCharts,omitempty"`
+	Images            []Image            `json:"images,omitempty"`
+	CACerts           []string           `json:"caCerts,omitempty" merge:"unique-union"` // PEM, or the path of a PEM file
+	WriteFiles        []File             `json:"writeFiles,omitempty"`
+	Hostname          string             `json:"hostname,omitempty"`
+	Maculaos          Maculaos           `json:"maculaos,omitempty"`
+	Runcmd            []string           `json:"runCmd,omitempty"`
+	Bootcmd           []string           `json:"bootCmd,omitempty"`
+	Initcmd           []string           `json:"initCmd,omitempty"`
 }
 
 type File struct {
-	Encoding           string `json:"encoding"`
+	Encoding           string `json:"encoding" norman:"options=b64|base64|gz|gzip|gz+base64|gzip+base64|gz+b64|gzip+b64"`
 	Content            string `json:"content"`
 	Owner              string `json:"owner"`
 	Path               string `json:"path"`
@@ -147,3 +384,14 @@ func (f *File) Permissions() (os.FileMode, error) {
 	}
 	return os.FileMode(perm), nil
 }
+
+// Provided reports whether a file exists or is written by the config
+func Provided(cfg *CloudConfig, path string) bool {
+	for _, f := range cfg.WriteFiles {
+		if f.Path == path {
+			return true
+		}
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,354 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/macula-io/macula-os/pkg/util"
+	"github.com/rancher/mapper/convert"
+	"github.com/rancher/mapper/definition"
+)
+
+// OverrideConfig is the config.d layer that Set and Unset edit. It is merged
+// after the other local files so that its values win.
+var OverrideConfig = LayerPath("99-override.yaml")
+
+// LayerPath returns the path of a file in config.d
+func LayerPath(name string) string {
+	return filepath.Join(localConfigs, name)
+}
+
+// pathStep is one segment of a dotted path such as writeFiles[0].path or
+// maculaos.k3sArgs[+]
+type pathStep struct {
+	key    string
+	index  int    // list item, or -1
+	add    bool   // append a new list item
+	parent string // type of the object holding key, or "" below a map of strings
+	merged bool   // key holds a map of strings, which layers replace as a whole
+}
+
+// resolvePath parses a dotted path against the schema. It returns the steps
+// with canonical field names and the type of the value the path points at.
+// Below a map of strings the rest of the path is a single key, so that keys
+// such as macula.io/zone need no quoting.
+func resolvePath(path string) ([]pathStep, string, error) {
+	if path == "" {
+		return nil, "", fmt.Errorf("a key is required")
+	}
+
+	var steps []pathStep
+	fieldType := schema.ID
+	parts := strings.Split(path, ".")
+	for i := 0; i < len(parts); i++ {
+		if isStringMap(fieldType) {
+			steps = append(steps, pathStep{key: strings.Join(parts[i:], "."), index: -1})
+			return steps, definition.SubType(fieldType), nil
+		}
+		parent := fieldType
+
+		key, index := parts[i], ""
+		if open := strings.Index(key, "["); open >= 0 && strings.HasSuffix(key, "]") {
+			key, index = key[:open], key[open+1:len(key)-1]
+		}
+
+		s := schemas.Schema(fieldType)
+		if s == nil {
+			return nil, "", fmt.Errorf("%s: %s is not an object", path, strings.Join(parts[:i], "."))
+		}
+		name, ok := fieldName(s, key)
+		if !ok {
+			return nil, "", fmt.Errorf("%s: unknown key %s", path, strings.Join(append(parts[:i:i], key), "."))
+		}
+		fieldType = s.ResourceFields[name].Type
+
+		step := pathStep{key: name, index: -1, parent: parent, merged: isStringMap(fieldType)}
+		if index != "" {
+			if !definition.IsArrayType(fieldType) {
+				return nil, "", fmt.Errorf("%s: %s is not a list", path, strings.Join(append(parts[:i:i], key), "."))
+			}
+			if index == "+" {
+				step.add = true
+			} else if step.index, ok = parseIndex(index); !ok {
+				return nil, "", fmt.Errorf("%s: invalid list index %q", path, index)
+			}
+			fieldType = definition.SubType(fieldType)
+		}
+		steps = append(steps, step)
+	}
+	return steps, fieldType, nil
+}
+
+func parseIndex(index string) (int, bool) {
+	i, err := strconv.Atoi(index)
+	return i, err == nil && i >= 0
+}
+
+// stepsPath renders steps back into a dotted path, as used by Provenance
+func stepsPath(steps []pathStep) string {
+	var parts []string
+	for _, step := range steps {
+		parts = append(parts, step.key)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Get returns the value at a dotted path of cfg, or nil if it is not set
+func Get(cfg CloudConfig, path string) (interface{}, error) {
+	data, err := convert.EncodeToMap(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return data, nil
+	}
+
+	steps, _, err := resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{} = data
+	for _, step := range steps {
+		if step.add {
+			return nil, fmt.Errorf("%s: [+] can only be set", path)
+		}
+		value = convert.ToMapInterface(value)[step.key]
+		if step.index >= 0 {
+			items := convert.ToInterfaceSlice(value)
+			if step.index >= len(items) {
+				return nil, nil
+			}
+			value = items[step.index]
+		}
+	}
+	return value, nil
+}
+
+// Set sets a dotted path to value in OverrideConfig. Values are read as YAML
+// unless the path points at a string, and a path ending in [+] appends to
+// the list. It returns the canonical path that changed.
+func Set(path, value string) (string, error) {
+	steps, fieldType, err := resolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	v, err := parseValue(fieldType, value)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	return stepsPath(steps), editOverride(steps, func(parent map[string]interface{}, key string, last pathStep) error {
+		if last.index < 0 && !last.add {
+			// a value set here replaces the one of the other layers
+			delete(parent, key)
+			delete(parent, "+"+last.key)
+			parent[last.key] = v
+			return nil
+		}
+		items := convert.ToInterfaceSlice(parent[key])
+		if last.add {
+			parent[key] = append(items, v)
+			return nil
+		}
+		if last.index >= len(items) {
+			return fmt.Errorf("%s: index %d is out of range, use [+] to append", path, last.index)
+		}
+		items[last.index] = v
+		parent[key] = items
+		return nil
+	})
+}
+
+// Unset removes a dotted path from OverrideConfig. Values set by other layers
+// are not changed. It returns the canonical path that changed.
+func Unset(path string) (string, error) {
+	steps, _, err := resolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	return stepsPath(steps), editOverride(steps, func(parent map[string]interface{}, key string, last pathStep) error {
+		if last.add {
+			return fmt.Errorf("%s: [+] can only be set", path)
+		}
+		if _, ok := parent[key]; !ok {
+			return fmt.Errorf("%s is not set in %s", path, OverrideConfig)
+		}
+		if last.index < 0 {
+			delete(parent, key)
+			delete(parent, "+"+last.key)
+			return nil
+		}
+		items := convert.ToInterfaceSlice(parent[key])
+		if last.index >= len(items) {
+			return fmt.Errorf("%s: index %d is out of range", path, last.index)
+		}
+		parent[key] = append(items[:last.index:last.index], items[last.index+1:]...)
+		return nil
+	})
+}
+
+// parseValue reads a command line value for a field of fieldType
+func parseValue(fieldType, value string) (interface{}, error) {
+	switch fieldType {
+	case "string", "enum", "password", "duration", "cron":
+		return value, nil
+	}
+	if definition.IsArrayType(fieldType) && definition.SubType(fieldType) == "string" && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		return []interface{}{value}, nil
+	}
+
+	var result interface{}
+	if err := yaml.Unmarshal([]byte(value), &result); err != nil {
+		return nil, fmt.Errorf("invalid value: %v", err)
+	}
+	return result, nil
+}
+
+// editOverride reads OverrideConfig, calls edit with the map holding the
+// last step of the path and the key the file spells it with, then validates
+// and writes the result. The file is edited as written, so that its other
+// entries, including +key and $merge directives, are kept.
+//
+// Appending to a list the file does not set, and setting a key of a map of
+// strings it does not set, write a +key that adds to the other layers rather
+// than copying their value. A list item set or removed by index needs the
+// list as a whole, so a list the file does not set yet starts out as the
+// merged value from every layer. Secrets in it are copied as they are, still
+// encrypted.
+func editOverride(steps []pathStep, edit func(parent map[string]interface{}, key string, last pathStep) error) error {
+	data, err := readFile(OverrideConfig)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+
+	var effective map[string]interface{}
+	parent := data
+	for i, step := range steps {
+		key, appended := overrideKey(parent, step)
+		switch {
+		case step.index >= 0 && (key == "" || appended):
+			if effective == nil {
+				if effective, _, err = mergeLayers(false, layers()...); err != nil {
+					return err
+				}
+			}
+			if key != "" {
+				delete(parent, key)
+			}
+			key = step.key
+			if items, ok := toList(valueAt(effective, steps[:i+1])); ok {
+				parent[key] = append([]interface{}{}, items...)
+			}
+		case key == "" && (step.add || step.merged):
+			key = "+" + step.key
+		case key == "":
+			key = step.key
+		}
+		if i == len(steps)-1 {
+			if err := edit(parent, key, step); err != nil {
+				return err
+			}
+			break
+		}
+
+		next, ok := parent[key].(map[string]interface{})
+		if step.index >= 0 {
+			items := convert.ToInterfaceSlice(parent[key])
+			if step.index >= len(items) {
+				return fmt.Errorf("%s: index %d is out of range", stepsPath(steps[:i+1]), step.index)
+			}
+			if next, ok = items[step.index].(map[string]interface{}); !ok {
+				return fmt.Errorf("%s[%d] is not an object", stepsPath(steps[:i+1]), step.index)
+			}
+		} else if step.add {
+			next = map[string]interface{}{}
+			parent[key] = append(convert.ToInterfaceSlice(parent[key]), next)
+		} else if !ok {
+			next = map[string]interface{}{}
+			parent[key] = next
+		}
+		parent = next
+	}
+	pruneEmpty(data)
+
+	if problems := validateLayer(layer{name: OverrideConfig}, data); len(problems) > 0 {
+		var messages []string
+		for _, p := range problems {
+			messages = append(messages, p.Error())
+		}
+		return fmt.Errorf("%s", strings.Join(messages, "\n"))
+	}
+	bytes, err := yaml.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return Track(Command(), func() error {
+		if len(data) == 0 {
+			if err := os.Remove(OverrideConfig); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(OverrideConfig), 0755); err != nil {
+			return err
+		}
+		return util.WriteFileAtomic(OverrideConfig, bytes, 0600)
+	})
+}
+
+// overrideKey returns the key of parent that step refers to in any spelling
+// ReadConfig accepts, and whether it is a +key. A plain key wins over a +key.
+func overrideKey(parent map[string]interface{}, step pathStep) (string, bool) {
+	s := schemas.Schema(step.parent)
+	result, appended := "", false
+	for k := range parent {
+		name := strings.TrimPrefix(k, "+")
+		if s != nil {
+			name, _ = fieldName(s, name)
+		}
+		if name != step.key {
+			continue
+		}
+		if !strings.HasPrefix(k, "+") {
+			return k, false
+		}
+		result, appended = k, true
+	}
+	return result, appended
+}
+
+// valueAt returns the value of the list a path runs through in data
+func valueAt(data map[string]interface{}, steps []pathStep) interface{} {
+	var value interface{} = data
+	for i, step := range steps {
+		value = convert.ToMapInterface(value)[step.key]
+		if i < len(steps)-1 && step.index >= 0 {
+			items := convert.ToInterfaceSlice(value)
+			if step.index >= len(items) {
+				return nil
+			}
+			value = items[step.index]
+		}
+	}
+	return value
+}
+
+// pruneEmpty drops the empty maps left behind by encoding and unsetting
+func pruneEmpty(data map[string]interface{}) {
+	for k, v := range data {
+		if m, ok := v.(map[string]interface{}); ok {
+			pruneEmpty(m)
+			if len(m) == 0 {
+				delete(data, k)
+			}
+		}
+	}
+}
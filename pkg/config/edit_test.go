@@ -0,0 +1,185 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetUnset(t *testing.T) {
+	dir := t.TempDir()
+	defer func(system, local, locals, override, cmd, user, root, history string) {
+		SystemConfig, LocalConfig, localConfigs, OverrideConfig, cmdline, userdata, historyRoot, HistoryDir = system, local, locals, override, cmd, user, root, history
+	}(SystemConfig, LocalConfig, localConfigs, OverrideConfig, cmdline, userdata, historyRoot, HistoryDir)
+
+	SystemConfig = filepath.Join(dir, "system.yaml")
+	cmdline = filepath.Join(dir, "cmdline")
+	userdata = filepath.Join(dir, "userdata")
+	historyRoot = dir
+	HistoryDir = filepath.Join(dir, "config-history")
+	LocalConfig = filepath.Join(dir, "config.yaml")
+	localConfigs = filepath.Join(dir, "config.d")
+	OverrideConfig = filepath.Join(localConfigs, "99-override.yaml")
+
+	if err := ioutil.WriteFile(LocalConfig, []byte("hostname: one\nmaculaos:\n  k3s_args: [server]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// hand-written directives are kept
+	if err := os.MkdirAll(localConfigs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(OverrideConfig, []byte("+ssh_authorized_keys: [debug]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, set := range [][2]string{
+		{"maculaos.k3sArgs[+]", "--disable=traefik"},
+		{"maculaos.labels.macula.io/zone", "brussels"},
+		{"hostname", "two"},
+		{"maculaos.mesh.roles.gateway", "true"},
+		{"maculaos.dns_nameservers", "[1.1.1.1, 8.8.8.8]"},
+		{"maculaos.health.checks[+]", "{name: k3s, type: process, process: k3s}"},
+		{"maculaos.health.checks[0].interval", "30s"},
+	} {
+		if _, err := Set(set[0], set[1]); err != nil {
+			t.Fatalf("set %s: %v", set[0], err)
+		}
+	}
+
+	cfg, err := ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"hostname":                           "two",
+		"maculaos.k3s_args":                  []interface{}{"server", "--disable=traefik"},
+		"maculaos.labels.macula.io/zone":     "brussels",
+		"maculaos.mesh.roles.gateway":        true,
+		"maculaos.dnsNameservers":            []interface{}{"1.1.1.1", "8.8.8.8"},
+		"maculaos.health.checks[0].interval": "30s",
+	} {
+		got, err := Get(cfg, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s is %#v, want %#v", path, got, want)
+		}
+	}
+
+	// appending adds to the other layers rather than copying them
+	content, err := ioutil.ReadFile(OverrideConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "+k3sArgs:\n  - --disable=traefik\n") || !strings.Contains(string(content), "+labels:") {
+		t.Errorf("unexpected override file:\n%s", content)
+	}
+	if err := ioutil.WriteFile(LocalConfig, []byte("hostname: one\nmaculaos:\n  k3s_args: [agent]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = ReadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if args := strings.Join(cfg.Maculaos.K3sArgs, " "); args != "agent --disable=traefik" {
+		t.Errorf("k3sArgs are %q", args)
+	}
+
+	for _, bad := range [][2]string{
+		{"maculaos.nope", "x"},
+		{"maculaos.mesh.tlsMode", "insecure"},
+		{"hostname[+]", "x"},
+		{"maculaos.health.checks[5].name", "x"},
+		{"maculaos.health.checks[0].maxRestarts", "many"},
+	} {
+		if _, err := Set(bad[0], bad[1]); err == nil {
+			t.Errorf("set %s %s should fail", bad[0], bad[1])
+		}
+	}
+
+	if key, err := Unset("hostname"); err != nil || key != "hostname" {
+		t.Fatalf("unset hostname: %q, %v", key, err)
+	}
+	if _, err := Unset("hostname"); err == nil {
+		t.Errorf("unsetting a key the override does not set should fail")
+	}
+	if _, err := Unset("maculaos.k3s_args[0]"); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, err = ioutil.ReadFile(OverrideConfig); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "hostname") || !strings.Contains(string(content), "  k3sArgs:\n  - --disable=traefik\n") ||
+		!strings.Contains(string(content), "+ssh_authorized_keys:\n- debug\n") {
+		t.Errorf("unexpected override file:\n%s", content)
+	}
+	if cfg, err = ReadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Hostname != "one" {
+		t.Errorf("hostname from config.yaml is %q", cfg.Hostname)
+	}
+	if keys := strings.Join(cfg.SSHAuthorizedKeys, " "); keys != "debug" {
+		t.Errorf("sshAuthorizedKeys are %q", keys)
+	}
+
+	revisions, err := History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 11 {
+		t.Errorf("expected a revision per change, got %d", len(revisions))
+	}
+}
+
+func TestSysctlProfilePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	defer func(system, local, locals, override, cmd, user, root, history string) {
+		SystemConfig, LocalConfig, localConfigs, OverrideConfig, cmdline, userdata, historyRoot, HistoryDir = system, local, locals, override, cmd, user, root, history
+	}(SystemConfig, LocalConfig, localConfigs, OverrideConfig, cmdline, userdata, historyRoot, HistoryDir)
+
+	SystemConfig = filepath.Join(dir, "system.yaml")
+	cmdline = filepath.Join(dir, "cmdline")
+	userdata = filepath.Join(dir, "userdata")
+	historyRoot = dir
+	HistoryDir = filepath.Join(dir, "config-history")
+	LocalConfig = filepath.Join(dir, "config.yaml")
+	localConfigs = filepath.Join(dir, "config.d")
+	OverrideConfig = filepath.Join(localConfigs, "99-override.yaml")
+
+	if err := ioutil.WriteFile(LocalConfig, []byte("maculaos:\n  sysctls:\n    vm.swappiness: \"10\"\n    kernel.panic: \"5\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(localConfigs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// as written by maculaos sysctl profile low-memory
+	profile := "maculaos:\n  +sysctls:\n    vm.swappiness: \"100\"\n    vm.min_free_kbytes: \"1024\"\n"
+	if err := ioutil.WriteFile(LayerPath("50-sysctl-profile-low-memory.yaml"), []byte(profile), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sysctls := func() map[string]string {
+		cfg, err := ReadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg.Maculaos.Sysctls
+	}
+	want := map[string]string{"vm.swappiness": "100", "kernel.panic": "5", "vm.min_free_kbytes": "1024"}
+	if got := sysctls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("the profile should add to config.yaml and win, got %v", got)
+	}
+
+	if _, err := Set("maculaos.sysctls.vm.swappiness", "10"); err != nil {
+		t.Fatal(err)
+	}
+	want["vm.swappiness"] = "10"
+	if got := sysctls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("config set should win over the profile, got %v", got)
+	}
+}
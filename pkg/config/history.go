@@ -0,0 +1,383 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/macula-io/macula-os/pkg/system"
+	"github.com/macula-io/macula-os/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// historyLimit is the number of revisions kept
+const historyLimit = 100
+
+var (
+	// HistoryDir holds a snapshot of the local config files for every change
+	HistoryDir = system.LocalPath("config-history")
+
+	// historyRoot is the directory the tracked files are relative to
+	historyRoot = system.LocalPath()
+
+	// trackedFiles are the local config files recorded in the history,
+	// including the ones the mesh, health and backup commands keep
+	trackedFiles = []string{"config.yaml", "config.d/*", "mesh.yaml", "health.yaml", "backup.yaml"}
+)
+
+// Revision is a recorded state of the local config files
+type Revision struct {
+	ID      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Files   []string  `json:"files"`
+	// Modes holds the permissions of the files, which a rollback restores
+	Modes map[string]os.FileMode `json:"modes,omitempty"`
+}
+
+// ManualEdit is the command recorded for changes made outside of maculaos
+const ManualEdit = "manual edit"
+
+// Track records the local config files before and after write runs, so that
+// hand edits made since the last revision and the change made by command
+// are kept as separate revisions. Failing to record is not fatal to write.
+func Track(command string, write func() error) error {
+	if _, err := Record(ManualEdit); err != nil {
+		logrus.Warnf("failed to record config history: %v", err)
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	if _, err := Record(command); err != nil {
+		logrus.Warnf("failed to record config history: %v", err)
+	}
+	return nil
+}
+
+// Command returns the command line of this process, for recording with Track
+func Command() string {
+	args := append([]string{filepath.Base(os.Args[0])}, os.Args[1:]...)
+	return strings.Join(args, " ")
+}
+
+// Record adds a revision if the local config files changed since the latest
+// one. It returns the revision, or nil if nothing changed.
+func Record(command string) (*Revision, error) {
+	current, err := snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := History()
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) > 0 {
+		latest, err := revisionFiles(revisions[len(revisions)-1].ID)
+		if err != nil {
+			return nil, err
+		}
+		if equalFiles(latest, current) {
+			return nil, nil
+		}
+	} else if len(current) == 0 {
+		return nil, nil
+	}
+
+	rev := Revision{
+		ID:      1,
+		Time:    time.Now().UTC(),
+		Command: command,
+	}
+	if len(revisions) > 0 {
+		rev.ID = revisions[len(revisions)-1].ID + 1
+	}
+	rev.Modes = map[string]os.FileMode{}
+	for name := range current {
+		rev.Files = append(rev.Files, name)
+		if info, err := os.Stat(filepath.Join(historyRoot, name)); err == nil {
+			rev.Modes[name] = info.Mode().Perm()
+		}
+	}
+	sort.Strings(rev.Files)
+
+	dir := revisionDir(rev.ID)
+	for name, content := range current {
+		p := filepath.Join(dir, "files", name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(p, content, 0600); err != nil {
+			return nil, err
+		}
+	}
+	meta, err := json.MarshalIndent(rev, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	// the metadata is written last, a revision without it is ignored
+	if err := util.WriteFileAtomic(filepath.Join(dir, "revision.json"), meta, 0600); err != nil {
+		return nil, err
+	}
+
+	return &rev, prune(revisions)
+}
+
+// History returns the recorded revisions, oldest first
+func History() ([]Revision, error) {
+	entries, err := ioutil.ReadDir(HistoryDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var result []Revision
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(HistoryDir, entry.Name(), "revision.json"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		rev := Revision{}
+		if err := json.Unmarshal(data, &rev); err != nil {
+			return nil, fmt.Errorf("revision %s: %v", entry.Name(), err)
+		}
+		result = append(result, rev)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+// Diff returns a unified diff of the local config files between two
+// revisions. A revision of 0 stands for the files as they are now.
+func Diff(from, to int) (string, error) {
+	fromFiles, err := filesAt(from)
+	if err != nil {
+		return "", err
+	}
+	toFiles, err := filesAt(to)
+	if err != nil {
+		return "", err
+	}
+
+	names := map[string]bool{}
+	for name := range fromFiles {
+		names[name] = true
+	}
+	for name := range toFiles {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	buf := &strings.Builder{}
+	for _, name := range sorted {
+		fromName, toName := revisionName(from, name), revisionName(to, name)
+		if _, ok := fromFiles[name]; !ok {
+			fromName = "/dev/null"
+		}
+		if _, ok := toFiles[name]; !ok {
+			toName = "/dev/null"
+		}
+		buf.WriteString(util.UnifiedDiff(fromName, toName, fromFiles[name], toFiles[name]))
+	}
+	return buf.String(), nil
+}
+
+func revisionName(rev int, name string) string {
+	if rev == 0 {
+		return filepath.Join(historyRoot, name)
+	}
+	return fmt.Sprintf("r%d/%s", rev, name)
+}
+
+// ChangedFiles returns the local config files that differ between two
+// revisions, with 0 standing for the files as they are now
+func ChangedFiles(from, to int) ([]string, error) {
+	fromFiles, err := filesAt(from)
+	if err != nil {
+		return nil, err
+	}
+	toFiles, err := filesAt(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for name, content := range toFiles {
+		if other, ok := fromFiles[name]; !ok || !bytes.Equal(content, other) {
+			result = append(result, name)
+		}
+	}
+	for name := range fromFiles {
+		if _, ok := toFiles[name]; !ok {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Rollback restores the local config files of a revision, with their
+// permissions, and records the result as a new revision
+func Rollback(id int) (*Revision, error) {
+	target, err := readRevision(id)
+	if err != nil {
+		return nil, err
+	}
+	files, err := revisionFiles(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := Record(ManualEdit); err != nil {
+		return nil, err
+	}
+
+	current, err := snapshot()
+	if err != nil {
+		return nil, err
+	}
+	for name := range current {
+		if _, ok := files[name]; !ok {
+			if err := os.Remove(filepath.Join(historyRoot, name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for name, content := range files {
+		p := filepath.Join(historyRoot, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, err
+		}
+		// revisions recorded before modes were kept restore as 0600
+		mode, ok := target.Modes[name]
+		if !ok {
+			mode = 0600
+		}
+		if err := util.WriteFileAtomic(p, content, mode); err != nil {
+			return nil, err
+		}
+	}
+
+	rev, err := Record(fmt.Sprintf("rollback to revision %d", id))
+	if err != nil {
+		return nil, err
+	}
+	if rev == nil {
+		return nil, fmt.Errorf("the local config already matches revision %d", id)
+	}
+	return rev, nil
+}
+
+func filesAt(id int) (map[string][]byte, error) {
+	if id == 0 {
+		return snapshot()
+	}
+	return revisionFiles(id)
+}
+
+// snapshot reads the tracked files as they are now, by path relative to
+// historyRoot
+func snapshot() (map[string][]byte, error) {
+	result := map[string][]byte{}
+	for _, pattern := range trackedFiles {
+		matches, err := filepath.Glob(filepath.Join(historyRoot, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			content, err := ioutil.ReadFile(match)
+			if err != nil {
+				return nil, err
+			}
+			name, err := filepath.Rel(historyRoot, match)
+			if err != nil {
+				return nil, err
+			}
+			result[name] = content
+		}
+	}
+	return result, nil
+}
+
+func revisionDir(id int) string {
+	return filepath.Join(HistoryDir, strconv.Itoa(id))
+}
+
+func readRevision(id int) (Revision, error) {
+	rev := Revision{}
+	data, err := ioutil.ReadFile(filepath.Join(revisionDir(id), "revision.json"))
+	if os.IsNotExist(err) {
+		return rev, fmt.Errorf("revision %d does not exist", id)
+	} else if err != nil {
+		return rev, err
+	}
+	if err := json.Unmarshal(data, &rev); err != nil {
+		return rev, fmt.Errorf("revision %d: %v", id, err)
+	}
+	return rev, nil
+}
+
+func revisionFiles(id int) (map[string][]byte, error) {
+	rev, err := readRevision(id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string][]byte{}
+	for _, name := range rev.Files {
+		content, err := ioutil.ReadFile(filepath.Join(revisionDir(id), "files", name))
+		if err != nil {
+			return nil, err
+		}
+		result[name] = content
+	}
+	return result, nil
+}
+
+func equalFiles(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, content := range a {
+		other, ok := b[name]
+		if !ok || !bytes.Equal(content, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// prune removes the oldest revisions beyond historyLimit. revisions is the
+// history before the latest revision was added.
+func prune(revisions []Revision) error {
+	for len(revisions)+1 > historyLimit {
+		if err := os.RemoveAll(revisionDir(revisions[0].ID)); err != nil {
+			return err
+		}
+		revisions = revisions[1:]
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	defer func(root, history string) { historyRoot, HistoryDir = root, history }(historyRoot, HistoryDir)
+	historyRoot = filepath.Join(dir, "local")
+	HistoryDir = filepath.Join(dir, "local", "config-history")
+
+	if err := os.MkdirAll(filepath.Join(historyRoot, "config.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) func() error {
+		return func() error {
+			return ioutil.WriteFile(filepath.Join(historyRoot, name), []byte(content), 0644)
+		}
+	}
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(historyRoot, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	if err := Track("maculaos install", write("config.yaml", "hostname: one\n")); err != nil {
+		t.Fatal(err)
+	}
+	// a hand edit, recorded by the next change
+	if err := write("config.d/10-extra.yaml", "maculaos:\n  modules: [wireguard]\n")(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Track("maculaos mesh join", write("mesh.yaml", "realm: io.macula\n")); err != nil {
+		t.Fatal(err)
+	}
+	// writing the same content again records nothing
+	if err := Track("maculaos mesh join", write("mesh.yaml", "realm: io.macula\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	for _, rev := range revisions {
+		commands = append(commands, rev.Command)
+	}
+	if got, want := strings.Join(commands, ", "), "maculaos install, manual edit, maculaos mesh join"; got != want {
+		t.Fatalf("history is %q, want %q", got, want)
+	}
+	if got := strings.Join(revisions[2].Files, ","); got != "config.d/10-extra.yaml,config.yaml,mesh.yaml" {
+		t.Errorf("revision 3 files are %s", got)
+	}
+
+	diff, err := Diff(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"--- /dev/null\n+++ r3/config.d/10-extra.yaml\n@@ -0,0 +1,2 @@\n+maculaos:\n+  modules: [wireguard]\n",
+		"--- /dev/null\n+++ r3/mesh.yaml\n@@ -0,0 +1 @@\n+realm: io.macula\n",
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff does not contain\n%s\ngot:\n%s", want, diff)
+		}
+	}
+	if diff, err := Diff(3, 0); err != nil || diff != "" {
+		t.Errorf("diff against the current files is %q, %v", diff, err)
+	}
+
+	if err := write("config.yaml", "hostname: broken\n")(); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := Rollback(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.ID != 5 || rev.Command != "rollback to revision 1" {
+		t.Errorf("rollback recorded %+v", rev)
+	}
+	if read("config.yaml") != "hostname: one\n" || read("mesh.yaml") != "" || read("config.d/10-extra.yaml") != "" {
+		t.Errorf("rollback did not restore revision 1")
+	}
+	// the state before the rollback is kept, so it can be undone
+	if diff, err := Diff(4, 0); err != nil || !strings.Contains(diff, "-hostname: broken\n+hostname: one\n") {
+		t.Errorf("diff from before the rollback is %q, %v", diff, err)
+	}
+
+	if _, err := Rollback(1); err == nil {
+		t.Errorf("rolling back to the current state should fail")
+	}
+	if _, err := Rollback(42); err == nil {
+		t.Errorf("rolling back to a missing revision should fail")
+	}
+
+	// files are restored with the permissions they were recorded with
+	if _, err := Rollback(3); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(historyRoot, "mesh.yaml")); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("mesh.yaml should be restored 0644, got %v, %v", info, err)
+	}
+	changed, err := ChangedFiles(5, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(changed, ","); got != "config.d/10-extra.yaml,mesh.yaml" {
+		t.Errorf("changed files are %s", got)
+	}
+}
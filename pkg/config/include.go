@@ -0,0 +1,255 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/macula-io/macula-os/pkg/system"
+	"github.com/macula-io/macula-os/pkg/util"
+	"github.com/rancher/mapper/convert"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxIncludeDepth bounds how deep includes may nest, which also ends cycles
+	maxIncludeDepth = 5
+	// fetchTimeout bounds fetching a remote include, since the config is read
+	// at boot and by every command
+	fetchTimeout = 10 * time.Second
+)
+
+var (
+	// PreferIncludeCache uses the verified copy of remote includes cached
+	// before rather than fetching them, for the initrd and boot phases, where
+	// the network may not be up yet
+	PreferIncludeCache = false
+
+	// includeCache holds the remote fragments last fetched, for offline boots
+	includeCache = system.LocalPath("include-cache")
+
+	fetch = func(url string) ([]byte, error) {
+		return util.HTTPLoadBytesTimeout(url, fetchTimeout)
+	}
+)
+
+// includeLayers returns the fragments the include list of data refers to, in
+// the order they are merged
+func includeLayers(l layer, data map[string]interface{}) []layer {
+	includes, ok := data["include"]
+	if !ok {
+		return nil
+	}
+
+	var result []layer
+	for i, item := range convert.ToInterfaceSlice(includes) {
+		inc := Include{}
+		if str, ok := item.(string); ok {
+			inc.Path = str
+		} else if m, ok := item.(map[string]interface{}); ok {
+			if err := schemas.Schema("include").Mapper.ToInternal(m); err != nil {
+				logrus.Warnf("%s: include[%d]: %v", l.name, i, err)
+				continue
+			}
+			if err := convert.ToObj(m, &inc); err != nil {
+				logrus.Warnf("%s: include[%d]: %v", l.name, i, err)
+				continue
+			}
+		}
+
+		layers, err := inc.layers(l)
+		if err != nil {
+			logrus.Warnf("%s: include[%d]: %v", l.name, i, err)
+			continue
+		}
+		result = append(result, layers...)
+	}
+	return result
+}
+
+func (inc Include) layers(parent layer) ([]layer, error) {
+	switch {
+	case inc.Path == "":
+		return nil, fmt.Errorf("path is required")
+	case strings.HasPrefix(inc.Path, "https://"):
+		if inc.SHA256 == "" && inc.PublicKey == "" {
+			return nil, fmt.Errorf("%s: remote includes must set sha256 or publicKey", inc.Path)
+		}
+		return []layer{{
+			name: inc.Path,
+			read: func() (map[string]interface{}, error) {
+				return inc.readRemote()
+			},
+		}}, nil
+	case strings.Contains(inc.Path, "://"):
+		return nil, fmt.Errorf("%s: only local files and https URLs can be included", inc.Path)
+	}
+
+	pattern := inc.Path
+	if !filepath.IsAbs(pattern) {
+		// relative to the including file, or to config.d
+		dir := localConfigs
+		if parent.file != "" {
+			dir = filepath.Dir(parent.file)
+		}
+		pattern = filepath.Join(dir, pattern)
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("%s does not exist", pattern)
+	}
+	sort.Strings(files)
+
+	var result []layer
+	for _, file := range files {
+		file := file
+		result = append(result, layer{
+			name: file,
+			file: file,
+			read: func() (map[string]interface{}, error) {
+				content, err := ioutil.ReadFile(file)
+				if err != nil {
+					return nil, err
+				}
+				var signature []byte
+				if inc.PublicKey != "" {
+					// local fragments carry their signature next to them
+					if signature, err = ioutil.ReadFile(file + ".sig"); err != nil {
+						return nil, fmt.Errorf("signature: %v", err)
+					}
+				}
+				if err := inc.verify(content, signature); err != nil {
+					return nil, err
+				}
+				return parseFragment(content)
+			},
+		})
+	}
+	return result, nil
+}
+
+// readRemote fetches and verifies a remote fragment, falling back to the
+// cached copy when it cannot be fetched. With PreferIncludeCache, a cached
+// copy that verifies is used without fetching.
+func (inc Include) readRemote() (map[string]interface{}, error) {
+	sum := sha256.Sum256([]byte(inc.Path))
+	cached := filepath.Join(includeCache, hex.EncodeToString(sum[:]))
+
+	if PreferIncludeCache {
+		if content, err := inc.readCached(cached); err == nil {
+			return parseFragment(content)
+		}
+	}
+
+	content, signature, err := inc.fetch()
+	if err == nil {
+		err = inc.verify(content, signature)
+	}
+	if err != nil {
+		content, cacheErr := inc.readCached(cached)
+		if os.IsNotExist(cacheErr) {
+			return nil, err
+		} else if cacheErr != nil {
+			return nil, fmt.Errorf("%v, and the cached copy failed verification: %v", err, cacheErr)
+		}
+		logrus.Warnf("%s: %v, using the copy cached in %s", inc.Path, err, includeCache)
+		return parseFragment(content)
+	}
+
+	if err := os.MkdirAll(includeCache, 0700); err != nil {
+		return nil, err
+	}
+	if err := util.WriteFileAtomic(cached+".yaml", content, 0600); err != nil {
+		return nil, err
+	}
+	if signature != nil {
+		if err := util.WriteFileAtomic(cached+".sig", signature, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return parseFragment(content)
+}
+
+// readCached returns the cached copy of a remote fragment if it verifies
+func (inc Include) readCached(cached string) ([]byte, error) {
+	content, err := ioutil.ReadFile(cached + ".yaml")
+	if err != nil {
+		return nil, err
+	}
+	signature, _ := ioutil.ReadFile(cached + ".sig")
+	if err := inc.verify(content, signature); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+func (inc Include) fetch() ([]byte, []byte, error) {
+	content, err := fetch(inc.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if inc.PublicKey == "" {
+		return content, nil, nil
+	}
+
+	signatureURL := inc.Signature
+	if signatureURL == "" {
+		signatureURL = inc.Path + ".sig"
+	}
+	signature, err := fetch(signatureURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signature: %v", err)
+	}
+	return content, signature, nil
+}
+
+// verify checks content against the pinned digest and public key. Local
+// files without either are trusted as they are.
+func (inc Include) verify(content, signature []byte) error {
+	if inc.SHA256 != "" {
+		sum := sha256.Sum256(content)
+		if !strings.EqualFold(strings.TrimPrefix(inc.SHA256, "sha256:"), hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("sha256 digest %x does not match %s", sum, inc.SHA256)
+		}
+	}
+
+	if inc.PublicKey == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(inc.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("publicKey must be a base64 ed25519 public key")
+	}
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil {
+			return fmt.Errorf("signature must be raw or base64 ed25519")
+		}
+		signature = decoded
+	}
+	if !ed25519.Verify(key, content, signature) {
+		return fmt.Errorf("signature does not match publicKey")
+	}
+	return nil
+}
+
+func parseFragment(content []byte) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIncludes(t *testing.T) {
+	dir := t.TempDir()
+	defer func(cache string) { includeCache = cache }(includeCache)
+	includeCache = filepath.Join(dir, "cache")
+	defer func(f func(string) ([]byte, error)) { fetch, PreferIncludeCache = f, false }(fetch)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := []byte("maculaos:\n  labels:\n    site: brussels\n  k3sArgs: [--site]\nhostname: site\n")
+	remote := map[string][]byte{
+		"https://configs.example.com/site.yaml":     site,
+		"https://configs.example.com/site.yaml.sig": []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, site))),
+	}
+	fetch = func(url string) ([]byte, error) {
+		if data, ok := remote[url]; ok {
+			return data, nil
+		}
+		return nil, fmt.Errorf("non-200 http response: 404")
+	}
+
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	write("10-base.yaml", "maculaos:\n  modules: [base]\n")
+	write("20-base.yaml", "maculaos:\n  +modules: [more]\n")
+	tampered := write("tampered.yaml", "hostname: evil\n")
+	sum := sha256.Sum256([]byte("hostname: good\n"))
+
+	node := write("node.yaml", fmt.Sprintf(`
+include:
+- https://configs.example.com/other.yaml
+- path: https://configs.example.com/site.yaml
+  public_key: %s
+- "*-base.yaml"
+- path: %s
+  sha256: %s
+hostname: node
+`, base64.StdEncoding.EncodeToString(pub), tampered, hex.EncodeToString(sum[:])))
+
+	read := layer{name: node, file: node, read: func() (map[string]interface{}, error) {
+		return readFile(node)
+	}}
+
+	expect := func() {
+		t.Helper()
+		cc, err := layersToObject(read)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			name          string
+			got, expected interface{}
+		}{
+			{"hostname", cc.Hostname, "node"},
+			{"labels", cc.Maculaos.Labels, map[string]string{"site": "brussels"}},
+			{"k3sArgs", cc.Maculaos.K3sArgs, []string{"--site"}},
+			{"modules", cc.Maculaos.Modules, []string{"base", "more"}},
+			{"include", len(cc.Include), 0},
+		} {
+			if !reflect.DeepEqual(test.got, test.expected) {
+				t.Errorf("%s: got %v, expected %v", test.name, test.got, test.expected)
+			}
+		}
+	}
+	expect()
+
+	// offline, the verified copy of the remote fragment is used
+	delete(remote, "https://configs.example.com/site.yaml")
+	expect()
+
+	// at boot, the verified copy is used without fetching
+	PreferIncludeCache = true
+	online := fetch
+	fetch = func(url string) ([]byte, error) {
+		if url == "https://configs.example.com/site.yaml" || url == "https://configs.example.com/site.yaml.sig" {
+			t.Errorf("%s fetched despite its cached copy", url)
+		}
+		return online(url)
+	}
+	expect()
+	PreferIncludeCache, fetch = false, online
+
+	// a fragment that does not match its signature is not merged
+	remote["https://configs.example.com/site.yaml"] = []byte("hostname: evil\n")
+	if err := ioutil.WriteFile(filepath.Join(includeCache, fmt.Sprintf("%x.yaml", sha256.Sum256([]byte("https://configs.example.com/site.yaml")))), []byte("hostname: evil\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cc, err := layersToObject(read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.Maculaos.Labels != nil {
+		t.Fatalf("unverified fragment merged: %v", cc.Maculaos.Labels)
+	}
+
+	problems := validateLayer(layer{name: "test"}, map[string]interface{}{
+		"include": []interface{}{"a.yaml", map[string]interface{}{"path": "b.yaml", "bogus": true}},
+	})
+	if len(problems) != 1 || problems[0].Path != "include[1].bogus" {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/rancher/mapper"
+	"github.com/rancher/mapper/convert"
+	"github.com/rancher/mapper/definition"
+)
+
+const durationPattern = `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)?$`
+
+// JSONSchema renders the CloudConfig schema as a JSON Schema document that
+// editors can use to check config files. Fields are accepted under their
+// camelCase and snake_case spellings, as ReadConfig does.
+func JSONSchema() ([]byte, error) {
+	definitions := map[string]interface{}{}
+	addDefinition(schema, definitions)
+
+	doc := map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "MaculaOS cloud config",
+		"$ref":        "#/definitions/" + schema.ID,
+		"definitions": definitions,
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func addDefinition(s *mapper.Schema, definitions map[string]interface{}) {
+	if _, ok := definitions[s.ID]; ok {
+		return
+	}
+
+	properties := map[string]interface{}{
+		mergeKey: directiveSchema(),
+	}
+	definitions[s.ID] = map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+
+	var names []string
+	for name := range s.ResourceFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := s.ResourceFields[name]
+		property := jsonSchemaType(field, field.Type, definitions)
+		aliases := []string{name}
+		if alias := convert.ToYAMLKey(name); alias != name {
+			aliases = append(aliases, alias)
+		}
+		for _, alias := range aliases {
+			properties[alias] = property
+			if mergeable(field.Type) {
+				properties["+"+alias] = property
+			}
+		}
+	}
+}
+
+func jsonSchemaType(field mapper.Field, fieldType string, definitions map[string]interface{}) map[string]interface{} {
+	switch {
+	case definition.IsArrayType(fieldType):
+		subType := definition.SubType(fieldType)
+		result := map[string]interface{}{
+			"type": "array",
+			"items": map[string]interface{}{
+				"anyOf": []interface{}{
+					jsonSchemaType(field, subType, definitions),
+					map[string]interface{}{
+						"type":                 "object",
+						"properties":           map[string]interface{}{mergeKey: directiveSchema()},
+						"required":             []string{mergeKey},
+						"additionalProperties": false,
+					},
+				},
+			},
+		}
+		if subType == "string" {
+			// a single string is accepted as a list of one
+			result["type"] = []string{"array", "string"}
+		}
+		return result
+	case definition.IsMapType(fieldType):
+		subType := definition.SubType(fieldType)
+		values := map[string]interface{}{
+			"type": []string{"string", "number", "boolean"},
+		}
+		if subType != "string" {
+			values = jsonSchemaType(field, subType, definitions)
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           map[string]interface{}{mergeKey: directiveSchema()},
+			"additionalProperties": values,
+		}
+	}
+
+	switch fieldType {
+	case "string":
+		return map[string]interface{}{"type": "string"}
+	case "enum":
+		return map[string]interface{}{"type": "string", "enum": append([]string{""}, field.Options...)}
+	case "boolean":
+		return map[string]interface{}{"type": "boolean"}
+	case "int":
+		return map[string]interface{}{"type": "integer"}
+	case "float":
+		return map[string]interface{}{"type": "number"}
+	case "duration":
+		return map[string]interface{}{"type": "string", "pattern": durationPattern}
+	case "cron":
+		return map[string]interface{}{"type": "string", "description": "cron expression with five fields or an @ macro"}
+	case "json":
+		return map[string]interface{}{}
+	}
+
+	subSchema := schemas.Schema(fieldType)
+	if subSchema == nil {
+		return map[string]interface{}{}
+	}
+	addDefinition(subSchema, definitions)
+	ref := map[string]interface{}{"$ref": "#/definitions/" + subSchema.ID}
+	if field, ok := shorthands[subSchema.ID]; ok {
+		return map[string]interface{}{
+			"anyOf": []interface{}{
+				map[string]interface{}{"type": "string", "description": "short for an object with only " + field},
+				ref,
+			},
+		}
+	}
+	return ref
+}
+
+func directiveSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "string",
+		"enum":        mergeDirectives,
+		"description": "how this value is merged with lower priority config layers",
+	}
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+)
+
+// locate finds the line of the value at path in block style YAML content.
+// It returns the closest enclosing line it could find, or 0 if none.
+func locate(content []byte, path []string) int {
+	if len(content) == 0 {
+		return 0
+	}
+
+	lines := strings.Split(string(content), "\n")
+	start, end, line := 0, len(lines), 0
+	for _, key := range path {
+		index, err := strconv.Atoi(key)
+		if err == nil {
+			found := findItem(lines, start, end, index)
+			if found < 0 {
+				break
+			}
+			line = found + 1
+			// the first key of an item shares the line with its marker
+			start, end = found, blockEnd(lines, found)
+			continue
+		}
+		found := findKey(lines, start, end, key)
+		if found < 0 {
+			break
+		}
+		line = found + 1
+		start, end = found+1, blockEnd(lines, found)
+	}
+	return line
+}
+
+// findKey returns the index of the least indented line in [start, end) that
+// defines key, allowing for a leading sequence marker
+func findKey(lines []string, start, end int, key string) int {
+	best, bestIndent := -1, -1
+	for i := start; i < end; i++ {
+		indent, text := splitIndent(lines[i])
+		for strings.HasPrefix(text, "- ") {
+			indent += 2
+			text = strings.TrimLeft(text[2:], " ")
+		}
+		if !definesKey(text, key) {
+			continue
+		}
+		if best < 0 || indent < bestIndent {
+			best, bestIndent = i, indent
+		}
+	}
+	return best
+}
+
+// findItem returns the index of the line holding sequence item index at the
+// shallowest sequence indentation inside [start, end)
+func findItem(lines []string, start, end, index int) int {
+	itemIndent := -1
+	for i := start; i < end; i++ {
+		indent, text := splitIndent(lines[i])
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			if itemIndent < 0 || indent < itemIndent {
+				itemIndent = indent
+			}
+		}
+	}
+	if itemIndent < 0 {
+		return -1
+	}
+
+	count := 0
+	for i := start; i < end; i++ {
+		indent, text := splitIndent(lines[i])
+		if indent != itemIndent || (text != "-" && !strings.HasPrefix(text, "- ")) {
+			continue
+		}
+		if count == index {
+			return i
+		}
+		count++
+	}
+	return -1
+}
+
+// blockEnd returns the index just past the block that starts at line start
+func blockEnd(lines []string, start int) int {
+	indent, text := splitIndent(lines[start])
+	item := false
+	for strings.HasPrefix(text, "- ") {
+		indent += 2
+		text = strings.TrimLeft(text[2:], " ")
+		item = true
+	}
+	for i := start + 1; i < len(lines); i++ {
+		lineIndent, lineText := splitIndent(lines[i])
+		if lineText == "" || strings.HasPrefix(lineText, "#") {
+			continue
+		}
+		if lineIndent < indent {
+			return i
+		}
+		// a sequence may sit at the same indentation as the key that owns it
+		if !item && lineIndent == indent && !strings.HasPrefix(lineText, "- ") {
+			return i
+		}
+	}
+	return len(lines)
+}
+
+func splitIndent(line string) (int, string) {
+	text := strings.TrimLeft(line, " ")
+	return len(line) - len(text), strings.TrimRight(text, " \t\r")
+}
+
+func definesKey(text, key string) bool {
+	for _, quoted := range []string{key, `"` + key + `"`, `'` + key + `'`} {
+		if strings.HasPrefix(text, quoted) {
+			rest := strings.TrimLeft(text[len(quoted):], " ")
+			if strings.HasPrefix(rest, ":") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,397 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/rancher/mapper"
+	"github.com/rancher/mapper/convert"
+	"github.com/rancher/mapper/definition"
+)
+
+// Merge directives control how a layer combines a list or map with the value
+// lower priority layers set. A field's default directive is set with a
+// `merge` struct tag; a layer overrides it with a `+key` (append) or with a
+// `$merge` marker, either as a key of a map or as an item of a list.
+const (
+	MergeAppend  = "append"
+	MergePrepend = "prepend"
+	MergeReplace = "replace"
+	MergeUnion   = "unique-union"
+
+	mergeKey = "$merge"
+)
+
+var mergeDirectives = []string{MergeAppend, MergePrepend, MergeReplace, MergeUnion}
+
+// fieldMerges holds the default directive of fields by schema and field name
+var fieldMerges = structMerges(reflect.TypeOf(CloudConfig{}), map[string]map[string]string{})
+
+func structMerges(t reflect.Type, result map[string]map[string]string) map[string]map[string]string {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	id := convert.LowerTitle(t.Name())
+	if t.Kind() != reflect.Struct || result[id] != nil {
+		return result
+	}
+
+	result[id] = map[string]string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if directive := field.Tag.Get("merge"); directive != "" {
+			if err := validDirective(directive); err != nil {
+				panic(fmt.Sprintf("%s.%s: %v", t.Name(), field.Name, err))
+			}
+			result[id][jsonName(field)] = directive
+		}
+		structMerges(field.Type, result)
+	}
+	return result
+}
+
+func jsonName(field reflect.StructField) string {
+	return strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+}
+
+// Origin is a config layer that set a value, along with the value as it
+// stood after the layer was merged and the directive it was merged with
+type Origin struct {
+	Source string      `json:"source"`
+	Value  interface{} `json:"value"`
+	Merge  string      `json:"merge,omitempty"`
+}
+
+// Provenance maps the dotted key paths of the merged config to the layers
+// that set them, lowest priority first. The last origin is the effective one.
+type Provenance map[string][]Origin
+
+// Explain merges every config layer the way ReadConfig does and records
+// which layer set each value
+func Explain() (Provenance, error) {
+	_, provenance, err := merge(layers()...)
+	if err != nil {
+		return nil, err
+	}
+	provenance.redact()
+	return provenance, nil
+}
+
+// redact replaces the values of secret fields so that decrypted values are
+// not shown
+func (p Provenance) redact() {
+	for path, origins := range p {
+		var field mapper.Field
+		fieldType := schema.ID
+		for _, part := range strings.Split(path, ".") {
+			if definition.IsMapType(fieldType) {
+				fieldType = definition.SubType(fieldType)
+				field = mapper.Field{}
+				continue
+			}
+			if s := schemas.Schema(fieldType); s != nil {
+				field = s.ResourceFields[part]
+				fieldType = field.Type
+			}
+		}
+
+		for i := range origins {
+			if str, ok := origins[i].Value.(string); ok && field.WriteOnly && str != "" {
+				origins[i].Value = Redacted
+				continue
+			}
+			redactValue(fieldType, origins[i].Value, func(interface{}) {})
+		}
+	}
+}
+
+func (p Provenance) set(path []string, origin Origin) {
+	key := joinPath(path)
+	for existing := range p {
+		if strings.HasPrefix(existing, key+".") || strings.HasPrefix(existing, key+"[") {
+			delete(p, existing)
+		}
+	}
+	p[key] = append(p[key], origin)
+}
+
+// expandMergeKeys rewrites `+key` entries of data, and of the maps nested in
+// it, into `key` carrying an append marker
+func expandMergeKeys(data map[string]interface{}) {
+	for k, v := range data {
+		if sub, ok := v.(map[string]interface{}); ok {
+			expandMergeKeys(sub)
+		}
+		if strings.HasPrefix(k, "+") && len(k) > 1 {
+			delete(data, k)
+			data[k[1:]] = withDirective(v, MergeAppend)
+		}
+	}
+}
+
+func withDirective(value interface{}, directive string) interface{} {
+	marker := map[string]interface{}{mergeKey: directive}
+	switch v := value.(type) {
+	case string:
+		return []interface{}{marker, v}
+	case []string:
+		return append([]interface{}{marker}, toInterfaceSlice(v)...)
+	case []interface{}:
+		return append([]interface{}{marker}, v...)
+	case map[string]interface{}:
+		result := map[string]interface{}{mergeKey: directive}
+		for k, item := range v {
+			result[k] = item
+		}
+		return result
+	}
+	return value
+}
+
+// splitDirective removes a merge marker from a list or map value, returning
+// the directive it held
+func splitDirective(value interface{}) (string, interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		directive := ""
+		var items []interface{}
+		for _, item := range v {
+			if m, ok := item.(map[string]interface{}); ok && len(m) == 1 && m[mergeKey] != nil {
+				directive = convert.ToString(m[mergeKey])
+				continue
+			}
+			items = append(items, item)
+		}
+		if directive == "" {
+			return "", value
+		}
+		return directive, items
+	case map[string]interface{}, map[string]string:
+		m, _ := toMap(v)
+		directive, ok := m[mergeKey]
+		if !ok {
+			return "", value
+		}
+		delete(m, mergeKey)
+		return convert.ToString(directive), m
+	}
+	return "", value
+}
+
+// mergeValue merges src over dest. Values of struct types are merged field by
+// field, and maps of struct types key by key. Lists and string maps are
+// replaced as a whole unless the layer or the field's default asks for
+// another directive. Only fields known to the schema are recorded in the
+// provenance; the aliases FuzzyNames copies to their field are dropped.
+func mergeValue(fieldType, directive string, path []string, tracked bool, dest, src interface{}, source string, provenance Provenance) interface{} {
+	if inline, value := splitDirective(src); inline != "" {
+		directive, src = inline, value
+	}
+
+	srcMap, isMap := src.(map[string]interface{})
+	if !isMap || isStringMap(fieldType) || directive == MergeReplace {
+		result := combine(directive, dest, src)
+		if tracked {
+			origin := Origin{Source: source, Value: result}
+			if directive != MergeReplace && dest != nil {
+				origin.Merge = directive
+			}
+			provenance.set(path, origin)
+		}
+		return result
+	}
+
+	destMap, _ := dest.(map[string]interface{})
+	result := make(map[string]interface{}, len(destMap)+len(srcMap))
+	for k, v := range destMap {
+		result[k] = v
+	}
+
+	subSchema := schemas.Schema(fieldType)
+	for k, v := range srcMap {
+		childPath := append(append([]string{}, path...), k)
+		childType, childDirective := "", ""
+		childTracked := false
+		if definition.IsMapType(fieldType) {
+			childType = definition.SubType(fieldType)
+			childTracked = tracked
+		} else if subSchema != nil {
+			if name, ok := fieldName(subSchema, k); ok && name != k {
+				// already copied to its field by FuzzyNames
+				delete(result, k)
+				continue
+			}
+			field, ok := subSchema.ResourceFields[k]
+			childType = field.Type
+			childDirective = fieldMerges[fieldType][k]
+			childTracked = tracked && ok
+		}
+		result[k] = mergeValue(childType, childDirective, childPath, childTracked, destMap[k], v, source, provenance)
+	}
+	return result
+}
+
+// combine applies a list or map directive to dest and src. Anything that is
+// not a list or map, and the replace directive, yields src.
+func combine(directive string, dest, src interface{}) interface{} {
+	if directive == "" || directive == MergeReplace {
+		return src
+	}
+
+	if srcMap, ok := toMap(src); ok {
+		result, _ := toMap(dest)
+		if result == nil {
+			result = map[string]interface{}{}
+		}
+		for k, v := range srcMap {
+			result[k] = v
+		}
+		return result
+	}
+
+	srcList, ok := toList(src)
+	if !ok {
+		return src
+	}
+	destList, _ := toList(dest)
+
+	switch directive {
+	case MergeAppend:
+		return append(append([]interface{}{}, destList...), srcList...)
+	case MergePrepend:
+		return append(append([]interface{}{}, srcList...), destList...)
+	case MergeUnion:
+		var result []interface{}
+		for _, item := range append(append([]interface{}{}, destList...), srcList...) {
+			if !containsItem(result, item) {
+				result = append(result, item)
+			}
+		}
+		return result
+	}
+	return src
+}
+
+// toMap returns a copy of a map value. String maps have already been through
+// NewToMap when they are merged.
+func toMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			result[k] = item
+		}
+		return result, true
+	case map[string]string:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			result[k] = item
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+func toList(value interface{}) ([]interface{}, bool) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, true
+	case []string:
+		return toInterfaceSlice(v), true
+	case string:
+		return []interface{}{v}, true
+	}
+	return nil, false
+}
+
+func toInterfaceSlice(items []string) []interface{} {
+	result := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		result = append(result, item)
+	}
+	return result
+}
+
+func containsItem(items []interface{}, item interface{}) bool {
+	for _, existing := range items {
+		if reflect.DeepEqual(existing, item) {
+			return true
+		}
+	}
+	return false
+}
+
+func validDirective(directive string) error {
+	for _, d := range mergeDirectives {
+		if directive == d {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid merge directive %q, must be one of: %s", directive, strings.Join(mergeDirectives, ", "))
+}
+
+// isStringMap reports whether fieldType is a map of plain values, which the
+// merge treats as a single value
+func isStringMap(fieldType string) bool {
+	return definition.IsMapType(fieldType) && schemas.Schema(definition.SubType(fieldType)) == nil
+}
+
+// Keys returns the sorted paths recorded at or below key. An empty key
+// matches every path, and key segments may use any spelling ReadConfig
+// accepts. A key below a value that is merged as a whole, such as a single
+// label, matches that value.
+func (p Provenance) Keys(key string) []string {
+	key = canonicalPath(key)
+
+	var result []string
+	for path := range p {
+		if key == "" || path == key || strings.HasPrefix(path, key+".") || strings.HasPrefix(path, key+"[") {
+			result = append(result, path)
+		}
+	}
+	sort.Strings(result)
+	if len(result) > 0 {
+		return result
+	}
+
+	for parts := strings.Split(key, "."); len(parts) > 1; {
+		parts = parts[:len(parts)-1]
+		if _, ok := p[strings.Join(parts, ".")]; ok {
+			return []string{strings.Join(parts, ".")}
+		}
+	}
+	return nil
+}
+
+// canonicalPath rewrites each segment of a dotted key to the field name it
+// resolves to in the schema
+func canonicalPath(key string) string {
+	if key == "" {
+		return ""
+	}
+
+	var result []string
+	fieldType := schema.ID
+	for _, part := range strings.Split(key, ".") {
+		if definition.IsMapType(fieldType) {
+			result = append(result, part)
+			fieldType = definition.SubType(fieldType)
+			continue
+		}
+		s := schemas.Schema(fieldType)
+		if s == nil {
+			result = append(result, part)
+			fieldType = ""
+			continue
+		}
+		name, ok := fieldName(s, part)
+		if !ok {
+			name = part
+		}
+		result = append(result, name)
+		fieldType = s.ResourceFields[name].Type
+	}
+	return strings.Join(result, ".")
+}
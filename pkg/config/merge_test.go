@@ -0,0 +1,161 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	static := func(data map[string]interface{}) reader {
+		return func() (map[string]interface{}, error) {
+			return data, nil
+		}
+	}
+
+	_, provenance, err := merge(
+		layer{name: "system", read: static(map[string]interface{}{
+			"hostname": "one",
+			"maculaos": map[string]interface{}{
+				"k3s_args": []interface{}{"server"},
+				"labels":   map[string]interface{}{"a": "b"},
+			},
+		})},
+		layer{name: "local", read: static(map[string]interface{}{
+			"hostname": "two",
+			"maculaos": map[string]interface{}{
+				"k3sArgs": []interface{}{"agent"},
+			},
+		})},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostname := provenance["hostname"]
+	if len(hostname) != 2 || hostname[0].Source != "system" || hostname[1].Source != "local" || hostname[1].Value != "two" {
+		t.Fatalf("unexpected hostname provenance: %v", hostname)
+	}
+
+	if origins := provenance["maculaos.labels"]; len(origins) != 1 || origins[0].Source != "system" {
+		t.Fatalf("unexpected labels provenance: %v", origins)
+	}
+
+	if _, ok := provenance["maculaos.k3s_args"]; ok {
+		t.Fatal("alias recorded in provenance")
+	}
+
+	if keys := provenance.Keys("maculaos.k3s_args"); !reflect.DeepEqual(keys, []string{"maculaos.k3sArgs"}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	if keys := provenance.Keys("maculaos.labels.a"); !reflect.DeepEqual(keys, []string{"maculaos.labels"}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+func TestMergeDirectives(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	defer func(system, local, locals, cmd, host, keys, user string) {
+		SystemConfig, LocalConfig, localConfigs, cmdline, hostname, ssh, userdata = system, local, locals, cmd, host, keys, user
+	}(SystemConfig, LocalConfig, localConfigs, cmdline, hostname, ssh, userdata)
+
+	SystemConfig = write("system.yaml", `
+ssh_authorized_keys:
+- one
+maculaos:
+  modules: [a]
+  k3s_args: [server]
+  labels:
+    role: edge
+  sysctls:
+    vm.swappiness: "60"
+    kernel.panic: "10"
+  dns_nameservers: [1.1.1.1]
+`)
+	cmdline = write("cmdline", `maculaos.+k3sArgs=--debug maculaos.modules=b`)
+	LocalConfig = write("local.yaml", `
+maculaos:
+  k3sArgs:
+  - $merge: prepend
+  - --node-name=x
+  labels:
+    zone: a
+`)
+	hostname = write("run/local_hostname", "host")
+	ssh = write("run/authorized_keys", "one\ntwo\n")
+	userdata = write("run/userdata", `
++ssh_authorized_keys: [three]
+maculaos:
+  dnsNameservers: [8.8.8.8]
+`)
+	localConfigs = filepath.Join(dir, "config.d")
+	write("config.d/10-keys.yaml", `
++ssh_authorized_keys: four
+maculaos:
+  +sysctls:
+    vm.swappiness: "10"
+  +dns_nameservers: 9.9.9.9
+  labels:
+    $merge: replace
+    zone: b
+`)
+
+	cc, err := ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name          string
+		got, expected interface{}
+	}{
+		{"sshAuthorizedKeys", cc.SSHAuthorizedKeys, []string{"one", "two", "three", "four"}},
+		{"modules", cc.Maculaos.Modules, []string{"b"}},
+		{"k3sArgs", cc.Maculaos.K3sArgs, []string{"--node-name=x", "server", "--debug"}},
+		{"dnsNameservers", cc.Maculaos.DNSNameservers, []string{"8.8.8.8", "9.9.9.9"}},
+		{"labels", cc.Maculaos.Labels, map[string]string{"zone": "b"}},
+		{"sysctls", cc.Maculaos.Sysctls, map[string]string{"vm.swappiness": "10", "kernel.panic": "10"}},
+		{"hostname", cc.Hostname, "host"},
+	} {
+		if !reflect.DeepEqual(test.got, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, test.got, test.expected)
+		}
+	}
+
+	provenance, err := Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins := provenance["maculaos.k3sArgs"]
+	if len(origins) != 3 || origins[1].Merge != MergeAppend || origins[2].Merge != MergePrepend {
+		t.Fatalf("unexpected k3sArgs provenance: %v", origins)
+	}
+}
+
+func TestValidateMergeDirectives(t *testing.T) {
+	problems := validateLayer(layer{name: "test"}, map[string]interface{}{
+		"+hostname": "x",
+		"maculaos": map[string]interface{}{
+			"$merge":   "bogus",
+			"+k3sArgs": "--debug",
+			"modules":  []interface{}{map[string]interface{}{"$merge": "append"}, "a"},
+		},
+	})
+	if len(problems) != 2 || problems[0].Path != "+hostname" || problems[1].Path != "maculaos.$merge" {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+}
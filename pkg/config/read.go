@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/ecdh"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -12,8 +13,8 @@ import (
 	"github.com/macula-io/macula-os/pkg/system"
 	"github.com/rancher/mapper"
 	"github.com/rancher/mapper/convert"
-	merge2 "github.com/rancher/mapper/convert/merge"
 	"github.com/rancher/mapper/values"
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -36,16 +37,13 @@ var (
 		}
 		return s
 	}).MustImport(CloudConfig{})
-	schema  = schemas.Schema("cloudConfig")
-	readers = []reader{
-		readSystemConfig,
-		readCmdline,
-		readLocalConfig,
-		readCloudConfig,
-		readUserData,
-	}
+	schema = schemas.Schema("cloudConfig")
 )
 
+const cloudConfigDir = "/run/config"
+
+var cmdline = "/proc/cmdline"
+
 func ToEnv(cfg CloudConfig) ([]string, error) {
 	data, err := convert.EncodeToMap(&cfg)
 	if err != nil {
@@ -70,17 +68,28 @@ func mapToEnv(prefix string, data map[string]interface{}) []string {
 }
 
 func ReadConfig() (CloudConfig, error) {
-	return readersToObject(append(readers, readLocalConfigs()...)...)
+	return layersToObject(layers()...)
 }
 
 func readersToObject(readers ...reader) (CloudConfig, error) {
+	var result []layer
+	for i, r := range readers {
+		result = append(result, layer{
+			name: fmt.Sprintf("reader %d", i),
+			read: r,
+		})
+	}
+	return layersToObject(result...)
+}
+
+func layersToObject(layers ...layer) (CloudConfig, error) {
 	result := CloudConfig{
 		Maculaos: Maculaos{
 			Install: &Install{},
 		},
 	}
 
-	data, err := merge(readers...)
+	data, _, err := merge(layers...)
 	if err != nil {
 		return result, err
 	}
@@ -90,19 +99,101 @@ func readersToObject(readers ...reader) (CloudConfig, error) {
 
 type reader func() (map[string]interface{}, error)
 
-func merge(readers ...reader) (map[string]interface{}, error) {
+// layer is a reader along with the name its problems are reported under and
+// the file it reads, if any
+type layer struct {
+	name string
+	file string
+	read reader
+}
+
+// layers returns the config layers in the order they are merged
+func layers() []layer {
+	result := []layer{
+		{name: SystemConfig, file: SystemConfig, read: readSystemConfig},
+		{name: cmdline, read: readCmdline},
+		{name: LocalConfig, file: LocalConfig, read: readLocalConfig},
+		{name: cloudConfigDir, read: readCloudConfig},
+		{name: userdata, read: readUserData},
+	}
+	return append(result, readLocalConfigs()...)
+}
+
+func merge(layers ...layer) (map[string]interface{}, Provenance, error) {
+	return mergeLayers(true, layers...)
+}
+
+// mergeLayers merges layers, decrypting their secrets unless decrypt is false
+func mergeLayers(decrypt bool, layers ...layer) (map[string]interface{}, Provenance, error) {
 	data := map[string]interface{}{}
-	for _, r := range readers {
-		newData, err := r()
-		if err != nil {
-			return nil, err
+	provenance := Provenance{}
+
+	var keys []*ecdh.PrivateKey
+	keysRead := false
+	readKeys := func() []*ecdh.PrivateKey {
+		if !keysRead {
+			var err error
+			if keys, err = secretKeys(); err != nil {
+				logrus.Warn(err)
+			}
+			keysRead = true
+		}
+		return keys
+	}
+
+	err := walkLayers(layers, func(l layer, newData map[string]interface{}) error {
+		for _, problem := range validateLayer(l, newData) {
+			logrus.Warn(problem)
 		}
+		// the included fragments have been merged in its place
+		delete(newData, "include")
+		if decrypt {
+			decryptSecrets(l.name, newData, readKeys)
+		}
+		expandMergeKeys(newData)
 		if err := schema.Mapper.ToInternal(newData); err != nil {
-			return nil, err
+			return err
 		}
-		data = merge2.UpdateMerge(schema, schemas, data, newData, false)
+		data = mergeValue(schema.ID, "", nil, true, data, newData, l.name, provenance).(map[string]interface{})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-	return data, nil
+	return data, provenance, nil
+}
+
+// walkLayers reads each layer and calls visit with it, after visiting the
+// fragments it includes. A fragment that cannot be read is skipped with a
+// warning rather than failing the whole config.
+func walkLayers(layers []layer, visit func(l layer, data map[string]interface{}) error) error {
+	for _, l := range layers {
+		if err := walkLayer(l, 0, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkLayer(l layer, depth int, visit func(l layer, data map[string]interface{}) error) error {
+	data, err := l.read()
+	if err != nil && depth > 0 {
+		logrus.Warnf("%s: %v", l.name, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %v", l.name, err)
+	}
+
+	for _, fragment := range includeLayers(l, data) {
+		if depth >= maxIncludeDepth {
+			logrus.Warnf("%s: includes nested more than %d deep, ignoring %s", l.name, maxIncludeDepth, fragment.name)
+			continue
+		}
+		if err := walkLayer(fragment, depth+1, visit); err != nil {
+			return err
+		}
+	}
+	return visit(l, data)
 }
 
 func readSystemConfig() (map[string]interface{}, error) {
@@ -113,24 +204,31 @@ func readLocalConfig() (map[string]interface{}, error) {
 	return readFile(LocalConfig)
 }
 
-func readLocalConfigs() []reader {
-	var result []reader
+func readLocalConfigs() []layer {
+	var result []layer
 
 	files, err := ioutil.ReadDir(localConfigs)
 	if os.IsNotExist(err) {
 		return nil
 	} else if err != nil {
-		return []reader{
-			func() (map[string]interface{}, error) {
-				return nil, err
+		return []layer{
+			{
+				name: localConfigs,
+				read: func() (map[string]interface{}, error) {
+					return nil, err
+				},
 			},
 		}
 	}
 
 	for _, f := range files {
 		p := filepath.Join(localConfigs, f.Name())
-		result = append(result, func() (map[string]interface{}, error) {
-			return readFile(p)
+		result = append(result, layer{
+			name: p,
+			file: p,
+			read: func() (map[string]interface{}, error) {
+				return readFile(p)
+			},
 		})
 	}
 
@@ -160,7 +258,7 @@ func readCmdline() (map[string]interface{}, error) {
 		return nil, nil
 	}
 
-	bytes, err := ioutil.ReadFile("/proc/cmdline")
+	bytes, err := ioutil.ReadFile(cmdline)
 	if os.IsNotExist(err) {
 		return nil, nil
 	} else if err != nil {
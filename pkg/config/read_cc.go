@@ -1,17 +1,12 @@
 package config
 
 import (
-	"bytes"
-	"encoding/base64"
 	"io/ioutil"
 	"os"
 	"strings"
-
-	"github.com/ghodss/yaml"
-	"github.com/rancher/mapper/convert"
 )
 
-const (
+var (
 	hostname = "/run/config/local_hostname"
 	ssh      = "/run/config/ssh/authorized_keys"
 	userdata = "/run/config/userdata"
@@ -47,8 +42,6 @@ func readCloudConfig() (map[string]interface{}, error) {
 }
 
 func readUserData() (map[string]interface{}, error) {
-	result := map[string]interface{}{}
-
 	data, err := ioutil.ReadFile(userdata)
 	if os.IsNotExist(err) {
 		return nil, nil
@@ -56,32 +49,5 @@ func readUserData() (map[string]interface{}, error) {
 		return nil, err
 	}
 
-	cc := CloudConfig{}
-	script := false
-	if bytes.Contains(data, []byte{0}) {
-		script = true
-		cc.WriteFiles = []File{
-			{
-				Content:  base64.StdEncoding.EncodeToString(data),
-				Encoding: "b64",
-			},
-		}
-	} else if strings.HasPrefix(string(data), "#!") {
-		script = true
-		cc.WriteFiles = []File{
-			{
-				Content: string(data),
-			},
-		}
-	}
-
-	if script {
-		cc.WriteFiles[0].Owner = "root"
-		cc.WriteFiles[0].RawFilePermissions = "0700"
-		cc.WriteFiles[0].Path = "/run/macula/userdata"
-		cc.Runcmd = []string{"source /run/macula/userdata"}
-
-		return convert.EncodeToMap(cc)
-	}
-	return result, yaml.Unmarshal(data, &result)
+	return parseUserData(data)
 }
@@ -40,10 +40,30 @@ func TestAuthorizedKeys(t *testing.T) {
 			return c2, nil
 		},
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(cc.SSHAuthorizedKeys) != 1 {
-		t.Fatal(err, "got %d keys, expected 2", len(cc.SSHAuthorizedKeys))
+		t.Fatalf("got %d keys, expected 1", len(cc.SSHAuthorizedKeys))
+	}
+
+	c3 := map[string]interface{}{
+		"+ssh_authorized_keys": []string{
+			"two...",
+		},
 	}
+	cc, err = readersToObject(
+		func() (map[string]interface{}, error) {
+			return c1, nil
+		},
+		func() (map[string]interface{}, error) {
+			return c3, nil
+		},
+	)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(cc.SSHAuthorizedKeys) != 2 {
+		t.Fatalf("got %d keys, expected 2 with +ssh_authorized_keys", len(cc.SSHAuthorizedKeys))
+	}
 }
@@ -0,0 +1,395 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/system"
+	"github.com/macula-io/macula-os/pkg/util"
+	"github.com/rancher/mapper"
+	"github.com/rancher/mapper/convert"
+	"github.com/rancher/mapper/definition"
+	"github.com/sirupsen/logrus"
+)
+
+// Encrypted values are written as ENC[x25519,<base64>] where the payload is an
+// ephemeral X25519 public key, an AES-GCM nonce and the sealed value. The key
+// is derived from the shared secret and both public keys, so only the holder
+// of the node key can read the value and anyone with its recipient can write
+// one.
+const (
+	secretScheme = "x25519"
+	// Redacted replaces secret values in dumped configs
+	Redacted = "<redacted>"
+)
+
+var (
+	// SecretKey is the node-local key encrypted config values are read with
+	SecretKey = system.LocalPath("secret.key")
+
+	encryptedValue = regexp.MustCompile(`ENC\[([a-z0-9-]+),([A-Za-z0-9+/=]+)\]`)
+)
+
+// IsEncrypted reports whether value is an encrypted config value
+func IsEncrypted(value string) bool {
+	match := encryptedValue.FindStringIndex(value)
+	return match != nil && match[0] == 0 && match[1] == len(value)
+}
+
+// EncryptValue seals value for recipient, which is the base64 public key
+// printed by Recipient
+func EncryptValue(recipient, value string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(recipient)
+	if err != nil {
+		return "", fmt.Errorf("invalid recipient: %v", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid recipient: %v", err)
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return "", err
+	}
+	aead, err := secretCipher(shared, ephemeral.PublicKey().Bytes(), raw)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	payload := append(ephemeral.PublicKey().Bytes(), nonce...)
+	payload = aead.Seal(payload, nonce, []byte(value), nil)
+	return fmt.Sprintf("ENC[%s,%s]", secretScheme, base64.StdEncoding.EncodeToString(payload)), nil
+}
+
+// decryptValue opens an ENC[...] value with the first key that can
+func decryptValue(keys []*ecdh.PrivateKey, value string) (string, error) {
+	match := encryptedValue.FindStringSubmatch(value)
+	if match == nil {
+		return "", fmt.Errorf("not an encrypted value")
+	}
+	if match[1] != secretScheme {
+		return "", fmt.Errorf("unsupported encryption scheme %q", match[1])
+	}
+	payload, err := base64.StdEncoding.DecodeString(match[2])
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no secret key in %s", SecretKey)
+	}
+
+	for _, key := range keys {
+		plaintext, err := openPayload(key, payload)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return "", fmt.Errorf("value was not encrypted for this node")
+}
+
+func openPayload(key *ecdh.PrivateKey, payload []byte) (string, error) {
+	if len(payload) < 32 {
+		return "", fmt.Errorf("value is truncated")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(payload[:32])
+	if err != nil {
+		return "", err
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return "", err
+	}
+	aead, err := secretCipher(shared, payload[:32], key.PublicKey().Bytes())
+	if err != nil {
+		return "", err
+	}
+	if len(payload) < 32+aead.NonceSize() {
+		return "", fmt.Errorf("value is truncated")
+	}
+	nonce, sealed := payload[32:32+aead.NonceSize()], payload[32+aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, nil)
+	return string(plaintext), err
+}
+
+func secretCipher(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte("maculaos secret " + secretScheme))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Recipient returns the public key values are encrypted for on this node,
+// creating the node key if there is none
+func Recipient() (string, error) {
+	key, err := readSecretKey(SecretKey)
+	if os.IsNotExist(err) {
+		key, err = writeSecretKey(SecretKey)
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// secretKeys returns the node key, along with the key a rekey that did not
+// finish was moving to
+func secretKeys() ([]*ecdh.PrivateKey, error) {
+	var result []*ecdh.PrivateKey
+	for _, path := range []string{SecretKey, SecretKey + ".new"} {
+		key, err := readSecretKey(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+func readSecretKey(path string) (*ecdh.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+func writeSecretKey(path string) (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	data := base64.StdEncoding.EncodeToString(key.Bytes()) + "\n"
+	return key, util.WriteFileAtomic(path, []byte(data), 0600)
+}
+
+// Rekey generates a new node key and re-encrypts the values in files for it.
+// Nothing is changed unless every value can be decrypted with the current key.
+func Rekey(files []string) error {
+	keys, err := secretKeys()
+	if err != nil {
+		return err
+	}
+
+	contents := map[string]string{}
+	var failed []string
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		contents[file] = string(content)
+		for _, value := range encryptedValue.FindAllString(string(content), -1) {
+			if _, err := decryptValue(keys, value); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", file, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot rekey %d value(s):\n%s", len(failed), strings.Join(failed, "\n"))
+	}
+
+	newKey, err := writeSecretKey(SecretKey + ".new")
+	if err != nil {
+		return err
+	}
+	recipient := base64.StdEncoding.EncodeToString(newKey.PublicKey().Bytes())
+
+	for _, file := range files {
+		content, ok := contents[file]
+		if !ok {
+			continue
+		}
+
+		var rekeyErr error
+		rekeyed := encryptedValue.ReplaceAllStringFunc(content, func(value string) string {
+			plaintext, err := decryptValue(keys, value)
+			if err != nil {
+				rekeyErr = err
+				return value
+			}
+			result, err := EncryptValue(recipient, plaintext)
+			if err != nil {
+				rekeyErr = err
+				return value
+			}
+			return result
+		})
+		if rekeyErr != nil {
+			return fmt.Errorf("%s: %v", file, rekeyErr)
+		}
+		if rekeyed == content {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if err := util.WriteFileAtomic(file, []byte(rekeyed), info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(SecretKey+".new", SecretKey)
+}
+
+// LocalFiles returns the local config files encrypted values are kept in
+func LocalFiles() []string {
+	result := []string{LocalConfig}
+	for _, l := range readLocalConfigs() {
+		if l.file != "" {
+			result = append(result, l.file)
+		}
+	}
+	return result
+}
+
+// decryptSecrets replaces the encrypted values in data with their plaintext.
+// Values that cannot be decrypted are dropped with a warning so that the
+// ciphertext never reaches an applier.
+func decryptSecrets(source string, data map[string]interface{}, keys func() []*ecdh.PrivateKey) {
+	for k, v := range data {
+		switch value := v.(type) {
+		case string:
+			if !IsEncrypted(value) {
+				continue
+			}
+			plaintext, err := decryptValue(keys(), value)
+			if err != nil {
+				logrus.Warnf("%s: %s: %v", source, k, err)
+				delete(data, k)
+				continue
+			}
+			data[k] = plaintext
+		case map[string]interface{}:
+			decryptSecrets(source, value, keys)
+		case []interface{}:
+			for i, item := range value {
+				wrapped := map[string]interface{}{k: item}
+				decryptSecrets(source, wrapped, keys)
+				value[i] = wrapped[k]
+			}
+		}
+	}
+}
+
+// Redact replaces the values of secret fields in cfg
+func Redact(cfg CloudConfig) (CloudConfig, error) {
+	data, err := convert.EncodeToMap(cfg)
+	if err != nil {
+		return cfg, err
+	}
+	redactMap(schema, data, func(interface{}) {})
+
+	result := CloudConfig{}
+	return result, convert.ToObj(data, &result)
+}
+
+// Secrets returns the plaintext of the values of secret fields in cfg, so
+// that they can be kept out of what is printed
+func Secrets(cfg CloudConfig) ([]string, error) {
+	data, err := convert.EncodeToMap(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	var collect func(value interface{})
+	collect = func(value interface{}) {
+		switch v := value.(type) {
+		case string:
+			result = append(result, v)
+		case []interface{}:
+			for _, item := range v {
+				collect(item)
+			}
+		case map[string]interface{}:
+			for _, item := range v {
+				collect(item)
+			}
+		}
+	}
+	redactMap(schema, data, collect)
+	return result, nil
+}
+
+// redactMap replaces the values of secret fields in data, after passing each
+// to found
+func redactMap(s *mapper.Schema, data map[string]interface{}, found func(value interface{})) {
+	for name, field := range s.ResourceFields {
+		value, ok := data[name]
+		if !ok || value == nil {
+			continue
+		}
+		if field.WriteOnly {
+			if str, ok := value.(string); !ok || str != "" {
+				found(value)
+				data[name] = Redacted
+			}
+			continue
+		}
+		redactValue(field.Type, value, found)
+	}
+}
+
+func redactValue(fieldType string, value interface{}, found func(value interface{})) {
+	switch {
+	case definition.IsArrayType(fieldType):
+		if items, ok := value.([]interface{}); ok {
+			for _, item := range items {
+				redactValue(definition.SubType(fieldType), item, found)
+			}
+		}
+	case definition.IsMapType(fieldType):
+		if m, ok := value.(map[string]interface{}); ok {
+			for _, item := range m {
+				redactValue(definition.SubType(fieldType), item, found)
+			}
+		}
+	default:
+		subSchema := schemas.Schema(fieldType)
+		if m, ok := value.(map[string]interface{}); ok && subSchema != nil {
+			redactMap(subSchema, m, found)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecrets(t *testing.T) {
+	dir := t.TempDir()
+	defer func(key string) { SecretKey = key }(SecretKey)
+	SecretKey = filepath.Join(dir, "secret.key")
+
+	recipient, err := Recipient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := EncryptValue(recipient, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(token) {
+		t.Fatalf("%s is not an encrypted value", token)
+	}
+
+	file := filepath.Join(dir, "config.yaml")
+	content := "# node token\nmaculaos:\n  token: " + token + "\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	read := layer{name: file, file: file, read: func() (map[string]interface{}, error) {
+		return readFile(file)
+	}}
+
+	cc, err := layersToObject(read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.Maculaos.Token != "s3cret" {
+		t.Fatalf("got token %q, expected s3cret", cc.Maculaos.Token)
+	}
+
+	redacted, err := Redact(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redacted.Maculaos.Token != Redacted {
+		t.Fatalf("token not redacted: %q", redacted.Maculaos.Token)
+	}
+	if secrets, err := Secrets(cc); err != nil || len(secrets) != 1 || secrets[0] != "s3cret" {
+		t.Fatalf("expected the token as the only secret, got %v, %v", secrets, err)
+	}
+
+	if err := Rekey([]string{file}); err != nil {
+		t.Fatal(err)
+	}
+	rekeyed, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rekeyed) == content || !strings.HasPrefix(string(rekeyed), "# node token\n") {
+		t.Fatalf("unexpected rekeyed file:\n%s", rekeyed)
+	}
+
+	cc, err = layersToObject(read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.Maculaos.Token != "s3cret" {
+		t.Fatalf("got token %q after rekey, expected s3cret", cc.Maculaos.Token)
+	}
+
+	// a value for another node is dropped rather than used as ciphertext
+	SecretKey = filepath.Join(dir, "other.key")
+	if _, err := Recipient(); err != nil {
+		t.Fatal(err)
+	}
+	cc, err = layersToObject(read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.Maculaos.Token != "" {
+		t.Fatalf("got token %q with the wrong key, expected none", cc.Maculaos.Token)
+	}
+}
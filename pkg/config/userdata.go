@@ -0,0 +1,382 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/macula-io/macula-os/pkg/util"
+	"github.com/rancher/mapper/convert"
+	"github.com/sirupsen/logrus"
+)
+
+// userData collects the parts of a userdata payload. Scripts are run from
+// runcmd and boothooks from bootcmd, in the order they appear.
+type userData struct {
+	config    map[string]interface{}
+	scripts   [][]byte
+	boothooks [][]byte
+}
+
+// parseUserData reads userdata in any of the formats cloud-init accepts:
+// gzip, MIME multipart, #cloud-config, #cloud-boothook and scripts. Plain YAML
+// is read as a MaculaOS config.
+func parseUserData(data []byte) (map[string]interface{}, error) {
+	u := &userData{config: map[string]interface{}{}}
+	if err := u.add(data, ""); err != nil {
+		return nil, err
+	}
+	return u.toConfig()
+}
+
+func (u *userData) add(data []byte, contentType string) error {
+	if contentType == "" {
+		contentType = detectContentType(data)
+	}
+
+	switch contentType {
+	case "application/gzip", "application/x-gzip":
+		decompressed, err := util.DecompressGzip(data)
+		if err != nil {
+			return fmt.Errorf("userdata: %v", err)
+		}
+		return u.add(decompressed, "")
+	case "multipart/mixed":
+		return u.addMultipart(data)
+	case "text/cloud-config":
+		config, err := translateCloudConfig(data)
+		if err != nil {
+			return err
+		}
+		mergeUserData(u.config, config)
+	case "text/x-shellscript":
+		u.scripts = append(u.scripts, data)
+	case "text/cloud-boothook":
+		u.boothooks = append(u.boothooks, data)
+	case "text/x-maculaos-config":
+		return u.addConfig(data)
+	default:
+		logrus.Warnf("userdata: ignoring unsupported part of type %s", contentType)
+	}
+	return nil
+}
+
+func (u *userData) addConfig(data []byte) error {
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("userdata: %v", err)
+	}
+	mergeUserData(u.config, config)
+	return nil
+}
+
+func (u *userData) addMultipart(data []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("userdata: %v", err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("userdata: %v", err)
+	}
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("userdata: %v", err)
+		}
+
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			return fmt.Errorf("userdata: %v", err)
+		}
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			if body, err = base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil))); err != nil {
+				return fmt.Errorf("userdata: part %s: %v", part.FileName(), err)
+			}
+		}
+
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if contentType == "text/plain" {
+			contentType = ""
+		}
+		if strings.HasPrefix(contentType, "multipart/") {
+			// nested archives carry their own headers
+			body = append([]byte("Content-Type: "+part.Header.Get("Content-Type")+"\n\n"), body...)
+			contentType = "multipart/mixed"
+		}
+		if err := u.add(body, contentType); err != nil {
+			return err
+		}
+	}
+}
+
+// detectContentType tells the format of userdata or of a part without a
+// content type by its first bytes, as cloud-init does
+func detectContentType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return "application/gzip"
+	case bytes.HasPrefix(data, []byte("Content-Type: multipart/")), bytes.HasPrefix(data, []byte("MIME-Version:")):
+		return "multipart/mixed"
+	case bytes.HasPrefix(data, []byte("#cloud-config")):
+		return "text/cloud-config"
+	case bytes.HasPrefix(data, []byte("#cloud-boothook")):
+		return "text/cloud-boothook"
+	case bytes.HasPrefix(data, []byte("#!")), bytes.Contains(data, []byte{0}):
+		return "text/x-shellscript"
+	}
+	return "text/x-maculaos-config"
+}
+
+func (u *userData) toConfig() (map[string]interface{}, error) {
+	if len(u.scripts) == 0 && len(u.boothooks) == 0 {
+		return u.config, nil
+	}
+
+	cc := CloudConfig{}
+	for i, script := range u.scripts {
+		path := "/run/macula/userdata"
+		if i > 0 {
+			path = fmt.Sprintf("/run/macula/userdata-%d", i)
+		}
+		cc.WriteFiles = append(cc.WriteFiles, scriptFile(path, script))
+		cc.Runcmd = append(cc.Runcmd, "source "+path)
+	}
+	for i, hook := range u.boothooks {
+		path := fmt.Sprintf("/run/macula/boothook-%d", i)
+		cc.WriteFiles = append(cc.WriteFiles, scriptFile(path, hook))
+		cc.Bootcmd = append(cc.Bootcmd, "source "+path)
+	}
+
+	scripts, err := convert.EncodeToMap(cc)
+	if err != nil {
+		return nil, err
+	}
+	// scripts run after the commands of the cloud-config parts
+	mergeUserData(u.config, scripts)
+	return u.config, nil
+}
+
+func scriptFile(path string, data []byte) File {
+	f := File{
+		Content:            string(data),
+		Owner:              "root",
+		Path:               path,
+		RawFilePermissions: "0700",
+	}
+	if bytes.Contains(data, []byte{0}) {
+		f.Content = base64.StdEncoding.EncodeToString(data)
+		f.Encoding = "b64"
+	}
+	return f
+}
+
+// mergeUserData merges the parts of a userdata payload, appending lists so
+// that every part's files, commands and keys are kept
+func mergeUserData(dest, src map[string]interface{}) {
+	for k, v := range src {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			if existing, ok := dest[k].(map[string]interface{}); ok {
+				mergeUserData(existing, value)
+				continue
+			}
+		case []interface{}:
+			if existing, ok := dest[k].([]interface{}); ok {
+				dest[k] = append(existing, value...)
+				continue
+			}
+		}
+		dest[k] = v
+	}
+}
+
+// translateCloudConfig maps the cloud-init #cloud-config keys MaculaOS has an
+// equivalent for onto a config layer, warning about the rest
+func translateCloudConfig(data []byte) (map[string]interface{}, error) {
+	in := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &in); err != nil {
+		return nil, fmt.Errorf("userdata: #cloud-config: %v", err)
+	}
+
+	result := map[string]interface{}{}
+	maculaos := map[string]interface{}{}
+
+	var unsupported []string
+	for k, v := range in {
+		switch k {
+		case "hostname":
+			result["hostname"] = convert.ToString(v)
+		case "fqdn":
+			if _, ok := in["hostname"]; !ok {
+				result["hostname"] = strings.SplitN(convert.ToString(v), ".", 2)[0]
+			}
+		case "ssh_authorized_keys", "users":
+			// translated below, once the other keys are known
+		case "write_files":
+			result["writeFiles"] = translateWriteFiles(v)
+		case "runcmd":
+			result["runCmd"] = translateCommands("runcmd", v)
+		case "bootcmd":
+			result["bootCmd"] = translateCommands("bootcmd", v)
+		case "ntp":
+			ntp := convert.ToMapInterface(v)
+			servers := append(convert.ToInterfaceSlice(ntp["servers"]), convert.ToInterfaceSlice(ntp["pools"])...)
+			if len(servers) > 0 {
+				maculaos["ntpServers"] = servers
+			}
+		case "timezone":
+			maculaos["timezone"] = convert.ToString(v)
+		default:
+			unsupported = append(unsupported, k)
+		}
+	}
+
+	sort.Strings(unsupported)
+	for _, k := range unsupported {
+		logrus.Warnf("userdata: #cloud-config key %q is not supported and was ignored", k)
+	}
+
+	if keys := convert.ToInterfaceSlice(in["ssh_authorized_keys"]); len(keys) > 0 {
+		result["sshAuthorizedKeys"] = keys
+	}
+	if users := translateUsers(in["users"]); len(users) > 0 {
+		result["users"] = users
+	}
+	if len(maculaos) > 0 {
+		result["maculaos"] = maculaos
+	}
+	return result, nil
+}
+
+// translateUsers maps cloud-init users onto MaculaOS users. The "default"
+// entry stands for the macula user, which always exists, and any other name
+// for a user with nothing but its name set.
+func translateUsers(v interface{}) []interface{} {
+	var result []interface{}
+	for i, item := range convert.ToInterfaceSlice(v) {
+		if name, ok := item.(string); ok {
+			if name == "default" {
+				logrus.Warnf("userdata: users[%d]: default stands for the macula user, which always exists, and was ignored", i)
+			} else {
+				result = append(result, map[string]interface{}{"name": name})
+			}
+			continue
+		}
+		in, ok := item.(map[string]interface{})
+		if !ok {
+			logrus.Warnf("userdata: users[%d]: %v is not a user and was ignored", i, item)
+			continue
+		}
+
+		// cloud-init locks the password unless told otherwise
+		locked := true
+		if lock, ok := in["lock_passwd"]; ok {
+			locked = convert.ToBool(lock)
+		}
+
+		user := map[string]interface{}{}
+		for k, value := range in {
+			switch k {
+			case "name", "shell":
+				user[k] = convert.ToString(value)
+			case "uid":
+				user[k] = value
+			case "groups":
+				if groups, ok := value.(string); ok {
+					var list []interface{}
+					for _, group := range strings.Split(groups, ",") {
+						list = append(list, strings.TrimSpace(group))
+					}
+					value = list
+				}
+				user[k] = value
+			case "passwd", "hashed_passwd":
+				if !locked {
+					user["hashedPassword"] = convert.ToString(value)
+				}
+			case "sudo":
+				if rules, ok := value.(string); ok {
+					value = []interface{}{rules}
+				}
+				if rules, ok := value.([]interface{}); ok {
+					user[k] = rules
+				}
+			case "ssh_authorized_keys", "ssh-authorized-keys":
+				user["sshAuthorizedKeys"] = value
+			case "lock_passwd":
+			default:
+				logrus.Warnf("userdata: users[%d]: %q is not supported and was ignored", i, k)
+			}
+		}
+		result = append(result, user)
+	}
+	return result
+}
+
+func translateWriteFiles(v interface{}) []interface{} {
+	var result []interface{}
+	for i, item := range convert.ToInterfaceSlice(v) {
+		in := convert.ToMapInterface(item)
+		file := map[string]interface{}{}
+		for k, value := range in {
+			switch k {
+			case "content":
+				file[k] = convert.ToStringNoTrim(value)
+			case "path", "owner", "permissions":
+				file[k] = convert.ToString(value)
+			case "encoding":
+				if encoding := convert.ToString(value); encoding != "text/plain" {
+					file[k] = encoding
+				}
+			default:
+				logrus.Warnf("userdata: write_files[%d]: %q is not supported and was ignored", i, k)
+			}
+		}
+		result = append(result, file)
+	}
+	return result
+}
+
+// translateCommands turns cloud-init commands, which are shell strings or
+// argument lists, into shell strings
+func translateCommands(key string, v interface{}) []interface{} {
+	var result []interface{}
+	for i, item := range convert.ToInterfaceSlice(v) {
+		switch cmd := item.(type) {
+		case string:
+			result = append(result, cmd)
+		case []interface{}:
+			var args []string
+			for _, arg := range cmd {
+				args = append(args, shellQuote(convert.ToString(arg)))
+			}
+			result = append(result, strings.Join(args, " "))
+		default:
+			logrus.Warnf("userdata: %s[%d]: expected a string or list, ignored", key, i)
+		}
+	}
+	return result
+}
+
+func shellQuote(arg string) string {
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r))
+	}) < 0 {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
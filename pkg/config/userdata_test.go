@@ -0,0 +1,119 @@
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+)
+
+const multipartUserData = `Content-Type: multipart/mixed; boundary="==BOUNDARY=="
+MIME-Version: 1.0
+
+--==BOUNDARY==
+Content-Type: text/cloud-config; charset="us-ascii"
+
+#cloud-config
+hostname: edge-1
+ssh_authorized_keys:
+  - ssh-ed25519 AAAA one
+users:
+  - default
+  - name: ops
+    groups: wheel, docker
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    passwd: $6$salt$hash
+    lock_passwd: false
+    ssh_authorized_keys:
+      - ssh-ed25519 BBBB ops
+  - backup
+write_files:
+  - path: /etc/motd
+    content: |
+      hello
+    permissions: "0644"
+    defer: true
+runcmd:
+  - echo first
+  - [sh, -c, "echo it's me"]
+ntp:
+  servers: [ntp.example.com]
+timezone: Europe/Brussels
+package_update: true
+
+--==BOUNDARY==
+Content-Type: text/cloud-config
+
+runcmd:
+  - echo typed
+
+--==BOUNDARY==
+Content-Type: text/x-shellscript; charset="us-ascii"
+Content-Transfer-Encoding: base64
+
+IyEvYmluL3NoCmVjaG8gc2NyaXB0Cg==
+
+--==BOUNDARY==--
+`
+
+func TestMultipartUserData(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(multipartUserData))
+	w.Close()
+
+	data, err := parseUserData(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := readersToObject(func() (map[string]interface{}, error) {
+		return data, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name          string
+		got, expected interface{}
+	}{
+		{"hostname", cc.Hostname, "edge-1"},
+		{"sshAuthorizedKeys", cc.SSHAuthorizedKeys, []string{"ssh-ed25519 AAAA one"}},
+		{"users", cc.Users, []User{{
+			Name:              "ops",
+			Groups:            []string{"wheel", "docker"},
+			HashedPassword:    "$6$salt$hash",
+			Sudo:              []string{"ALL=(ALL) NOPASSWD:ALL"},
+			SSHAuthorizedKeys: []string{"ssh-ed25519 BBBB ops"},
+		}, {
+			Name: "backup",
+		}}},
+		// the part without a #cloud-config line is read as one for its type
+		{"runcmd", cc.Runcmd, []string{"echo first", `sh -c 'echo it'\''s me'`, "echo typed", "source /run/macula/userdata"}},
+		{"ntpServers", cc.Maculaos.NTPServers, []string{"ntp.example.com"}},
+		{"timezone", cc.Maculaos.Timezone, "Europe/Brussels"},
+		{"writeFiles", len(cc.WriteFiles), 2},
+	} {
+		if !reflect.DeepEqual(test.got, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, test.got, test.expected)
+		}
+	}
+
+	if f := cc.WriteFiles[0]; f.Path != "/etc/motd" || f.Content != "hello\n" || f.RawFilePermissions != "0644" {
+		t.Errorf("unexpected file: %+v", f)
+	}
+	if f := cc.WriteFiles[1]; f.Path != "/run/macula/userdata" || f.Content != "#!/bin/sh\necho script\n" {
+		t.Errorf("unexpected script: %+v", f)
+	}
+}
+
+func TestPlainUserData(t *testing.T) {
+	data, err := parseUserData([]byte("hostname: plain\nmaculaos:\n  labels:\n    a: b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["hostname"] != "plain" {
+		t.Fatalf("unexpected userdata: %v", data)
+	}
+}
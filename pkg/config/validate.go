@@ -0,0 +1,411 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/rancher/mapper"
+	"github.com/rancher/mapper/definition"
+)
+
+// ValidationError describes a single problem found in a config layer
+type ValidationError struct {
+	Source  string
+	Line    int
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	source := e.Source
+	if e.Line > 0 {
+		source = fmt.Sprintf("%s:%d", source, e.Line)
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %s", source, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", source, e.Path, e.Message)
+}
+
+// Validate checks every layer that ReadConfig merges against the CloudConfig schema
+func Validate() ([]ValidationError, error) {
+	var result []ValidationError
+	err := walkLayers(layers(), func(l layer, data map[string]interface{}) error {
+		result = append(result, validateLayer(l, data)...)
+		return nil
+	})
+	return result, err
+}
+
+// ValidateFile checks a single config file against the CloudConfig schema
+func ValidateFile(path string) ([]ValidationError, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{}
+	if err := yaml.Unmarshal(bytes, &data); err != nil {
+		return []ValidationError{{Source: path, Message: err.Error()}}, nil
+	}
+
+	return validateLayer(layer{name: path, file: path}, data), nil
+}
+
+func validateLayer(l layer, data map[string]interface{}) []ValidationError {
+	problems := validateMap(schema, data, nil, l.name != cmdline)
+	if len(problems) == 0 {
+		return nil
+	}
+
+	var content []byte
+	if l.file != "" {
+		content, _ = ioutil.ReadFile(l.file)
+	}
+
+	result := make([]ValidationError, 0, len(problems))
+	for _, p := range problems {
+		result = append(result, ValidationError{
+			Source:  l.name,
+			Line:    locate(content, p.path),
+			Path:    joinPath(p.path),
+			Message: p.message,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Line != result[j].Line {
+			return result[i].Line < result[j].Line
+		}
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
+type problem struct {
+	path    []string
+	message string
+}
+
+func validateMap(s *mapper.Schema, data map[string]interface{}, path []string, strict bool) []problem {
+	var problems []problem
+	for key, value := range data {
+		keyPath := append(append([]string{}, path...), key)
+		if key == mergeKey {
+			problems = append(problems, validateDirective(value, keyPath)...)
+			continue
+		}
+		name, ok := fieldName(s, key)
+		if !ok && strings.HasPrefix(key, "+") {
+			if name, ok = fieldName(s, key[1:]); ok && !mergeable(s.ResourceFields[name].Type) {
+				problems = append(problems, problem{keyPath, "+ only applies to lists and maps"})
+				continue
+			}
+		}
+		if !ok {
+			if strict {
+				problems = append(problems, problem{keyPath, "unknown key"})
+			}
+			continue
+		}
+		problems = append(problems, validateValue(s.ResourceFields[name], s.ResourceFields[name].Type, value, keyPath)...)
+	}
+	return problems
+}
+
+func validateValue(field mapper.Field, fieldType string, value interface{}, path []string) []problem {
+	if value == nil {
+		return nil
+	}
+
+	mismatch := func() []problem {
+		return []problem{{path, fmt.Sprintf("expected %s, got %s", describeType(fieldType), describeValue(value))}}
+	}
+
+	switch {
+	case definition.IsArrayType(fieldType):
+		subType := definition.SubType(fieldType)
+		var items []interface{}
+		switch v := value.(type) {
+		case []interface{}:
+			items = v
+		case []string:
+			for _, item := range v {
+				items = append(items, item)
+			}
+		case string:
+			if subType == "string" {
+				return nil
+			}
+			return mismatch()
+		default:
+			return mismatch()
+		}
+		var problems []problem
+		for i, item := range items {
+			itemPath := append(append([]string{}, path...), strconv.Itoa(i))
+			if m, ok := item.(map[string]interface{}); ok && len(m) == 1 && m[mergeKey] != nil {
+				problems = append(problems, validateDirective(m[mergeKey], append(itemPath, mergeKey))...)
+				continue
+			}
+			problems = append(problems, validateValue(field, subType, item, itemPath)...)
+		}
+		return problems
+	case definition.IsMapType(fieldType):
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		subType := definition.SubType(fieldType)
+		var problems []problem
+		for k, v := range m {
+			itemPath := append(append([]string{}, path...), k)
+			if k == mergeKey {
+				problems = append(problems, validateDirective(v, itemPath)...)
+				continue
+			}
+			if subType == "string" {
+				switch v.(type) {
+				case string, bool, float64, json.Number:
+				default:
+					problems = append(problems, problem{itemPath, fmt.Sprintf("expected string, got %s", describeValue(v))})
+				}
+				continue
+			}
+			problems = append(problems, validateValue(field, subType, v, itemPath)...)
+		}
+		return problems
+	}
+
+	switch fieldType {
+	case "json":
+		return nil
+	case "string":
+		if _, ok := value.(string); !ok {
+			return mismatch()
+		}
+	case "enum":
+		str, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		if str == "" {
+			return nil
+		}
+		for _, option := range field.Options {
+			if str == option {
+				return nil
+			}
+		}
+		return []problem{{path, fmt.Sprintf("invalid value %q, must be one of: %s", str, strings.Join(field.Options, ", "))}}
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+		case string:
+			if v != "true" && v != "false" {
+				return mismatch()
+			}
+		default:
+			return mismatch()
+		}
+	case "int":
+		switch v := value.(type) {
+		case float64:
+			if v != float64(int64(v)) {
+				return mismatch()
+			}
+		case json.Number:
+			if _, err := v.Int64(); err != nil {
+				return mismatch()
+			}
+		default:
+			return mismatch()
+		}
+	case "float":
+		switch value.(type) {
+		case float64, json.Number:
+		default:
+			return mismatch()
+		}
+	case "duration":
+		str, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		if _, err := time.ParseDuration(str); err != nil && str != "" {
+			return []problem{{path, fmt.Sprintf("invalid duration %q", str)}}
+		}
+	case "cron":
+		str, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		if err := validCron(str); err != nil && str != "" {
+			return []problem{{path, fmt.Sprintf("invalid cron expression %q: %v", str, err)}}
+		}
+	default:
+		subSchema := schemas.Schema(fieldType)
+		if subSchema == nil {
+			return nil
+		}
+		if _, ok := value.(string); ok && shorthands[fieldType] != "" {
+			return nil
+		}
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		return validateMap(subSchema, m, path, true)
+	}
+
+	return nil
+}
+
+// shorthands lists the schemas a string may stand in for, along with the
+// field the string sets
+var shorthands = map[string]string{
+	"include": "path",
+}
+
+func validateDirective(value interface{}, path []string) []problem {
+	str, ok := value.(string)
+	if !ok {
+		return []problem{{path, fmt.Sprintf("expected string, got %s", describeValue(value))}}
+	}
+	if err := validDirective(str); err != nil {
+		return []problem{{path, err.Error()}}
+	}
+	return nil
+}
+
+// mergeable reports whether values of fieldType can be appended to
+func mergeable(fieldType string) bool {
+	return definition.IsArrayType(fieldType) || definition.IsMapType(fieldType)
+}
+
+func describeType(fieldType string) string {
+	switch {
+	case definition.IsArrayType(fieldType):
+		return "list of " + describeType(definition.SubType(fieldType))
+	case definition.IsMapType(fieldType):
+		return "map of " + describeType(definition.SubType(fieldType))
+	}
+	switch fieldType {
+	case "int":
+		return "integer"
+	case "float":
+		return "number"
+	case "enum", "duration", "cron":
+		return "string"
+	case "string", "boolean":
+		return fieldType
+	}
+	return "map"
+}
+
+func describeValue(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		return "number"
+	case []interface{}, []string:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// joinPath renders a key path as dotted keys with list indexes in brackets
+func joinPath(path []string) string {
+	buf := &strings.Builder{}
+	for i, p := range path {
+		if _, err := strconv.Atoi(p); err == nil && i > 0 {
+			buf.WriteString("[" + p + "]")
+			continue
+		}
+		if i > 0 {
+			buf.WriteString(".")
+		}
+		buf.WriteString(p)
+	}
+	return buf.String()
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+	names    []string
+}{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// validCron checks a standard five field cron expression or one of the @ macros
+func validCron(expr string) error {
+	switch expr {
+	case "@yearly", "@annually", "@monthly", "@weekly", "@daily", "@midnight", "@hourly", "@reboot":
+		return nil
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return fmt.Errorf("expected %d fields, got %d", len(cronFields), len(fields))
+	}
+
+	for i, field := range fields {
+		spec := cronFields[i]
+		value := func(s string) (int, error) {
+			for j, name := range spec.names {
+				if strings.EqualFold(s, name) {
+					return j + spec.min, nil
+				}
+			}
+			n, err := strconv.Atoi(s)
+			if err != nil || n < spec.min || n > spec.max {
+				return 0, fmt.Errorf("invalid %s %q", spec.name, s)
+			}
+			return n, nil
+		}
+
+		for _, part := range strings.Split(field, ",") {
+			rangePart := part
+			if idx := strings.Index(part, "/"); idx >= 0 {
+				if step, err := strconv.Atoi(part[idx+1:]); err != nil || step <= 0 {
+					return fmt.Errorf("invalid step in %s %q", spec.name, part)
+				}
+				rangePart = part[:idx]
+			}
+			if rangePart == "*" {
+				continue
+			}
+			bounds := strings.SplitN(rangePart, "-", 2)
+			low, err := value(bounds[0])
+			if err != nil {
+				return err
+			}
+			if len(bounds) == 2 {
+				high, err := value(bounds[1])
+				if err != nil {
+					return err
+				}
+				if high < low {
+					return fmt.Errorf("invalid range in %s %q", spec.name, part)
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	content := `hostname: edge-01
+ssh_authorized_keys: ssh-rsa AAA
+maculaos:
+  datasource: cdrom
+  labls:
+    a: b
+  health:
+    checks:
+      - name: k3s
+        type: process
+      - name: web
+        type: htp
+        timeout: 5 seconds
+  backup:
+    schedule: "0 2 * * *"
+    retention: seven
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := ValidateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		line int
+		path string
+	}{
+		{5, "maculaos.labls"},
+		{12, "maculaos.health.checks[1].type"},
+		{13, "maculaos.health.checks[1].timeout"},
+		{16, "maculaos.backup.retention"},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("got %d problems, expected %d: %v", len(problems), len(expected), problems)
+	}
+	for i, e := range expected {
+		if problems[i].Line != e.line || problems[i].Path != e.path {
+			t.Errorf("problem %d: got %s, expected line %d at %s", i, problems[i], e.line, e.path)
+		}
+	}
+}
+
+func TestValidCron(t *testing.T) {
+	for _, expr := range []string{"0 2 * * *", "*/15 0-6 1,15 jan-mar mon-fri", "@daily"} {
+		if err := validCron(expr); err != nil {
+			t.Errorf("%q: %v", expr, err)
+		}
+	}
+	for _, expr := range []string{"0 2 * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "5-1 * * * *"} {
+		if err := validCron(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultTimeout bounds a single provider's probe and extract
+	DefaultTimeout = 10 * time.Second
+	// DefaultWait is how long Run keeps retrying while no provider answers,
+	// to give the network and block devices time to come up
+	DefaultWait = 2 * time.Minute
+)
+
+// ConfigDir is where metadata is written for config.ReadConfig to pick up
+var ConfigDir = "/run/config"
+
+// Metadata is what a provider knows about the instance
+type Metadata struct {
+	Hostname string
+	SSHKeys  []string
+	UserData []byte
+}
+
+// Provider is a source of instance metadata
+type Provider interface {
+	String() string
+	// Probe reports whether the provider is present on this instance
+	Probe(ctx context.Context) bool
+	// Extract reads the instance metadata
+	Extract(ctx context.Context) (*Metadata, error)
+}
+
+// New returns the provider with the given name, as used in
+// maculaos.dataSources. The none provider is returned as nil.
+func New(name string) (Provider, error) {
+	switch name {
+	case "cdrom", "nocloud":
+		return NewNoCloud(), nil
+	case "openstack", "configdrive", "config-drive":
+		return NewConfigDrive(), nil
+	case "aws", "ec2":
+		return NewEC2(), nil
+	case "gce":
+		return NewGCE(), nil
+	case "digitalocean":
+		return NewDigitalOcean(), nil
+	case "packet":
+		return NewPacket(), nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown datasource %q", name)
+}
+
+// Providers returns the providers for names, in order
+func Providers(names []string) ([]Provider, error) {
+	var result []Provider
+	for _, name := range names {
+		p, err := New(name)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// Run tries providers in order, giving each timeout to answer, and writes the
+// metadata of the first one found to ConfigDir. The providers are tried again
+// until ctx is done.
+func Run(ctx context.Context, providers []Provider, timeout time.Duration) (Provider, error) {
+	if len(providers) == 0 {
+		return nil, nil
+	}
+
+	for {
+		for _, p := range providers {
+			md, err := try(ctx, p, timeout)
+			if err != nil {
+				logrus.Warnf("datasource %s: %v", p, err)
+				continue
+			}
+			if md == nil {
+				logrus.Debugf("datasource %s: not available", p)
+				continue
+			}
+			return p, Write(ConfigDir, md)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no datasource available, tried: %s", names(providers))
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func try(ctx context.Context, p Provider, timeout time.Duration) (*Metadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if !p.Probe(ctx) {
+		return nil, nil
+	}
+	return p.Extract(ctx)
+}
+
+func names(providers []Provider) string {
+	var result []string
+	for _, p := range providers {
+		result = append(result, p.String())
+	}
+	return strings.Join(result, ", ")
+}
+
+// Write stores md in dir using the layout config.ReadConfig reads
+func Write(dir string, md *Metadata) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if md.Hostname != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, "local_hostname"), []byte(md.Hostname+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	if len(md.SSHKeys) > 0 {
+		if err := os.MkdirAll(filepath.Join(dir, "ssh"), 0700); err != nil {
+			return err
+		}
+		keys := strings.Join(md.SSHKeys, "\n") + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, "ssh", "authorized_keys"), []byte(keys), 0600); err != nil {
+			return err
+		}
+	}
+
+	if len(md.UserData) > 0 {
+		if err := ioutil.WriteFile(filepath.Join(dir, "userdata"), md.UserData, 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sshKeys returns the non-empty, trimmed lines of keys
+func sshKeys(keys ...string) []string {
+	var result []string
+	for _, key := range keys {
+		for _, line := range strings.Split(key, "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				result = append(result, line)
+			}
+		}
+	}
+	return result
+}
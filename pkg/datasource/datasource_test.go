@@ -0,0 +1,234 @@
+package datasource
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEC2(t *testing.T) {
+	const token = "session"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(token))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/instance-id":
+			w.Write([]byte("i-0123"))
+		case "/latest/meta-data/local-hostname":
+			w.Write([]byte("ip-10-0-0-1.ec2.internal"))
+		case "/latest/meta-data/public-keys/":
+			w.Write([]byte("0=deploy\n1=admin"))
+		case "/latest/meta-data/public-keys/0/openssh-key":
+			w.Write([]byte("ssh-ed25519 AAAA deploy\n"))
+		case "/latest/meta-data/public-keys/1/openssh-key":
+			w.Write([]byte("ssh-ed25519 BBBB admin\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	expectMetadata(t, &EC2{URL: server.URL}, &Metadata{
+		Hostname: "ip-10-0-0-1.ec2.internal",
+		SSHKeys:  []string{"ssh-ed25519 AAAA deploy", "ssh-ed25519 BBBB admin"},
+	})
+}
+
+func TestGCE(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/id":
+			w.Write([]byte("42"))
+		case "/computeMetadata/v1/instance/hostname":
+			w.Write([]byte("node-1.c.project.internal"))
+		case "/computeMetadata/v1/project/attributes/ssh-keys":
+			w.Write([]byte("ops:ssh-ed25519 AAAA ops"))
+		case "/computeMetadata/v1/instance/attributes/user-data":
+			w.Write([]byte("#cloud-config\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	expectMetadata(t, &GCE{URL: server.URL}, &Metadata{
+		Hostname: "node-1",
+		SSHKeys:  []string{"ssh-ed25519 AAAA ops"},
+		UserData: []byte("#cloud-config\n"),
+	})
+}
+
+func TestDigitalOcean(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/v1/id":
+			w.Write([]byte("1234"))
+		case "/metadata/v1.json":
+			w.Write([]byte(`{"hostname":"droplet","public_keys":["ssh-rsa AAAA a"],"user_data":"hostname: x"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	expectMetadata(t, &DigitalOcean{URL: server.URL}, &Metadata{
+		Hostname: "droplet",
+		SSHKeys:  []string{"ssh-rsa AAAA a"},
+		UserData: []byte("hostname: x"),
+	})
+}
+
+func TestNoCloud(t *testing.T) {
+	dir := writeSeed(t, map[string]string{
+		"meta-data": "instance-id: iid-1\nlocal-hostname: seeded\npublic-keys:\n  - ssh-ed25519 AAAA seed\n",
+		"user-data": "#cloud-config\nhostname: seeded\n",
+	})
+
+	expectMetadata(t, &Drive{name: "cdrom", parse: parseNoCloud, Dir: dir}, &Metadata{
+		Hostname: "seeded",
+		SSHKeys:  []string{"ssh-ed25519 AAAA seed"},
+		UserData: []byte("#cloud-config\nhostname: seeded\n"),
+	})
+}
+
+func TestConfigDrive(t *testing.T) {
+	dir := writeSeed(t, map[string]string{
+		"openstack/latest/meta_data.json": `{"hostname":"stack","public_keys":{"b":"ssh-rsa BBBB","a":"ssh-rsa AAAA"}}`,
+		"openstack/latest/user_data":      "#!/bin/sh\n",
+	})
+
+	expectMetadata(t, &Drive{name: "openstack", parse: parseConfigDrive, Dir: dir}, &Metadata{
+		Hostname: "stack",
+		SSHKeys:  []string{"ssh-rsa AAAA", "ssh-rsa BBBB"},
+		UserData: []byte("#!/bin/sh\n"),
+	})
+}
+
+// TestSeedImage reads a NoCloud seed from a loop mounted filesystem image. It
+// needs root and e2fsprogs, and is skipped without them.
+func TestSeedImage(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	if _, err := exec.LookPath("mke2fs"); err != nil {
+		t.Skip("requires mke2fs")
+	}
+
+	seed := writeSeed(t, map[string]string{
+		"meta-data": "local-hostname: looped\n",
+	})
+	image := filepath.Join(t.TempDir(), "seed.img")
+	if out, err := exec.Command("mke2fs", "-q", "-t", "ext2", "-L", "cidata", "-d", seed, image, "1M").CombinedOutput(); err != nil {
+		t.Skipf("mke2fs: %v: %s", err, out)
+	}
+	out, err := exec.Command("losetup", "-f", "--show", image).Output()
+	if err != nil {
+		t.Skipf("losetup: %v", err)
+	}
+	device := strings.TrimSpace(string(out))
+	defer exec.Command("losetup", "-d", device).Run()
+
+	p := NewNoCloud()
+	p.Device = device
+	md, err := try(context.Background(), p, DefaultTimeout)
+	if err != nil && strings.Contains(err.Error(), "failed to mount") {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if md == nil || md.Hostname != "looped" {
+		t.Fatalf("unexpected metadata: %+v", md)
+	}
+}
+
+func TestRunFallback(t *testing.T) {
+	defer func(dir string) { ConfigDir = dir }(ConfigDir)
+	ConfigDir = t.TempDir()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer down.Close()
+
+	seed := writeSeed(t, map[string]string{
+		"meta-data": "local-hostname: fallback\npublic-keys: ssh-ed25519 AAAA fallback\n",
+		"user-data": "hostname: fallback\n",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p, err := Run(ctx, []Provider{
+		&EC2{URL: down.URL},
+		&Drive{name: "cdrom", parse: parseNoCloud, Dir: seed},
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.String() != "cdrom" {
+		t.Fatalf("got provider %s, expected cdrom", p)
+	}
+
+	for file, expected := range map[string]string{
+		"local_hostname":      "fallback\n",
+		"ssh/authorized_keys": "ssh-ed25519 AAAA fallback\n",
+		"userdata":            "hostname: fallback\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(ConfigDir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("%s: got %q, expected %q", file, data, expected)
+		}
+	}
+}
+
+func expectMetadata(t *testing.T, p Provider, expected *Metadata) {
+	t.Helper()
+	md, err := try(context.Background(), p, DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md == nil {
+		t.Fatalf("%s not available", p)
+	}
+	if !reflect.DeepEqual(md, expected) {
+		t.Fatalf("got %+v, expected %+v", md, expected)
+	}
+}
+
+func writeSeed(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
@@ -0,0 +1,50 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+const digitalOceanURL = "http://169.254.169.254"
+
+// DigitalOcean reads the droplet metadata service
+type DigitalOcean struct {
+	URL string
+}
+
+// NewDigitalOcean returns the DigitalOcean provider
+func NewDigitalOcean() *DigitalOcean {
+	return &DigitalOcean{URL: digitalOceanURL}
+}
+
+func (p *DigitalOcean) String() string {
+	return "digitalocean"
+}
+
+func (p *DigitalOcean) Probe(ctx context.Context) bool {
+	_, err := request(ctx, http.MethodGet, p.URL+"/metadata/v1/id", nil)
+	return err == nil
+}
+
+func (p *DigitalOcean) Extract(ctx context.Context) (*Metadata, error) {
+	data, err := request(ctx, http.MethodGet, p.URL+"/metadata/v1.json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	droplet := struct {
+		Hostname   string   `json:"hostname"`
+		PublicKeys []string `json:"public_keys"`
+		UserData   string   `json:"user_data"`
+	}{}
+	if err := json.Unmarshal(data, &droplet); err != nil {
+		return nil, err
+	}
+
+	return &Metadata{
+		Hostname: droplet.Hostname,
+		SSHKeys:  sshKeys(droplet.PublicKeys...),
+		UserData: []byte(droplet.UserData),
+	}, nil
+}
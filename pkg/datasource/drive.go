@@ -0,0 +1,199 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/ghodss/yaml"
+	"github.com/rancher/mapper/convert"
+)
+
+// Drive reads metadata from a labelled seed filesystem, such as a NoCloud
+// cidata image or an OpenStack config drive
+type Drive struct {
+	name   string
+	labels []string
+	parse  func(dir string) (*Metadata, error)
+
+	// Device is the block device holding the seed, found by label if unset
+	Device string
+	// Dir is an already mounted seed, read instead of a device
+	Dir string
+}
+
+// NewNoCloud returns the NoCloud provider, which reads a seed image labelled
+// cidata as created by cloud-localds or genisoimage
+func NewNoCloud() *Drive {
+	return &Drive{
+		name:   "cdrom",
+		labels: []string{"cidata", "CIDATA"},
+		parse:  parseNoCloud,
+	}
+}
+
+// NewConfigDrive returns the OpenStack config drive provider
+func NewConfigDrive() *Drive {
+	return &Drive{
+		name:   "openstack",
+		labels: []string{"config-2", "CONFIG-2"},
+		parse:  parseConfigDrive,
+	}
+}
+
+func (p *Drive) String() string {
+	return p.name
+}
+
+func (p *Drive) Probe(ctx context.Context) bool {
+	if p.Dir != "" {
+		_, err := os.Stat(p.Dir)
+		return err == nil
+	}
+	if p.Device == "" {
+		p.Device = findDevice(ctx, p.labels)
+	}
+	return p.Device != ""
+}
+
+func (p *Drive) Extract(ctx context.Context) (*Metadata, error) {
+	if p.Dir != "" {
+		return p.parse(p.Dir)
+	}
+
+	dir, err := ioutil.TempDir("", "datasource")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+
+	if err := mountReadOnly(ctx, p.Device, dir); err != nil {
+		return nil, err
+	}
+	defer syscall.Unmount(dir, 0)
+
+	return p.parse(dir)
+}
+
+func findDevice(ctx context.Context, labels []string) string {
+	for _, label := range labels {
+		out, err := exec.CommandContext(ctx, "blkid", "-t", "LABEL="+label, "-o", "device").Output()
+		if err != nil {
+			continue
+		}
+		if devices := strings.Fields(string(out)); len(devices) > 0 {
+			return devices[0]
+		}
+	}
+	return ""
+}
+
+func mountReadOnly(ctx context.Context, device, dir string) error {
+	fsTypes := []string{"iso9660", "vfat", "ext4"}
+	if out, err := exec.CommandContext(ctx, "blkid", "-s", "TYPE", "-o", "value", device).Output(); err == nil {
+		if fsType := strings.TrimSpace(string(out)); fsType != "" {
+			fsTypes = []string{fsType}
+		}
+	}
+
+	var err error
+	for _, fsType := range fsTypes {
+		if err = syscall.Mount(device, dir, fsType, syscall.MS_RDONLY, ""); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to mount %s: %v", device, err)
+}
+
+func readOptional(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// parseNoCloud reads the meta-data and user-data files of a NoCloud seed
+func parseNoCloud(dir string) (*Metadata, error) {
+	md := &Metadata{}
+
+	data, err := readOptional(filepath.Join(dir, "meta-data"))
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("meta-data: %v", err)
+	}
+
+	md.Hostname = convert.ToString(meta["local-hostname"])
+	if md.Hostname == "" {
+		md.Hostname = convert.ToString(meta["hostname"])
+	}
+
+	// public-keys may be a key, a list of keys or a map of named keys
+	switch keys := meta["public-keys"].(type) {
+	case string:
+		md.SSHKeys = sshKeys(keys)
+	case []interface{}:
+		for _, key := range keys {
+			md.SSHKeys = append(md.SSHKeys, sshKeys(convert.ToString(key))...)
+		}
+	case map[string]interface{}:
+		for _, name := range sortedKeys(keys) {
+			key := keys[name]
+			if named, ok := key.(map[string]interface{}); ok {
+				key = named["openssh-key"]
+			}
+			md.SSHKeys = append(md.SSHKeys, sshKeys(convert.ToString(key))...)
+		}
+	}
+
+	if md.UserData, err = readOptional(filepath.Join(dir, "user-data")); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// parseConfigDrive reads the latest metadata of an OpenStack config drive
+func parseConfigDrive(dir string) (*Metadata, error) {
+	md := &Metadata{}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "openstack", "latest", "meta_data.json"))
+	if err != nil {
+		return nil, err
+	}
+	meta := struct {
+		Hostname   string                 `json:"hostname"`
+		PublicKeys map[string]interface{} `json:"public_keys"`
+	}{}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("meta_data.json: %v", err)
+	}
+
+	md.Hostname = meta.Hostname
+	for _, name := range sortedKeys(meta.PublicKeys) {
+		md.SSHKeys = append(md.SSHKeys, sshKeys(convert.ToString(meta.PublicKeys[name]))...)
+	}
+
+	if md.UserData, err = readOptional(filepath.Join(dir, "openstack", "latest", "user_data")); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var result []string
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
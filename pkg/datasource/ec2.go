@@ -0,0 +1,78 @@
+package datasource
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const ec2URL = "http://169.254.169.254"
+
+// EC2 reads the AWS instance metadata service using IMDSv2 session tokens
+type EC2 struct {
+	URL string
+}
+
+// NewEC2 returns the AWS provider
+func NewEC2() *EC2 {
+	return &EC2{URL: ec2URL}
+}
+
+func (p *EC2) String() string {
+	return "aws"
+}
+
+func (p *EC2) Probe(ctx context.Context) bool {
+	token, err := p.token(ctx)
+	if err != nil {
+		return false
+	}
+	_, err = p.get(ctx, token, "meta-data/instance-id")
+	return err == nil
+}
+
+func (p *EC2) Extract(ctx context.Context) (*Metadata, error) {
+	token, err := p.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	md := &Metadata{}
+	hostname, err := optional(p.get(ctx, token, "meta-data/local-hostname"))
+	if err != nil {
+		return nil, err
+	}
+	md.Hostname = strings.TrimSpace(string(hostname))
+
+	// public-keys lists the keys as index=name
+	index, err := optional(p.get(ctx, token, "meta-data/public-keys/"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range sshKeys(string(index)) {
+		n := strings.SplitN(line, "=", 2)[0]
+		key, err := p.get(ctx, token, "meta-data/public-keys/"+n+"/openssh-key")
+		if err != nil {
+			return nil, err
+		}
+		md.SSHKeys = append(md.SSHKeys, sshKeys(string(key))...)
+	}
+
+	if md.UserData, err = optional(p.get(ctx, token, "user-data")); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+func (p *EC2) token(ctx context.Context) (string, error) {
+	token, err := request(ctx, http.MethodPut, p.URL+"/latest/api/token", map[string]string{
+		"X-aws-ec2-metadata-token-ttl-seconds": "300",
+	})
+	return string(token), err
+}
+
+func (p *EC2) get(ctx context.Context, token, path string) ([]byte, error) {
+	return request(ctx, http.MethodGet, p.URL+"/latest/"+path, map[string]string{
+		"X-aws-ec2-metadata-token": token,
+	})
+}
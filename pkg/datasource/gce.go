@@ -0,0 +1,63 @@
+package datasource
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const gceURL = "http://metadata.google.internal"
+
+// GCE reads the Google Compute Engine metadata server
+type GCE struct {
+	URL string
+}
+
+// NewGCE returns the Google Compute Engine provider
+func NewGCE() *GCE {
+	return &GCE{URL: gceURL}
+}
+
+func (p *GCE) String() string {
+	return "gce"
+}
+
+func (p *GCE) Probe(ctx context.Context) bool {
+	_, err := p.get(ctx, "instance/id")
+	return err == nil
+}
+
+func (p *GCE) Extract(ctx context.Context) (*Metadata, error) {
+	md := &Metadata{}
+	hostname, err := optional(p.get(ctx, "instance/hostname"))
+	if err != nil {
+		return nil, err
+	}
+	// the hostname is fully qualified, the node name is its first label
+	md.Hostname = strings.SplitN(strings.TrimSpace(string(hostname)), ".", 2)[0]
+
+	// ssh-keys entries are user:key, set on the project and the instance
+	for _, path := range []string{"project/attributes/ssh-keys", "instance/attributes/ssh-keys"} {
+		keys, err := optional(p.get(ctx, path))
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range sshKeys(string(keys)) {
+			if parts := strings.SplitN(line, ":", 2); len(parts) == 2 && !strings.Contains(parts[0], " ") {
+				line = parts[1]
+			}
+			md.SSHKeys = append(md.SSHKeys, line)
+		}
+	}
+
+	if md.UserData, err = optional(p.get(ctx, "instance/attributes/user-data")); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+func (p *GCE) get(ctx context.Context, path string) ([]byte, error) {
+	return request(ctx, http.MethodGet, p.URL+"/computeMetadata/v1/"+path, map[string]string{
+		"Metadata-Flavor": "Google",
+	})
+}
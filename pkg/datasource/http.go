@@ -0,0 +1,52 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// errNotFound is returned for metadata the provider does not have, such as
+// userdata on an instance launched without it
+var errNotFound = errors.New("not found")
+
+// client talks to link-local metadata services, which must not go through a
+// proxy
+var client = &http.Client{
+	Transport: &http.Transport{Proxy: nil},
+}
+
+func request(ctx context.Context, method, url string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// optional returns data, treating missing metadata as empty
+func optional(data []byte, err error) ([]byte, error) {
+	if err == errNotFound {
+		return nil, nil
+	}
+	return data, err
+}
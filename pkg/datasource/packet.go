@@ -0,0 +1,52 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+const packetURL = "https://metadata.platformequinix.com"
+
+// Packet reads the Equinix Metal (formerly Packet) metadata service
+type Packet struct {
+	URL string
+}
+
+// NewPacket returns the Equinix Metal provider
+func NewPacket() *Packet {
+	return &Packet{URL: packetURL}
+}
+
+func (p *Packet) String() string {
+	return "packet"
+}
+
+func (p *Packet) Probe(ctx context.Context) bool {
+	_, err := request(ctx, http.MethodGet, p.URL+"/metadata", nil)
+	return err == nil
+}
+
+func (p *Packet) Extract(ctx context.Context) (*Metadata, error) {
+	data, err := request(ctx, http.MethodGet, p.URL+"/metadata", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	device := struct {
+		Hostname string   `json:"hostname"`
+		SSHKeys  []string `json:"ssh_keys"`
+	}{}
+	if err := json.Unmarshal(data, &device); err != nil {
+		return nil, err
+	}
+
+	md := &Metadata{
+		Hostname: device.Hostname,
+		SSHKeys:  sshKeys(device.SSHKeys...),
+	}
+	if md.UserData, err = optional(request(ctx, http.MethodGet, p.URL+"/userdata", nil)); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
@@ -0,0 +1,323 @@
+// Package effects routes the changes the cloud-config appliers make to the
+// system. While a Recorder is active every change is recorded, and in dry-run
+// mode it is only recorded, so that a config can be planned before it is
+// applied.
+package effects
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/util"
+)
+
+// Kinds of effects
+const (
+	KindFile    = "file"
+	KindSymlink = "symlink"
+	KindSysctl  = "sysctl"
+	KindModule  = "module"
+	KindCommand = "command"
+	KindSystem  = "system"
+)
+
+// Effect is a change made, or planned, by an applier
+type Effect struct {
+	Kind    string `json:"kind"`
+	Target  string `json:"target"`
+	Detail  string `json:"detail,omitempty"`
+	Changed bool   `json:"changed"`
+
+	old, new  []byte
+	oldExists bool
+	exists    bool
+	private   bool // written with a mode others cannot read
+}
+
+// Recorder collects the effects of the appliers run while it is active
+type Recorder struct {
+	DryRun  bool
+	Effects []*Effect
+
+	files map[string]*Effect
+}
+
+var current *Recorder
+
+// Record starts recording effects. With dryRun the system is left unchanged.
+func Record(dryRun bool) *Recorder {
+	current = &Recorder{
+		DryRun: dryRun,
+		files:  map[string]*Effect{},
+	}
+	return current
+}
+
+// Stop ends recording
+func (r *Recorder) Stop() {
+	if current == r {
+		current = nil
+	}
+}
+
+// DryRun reports whether changes are only being recorded
+func DryRun() bool {
+	return current != nil && current.DryRun
+}
+
+// Do records an effect and, unless in dry-run mode, makes it with apply
+func Do(kind, target, detail string, changed bool, apply func() error) error {
+	if current != nil {
+		current.Effects = append(current.Effects, &Effect{
+			Kind:    kind,
+			Target:  target,
+			Detail:  detail,
+			Changed: changed,
+		})
+		if current.DryRun {
+			return nil
+		}
+	}
+	return apply()
+}
+
+// ReadFile reads a file as it would be after the effects planned so far
+func ReadFile(path string) ([]byte, error) {
+	if current != nil {
+		if e, ok := current.files[path]; ok {
+			if !e.exists {
+				return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+			}
+			return e.new, nil
+		}
+	}
+	return ioutil.ReadFile(path)
+}
+
+// File records writing content to path with perm and, unless in dry-run mode,
+// writes it with write
+func File(path string, content []byte, perm os.FileMode, write func() error) error {
+	return file(path, content, true, perm, write)
+}
+
+func file(path string, content []byte, exists bool, perm os.FileMode, write func() error) error {
+	if current == nil {
+		return write()
+	}
+
+	e, ok := current.files[path]
+	if !ok {
+		e = &Effect{
+			Kind:   KindFile,
+			Target: path,
+		}
+		if old, err := ioutil.ReadFile(path); err == nil {
+			e.old = old
+			e.oldExists = true
+		}
+		if info, err := os.Stat(path); err == nil {
+			e.private = info.Mode().Perm()&0004 == 0
+		}
+		current.files[path] = e
+		current.Effects = append(current.Effects, e)
+	}
+	e.new = content
+	e.exists = exists
+	e.private = e.private || perm&0004 == 0
+	e.Changed = e.oldExists != e.exists || !bytes.Equal(e.old, e.new)
+
+	if current.DryRun {
+		return nil
+	}
+	return write()
+}
+
+// WriteFile writes a file the way ioutil.WriteFile does
+func WriteFile(path string, content []byte, perm os.FileMode) error {
+	return File(path, content, perm, func() error {
+		return ioutil.WriteFile(path, content, perm)
+	})
+}
+
+// WriteBlock replaces the block between the "# BEGIN maculaos <name>" and
+// "# END maculaos <name>" lines of a file with lines, keeping the rest of the
+// file, and reports whether it changed. Without lines the block is removed.
+func WriteBlock(path, name string, lines []string, perm os.FileMode) (bool, error) {
+	old, err := ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	begin, end := "# BEGIN maculaos "+name, "# END maculaos "+name
+	var result []string
+	inBlock := false
+	for _, line := range strings.Split(strings.TrimSuffix(string(old), "\n"), "\n") {
+		switch {
+		case line == begin:
+			inBlock = true
+		case line == end:
+			inBlock = false
+		case !inBlock && (line != "" || len(result) > 0):
+			result = append(result, line)
+		}
+	}
+	if len(lines) > 0 {
+		result = append(result, begin)
+		result = append(result, lines...)
+		result = append(result, end)
+	}
+
+	content := ""
+	if len(result) > 0 {
+		content = strings.Join(result, "\n") + "\n"
+	}
+	if content == string(old) {
+		return false, nil
+	}
+	return true, WriteFile(path, []byte(content), perm)
+}
+
+// Remove removes a file if it exists
+func Remove(path string) error {
+	return file(path, nil, false, 0644, func() error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Symlink points path at target, replacing what is there
+func Symlink(target, path string) error {
+	existing, _ := os.Readlink(path)
+	return Do(KindSymlink, path, "-> "+target, existing != target, func() error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(target, path)
+	})
+}
+
+// MkdirAll creates a directory. It is not recorded on its own, the files
+// written to it are.
+func MkdirAll(path string, perm os.FileMode) error {
+	if DryRun() {
+		return nil
+	}
+	return os.MkdirAll(path, perm)
+}
+
+// Chown changes the owner of a file written before
+func Chown(path string, uid, gid int) error {
+	if DryRun() {
+		return nil
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// Run records running cmd and, unless in dry-run mode, runs it
+func Run(cmd *exec.Cmd) error {
+	return Do(KindCommand, commandLine(cmd.Args), "", true, cmd.Run)
+}
+
+// RunOutput is Run with the output of cmd captured, and added to the error
+// when it fails
+func RunOutput(cmd *exec.Cmd) error {
+	out := &strings.Builder{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := Run(cmd); err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+func commandLine(args []string) string {
+	var quoted []string
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`|&;<>()*?[]#~") {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Changed reports whether any recorded effect changes the system
+func (r *Recorder) Changed() bool {
+	for _, e := range r.Effects {
+		if e.Changed {
+			return true
+		}
+	}
+	return false
+}
+
+// Paths returns the files and symlinks changed, sorted
+func (r *Recorder) Paths() []string {
+	var result []string
+	for _, e := range r.Effects {
+		if e.Changed && (e.Kind == KindFile || e.Kind == KindSymlink) {
+			result = append(result, e.Target)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Diff renders the changes recorded: a unified diff for every file and a
+// line for every other effect. With redact, the contents of the files others
+// cannot read, or that hold one of secrets, are left out.
+func (r *Recorder) Diff(redact bool, secrets []string) string {
+	buf := &strings.Builder{}
+	for _, e := range r.Effects {
+		if !e.Changed {
+			continue
+		}
+		switch {
+		case e.Kind == KindFile && redact && e.sensitive(secrets):
+			fmt.Fprintf(buf, "file %s contents changed (redacted)\n", e.Target)
+		case e.Kind == KindFile:
+			from, to := e.Target, e.Target
+			if !e.oldExists {
+				from = "/dev/null"
+			}
+			if !e.exists {
+				to = "/dev/null"
+			}
+			buf.WriteString(util.UnifiedDiff(from, to, e.old, e.new))
+		default:
+			line := e.Kind + " " + e.Target
+			if e.Detail != "" {
+				line += " " + e.Detail
+			}
+			if redact {
+				for _, secret := range secrets {
+					if secret != "" {
+						line = strings.Replace(line, secret, "<redacted>", -1)
+					}
+				}
+			}
+			buf.WriteString(line + "\n")
+		}
+	}
+	return buf.String()
+}
+
+// sensitive reports whether the contents of a file are not to be shown
+func (e *Effect) sensitive(secrets []string) bool {
+	if e.private {
+		return true
+	}
+	for _, secret := range secrets {
+		if secret != "" && (bytes.Contains(e.old, []byte(secret)) || bytes.Contains(e.new, []byte(secret))) {
+			return true
+		}
+	}
+	return false
+}
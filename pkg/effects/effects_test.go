@@ -0,0 +1,128 @@
+package effects
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	unchanged := filepath.Join(dir, "unchanged")
+	created := filepath.Join(dir, "created")
+	for _, p := range []string{existing, unchanged} {
+		if err := ioutil.WriteFile(p, []byte("a\nb\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := Record(true)
+	defer recorder.Stop()
+
+	if err := WriteFile(existing, []byte("a\nc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(unchanged, []byte("a\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(created, []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(created); err != nil || string(data) != "new\n" {
+		t.Errorf("planned content not read back: %q, %v", data, err)
+	}
+	if err := Run(exec.Command("sh", "-c", "touch "+filepath.Join(dir, "ran"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := Do(KindSysctl, "net.ipv4.ip_forward", "0 -> 1", true, func() error {
+		t.Error("dry-run made a change")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Stop()
+
+	if data, _ := ioutil.ReadFile(existing); string(data) != "a\nb\n" {
+		t.Errorf("dry-run wrote %s", existing)
+	}
+	for _, p := range []string{created, filepath.Join(dir, "ran")} {
+		if _, err := os.Stat(p); err == nil {
+			t.Errorf("dry-run created %s", p)
+		}
+	}
+
+	want := "--- " + existing + "\n+++ " + existing + "\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n" +
+		"--- /dev/null\n+++ " + created + "\n@@ -0,0 +1 @@\n+new\n" +
+		"command sh -c 'touch " + filepath.Join(dir, "ran") + "'\n" +
+		"sysctl net.ipv4.ip_forward 0 -> 1\n"
+	if diff := recorder.Diff(false, nil); diff != want {
+		t.Errorf("diff is\n%s\nwant\n%s", diff, want)
+	}
+	if paths := strings.Join(recorder.Paths(), ","); paths != created+","+existing {
+		t.Errorf("changed paths are %s", paths)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "file")
+
+	recorder := Record(false)
+	defer recorder.Stop()
+
+	if err := WriteFile(p, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(p); err != nil || string(data) != "one\n" {
+		t.Errorf("file not written: %q, %v", data, err)
+	}
+	if err := Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("file not removed")
+	}
+	// written and removed again, so nothing changed in the end
+	if recorder.Changed() {
+		t.Errorf("recorded a change: %s", recorder.Diff(false, nil))
+	}
+}
+
+func TestDiffRedact(t *testing.T) {
+	dir := t.TempDir()
+	shadow := filepath.Join(dir, "shadow")
+	config := filepath.Join(dir, "config.yaml")
+	public := filepath.Join(dir, "public")
+
+	recorder := Record(true)
+	defer recorder.Stop()
+
+	if err := WriteFile(shadow, []byte("root:$6$hash:1::::::\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(config, []byte("token: s3cret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(public, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(exec.Command("login", "--token", "s3cret")); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Stop()
+
+	want := "file " + shadow + " contents changed (redacted)\n" +
+		"file " + config + " contents changed (redacted)\n" +
+		"--- /dev/null\n+++ " + public + "\n@@ -0,0 +1 @@\n+hello\n" +
+		"command login --token <redacted>\n"
+	if diff := recorder.Diff(true, []string{"s3cret"}); diff != want {
+		t.Errorf("diff is\n%s\nwant\n%s", diff, want)
+	}
+	if diff := recorder.Diff(false, []string{"s3cret"}); !strings.Contains(diff, "+token: s3cret") {
+		t.Errorf("secrets should be shown without redact:\n%s", diff)
+	}
+}
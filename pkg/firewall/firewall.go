@@ -0,0 +1,422 @@
+// Package firewall renders the nftables ruleset of maculaos, the table inet
+// maculaos, from the config and the rules other parts of the system register
+// for themselves, and loads it in a single transaction.
+package firewall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/sysctl"
+	"github.com/macula-io/macula-os/pkg/system"
+)
+
+const (
+	// Table is the nftables table maculaos owns
+	Table = "inet maculaos"
+	// configOwner names the rules of the firewall section of the config
+	configOwner = "config"
+)
+
+var (
+	// RulesDir holds the rules registered by owners other than the config
+	RulesDir = system.LocalPath("firewall.d")
+	// RulesetFile is the ruleset as last loaded
+	RulesetFile = system.StatePath("firewall.nft")
+
+	validPort      = regexp.MustCompile(`^[0-9]{1,5}(-[0-9]{1,5})?$`)
+	validRate      = regexp.MustCompile(`^[0-9]+/(second|minute|hour|day)$`)
+	validInterface = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}\*?$`)
+	validOwner     = regexp.MustCompile(`^[a-z0-9-]+$`)
+)
+
+// Register sets the rules of owner, such as mesh or k3s, replacing the ones
+// it registered before. They take effect at the next Apply.
+func Register(owner string, rules []config.FirewallRule) error {
+	if !validOwner.MatchString(owner) || owner == configOwner {
+		return fmt.Errorf("invalid firewall rule owner %q", owner)
+	}
+	if len(rules) == 0 {
+		return Unregister(owner)
+	}
+	for _, r := range rules {
+		if err := validateRule(r, nil); err != nil {
+			return fmt.Errorf("%s: %v", owner, err)
+		}
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := effects.MkdirAll(RulesDir, 0755); err != nil {
+		return err
+	}
+	return effects.WriteFile(filepath.Join(RulesDir, owner+".json"), append(data, '\n'), 0644)
+}
+
+// Unregister removes the rules of owner
+func Unregister(owner string) error {
+	path := filepath.Join(RulesDir, owner+".json")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return effects.Remove(path)
+}
+
+// Owners returns the registered rules by owner
+func Owners() (map[string][]config.FirewallRule, error) {
+	owners := map[string][]config.FirewallRule{}
+	files, err := filepath.Glob(filepath.Join(RulesDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		data, err := effects.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var rules []config.FirewallRule
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		owners[strings.TrimSuffix(filepath.Base(f), ".json")] = rules
+	}
+	return owners, nil
+}
+
+// Reload applies the ruleset for the current config, for the commands that
+// change the registered rules outside of the appliers
+func Reload() error {
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+	return Apply(&cfg)
+}
+
+// Apply renders the ruleset and loads it, replacing the table as a whole so
+// that rules never pile up. Without a firewall section or registered rules
+// the table is removed.
+func Apply(cfg *config.CloudConfig) error {
+	owners, err := Owners()
+	if err != nil {
+		return err
+	}
+	if cfg.Firewall == nil && len(owners) == 0 {
+		if !loaded() {
+			return nil
+		}
+		if err := effects.Remove(RulesetFile); err != nil {
+			return err
+		}
+		return effects.Run(exec.Command("nft", "delete", "table", "inet", "maculaos"))
+	}
+
+	ruleset, err := Render(cfg.Firewall, owners)
+	if err != nil {
+		return err
+	}
+	if cfg.Firewall != nil {
+		if err := enableForwarding(cfg.Firewall.Forwards); err != nil {
+			return err
+		}
+	}
+
+	old, _ := effects.ReadFile(RulesetFile)
+	if bytes.Equal(old, ruleset) && loaded() {
+		return nil
+	}
+	if err := effects.MkdirAll(filepath.Dir(RulesetFile), 0755); err != nil {
+		return err
+	}
+	if err := effects.WriteFile(RulesetFile, ruleset, 0600); err != nil {
+		return err
+	}
+	out := &strings.Builder{}
+	cmd := exec.Command("nft", "-f", RulesetFile)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := effects.Run(cmd); err != nil {
+		// so that the next apply tries again
+		os.Remove(RulesetFile)
+		return fmt.Errorf("failed to load %s: %v: %s", RulesetFile, err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// enableForwarding turns on the forwarding of the address families that port
+// forwards send traffic to, without which they would not pass the node. It is
+// left on when the forwards are removed, as k3s needs it as well.
+func enableForwarding(forwards []config.PortForward) error {
+	keys := map[string]bool{}
+	for _, f := range forwards {
+		host, _, _ := net.SplitHostPort(f.To)
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			keys["net.ipv6.conf.all.forwarding"] = true
+		} else {
+			keys["net.ipv4.ip_forward"] = true
+		}
+	}
+	for _, key := range []string{"net.ipv4.ip_forward", "net.ipv6.conf.all.forwarding"} {
+		if !keys[key] {
+			continue
+		}
+		if err := sysctl.Set(key, "1"); err != nil {
+			return fmt.Errorf("enabling forwarding for the port forwards: sysctl %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// loaded reports whether the table of maculaos is in the kernel
+func loaded() bool {
+	return exec.Command("nft", "list", "table", "inet", "maculaos").Run() == nil
+}
+
+// Render returns the nftables ruleset for the firewall section of the config
+// and the rules registered by owners
+func Render(fw *config.Firewall, owners map[string][]config.FirewallRule) ([]byte, error) {
+	if fw == nil {
+		fw = &config.Firewall{}
+	}
+	policy := fw.DefaultPolicy
+	if policy == "" {
+		policy = "accept"
+	}
+	if policy != "accept" && policy != "drop" {
+		return nil, fmt.Errorf("invalid defaultPolicy %q", policy)
+	}
+
+	buf := &bytes.Buffer{}
+	// creating the table first lets it be deleted whether it exists or not,
+	// and nft -f runs the whole file as one transaction
+	fmt.Fprintf(buf, "table %s\ndelete table %s\n\ntable %s {\n", Table, Table, Table)
+	buf.WriteString("\tchain input {\n")
+	fmt.Fprintf(buf, "\t\ttype filter hook input priority filter; policy %s;\n", policy)
+	buf.WriteString("\t\tiif \"lo\" accept\n")
+	buf.WriteString("\t\tct state established,related accept\n")
+	buf.WriteString("\t\tct state invalid drop\n")
+	buf.WriteString("\t\tmeta l4proto { icmp, ipv6-icmp } accept\n")
+
+	var names []string
+	for name := range owners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for i, r := range owners[name] {
+			lines, err := renderRule(r, fw.Zones, name)
+			if err != nil {
+				return nil, fmt.Errorf("%s rule %d: %v", name, i, err)
+			}
+			buf.WriteString(lines)
+		}
+	}
+	for i, r := range fw.Rules {
+		lines, err := renderRule(r, fw.Zones, configOwner)
+		if err != nil {
+			return nil, fmt.Errorf("firewall.rules[%d]: %v", i, err)
+		}
+		buf.WriteString(lines)
+	}
+	buf.WriteString("\t}\n")
+
+	if len(fw.Forwards) > 0 {
+		var dnat, masquerade []string
+		for i, f := range fw.Forwards {
+			d, m, err := renderForward(f)
+			if err != nil {
+				return nil, fmt.Errorf("firewall.forwards[%d]: %v", i, err)
+			}
+			dnat, masquerade = append(dnat, d), append(masquerade, m)
+		}
+		buf.WriteString("\n\tchain prerouting {\n")
+		buf.WriteString("\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+		buf.WriteString(strings.Join(dnat, ""))
+		buf.WriteString("\t}\n")
+		// replies have to come back through this node to be translated. Only
+		// the forwards are masqueraded, the ones of kube-proxy keep the
+		// source address of their clients.
+		buf.WriteString("\n\tchain postrouting {\n")
+		buf.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+		buf.WriteString(strings.Join(masquerade, ""))
+		buf.WriteString("\t}\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+func validateRule(r config.FirewallRule, zones map[string][]string) error {
+	if r.Port != "" && !validPort.MatchString(r.Port) {
+		return fmt.Errorf("invalid port %q", r.Port)
+	}
+	if r.Protocol != "" && r.Protocol != "tcp" && r.Protocol != "udp" {
+		return fmt.Errorf("invalid protocol %q", r.Protocol)
+	}
+	if r.Interface != "" && !validInterface.MatchString(r.Interface) {
+		return fmt.Errorf("invalid interface %q", r.Interface)
+	}
+	if r.Interface != "" && r.Zone != "" {
+		return fmt.Errorf("a rule has either an interface or a zone")
+	}
+	if r.Zone != "" && zones != nil {
+		if _, ok := zones[r.Zone]; !ok {
+			return fmt.Errorf("unknown zone %q", r.Zone)
+		}
+	}
+	if r.Source != "" && parseSource(r.Source) == "" {
+		return fmt.Errorf("invalid source %q", r.Source)
+	}
+	if r.RateLimit != "" && !validRate.MatchString(r.RateLimit) {
+		return fmt.Errorf("invalid rateLimit %q, must be such as 10/minute", r.RateLimit)
+	}
+	switch r.Action {
+	case "", "accept", "drop", "reject":
+	default:
+		return fmt.Errorf("invalid action %q", r.Action)
+	}
+	return nil
+}
+
+// parseSource returns the nftables match for a source address or network
+func parseSource(source string) string {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(source); err != nil {
+			return ""
+		}
+	}
+	if ip.To4() != nil {
+		return "ip saddr " + source
+	}
+	return "ip6 saddr " + source
+}
+
+func renderRule(r config.FirewallRule, zones map[string][]string, owner string) (string, error) {
+	if zones == nil {
+		zones = map[string][]string{}
+	}
+	if err := validateRule(r, zones); err != nil {
+		return "", err
+	}
+
+	var match []string
+	interfaces := zones[r.Zone]
+	if r.Interface != "" {
+		interfaces = []string{r.Interface}
+	}
+	for _, iface := range interfaces {
+		if !validInterface.MatchString(iface) {
+			return "", fmt.Errorf("invalid interface %q in zone %s", iface, r.Zone)
+		}
+	}
+	if m := interfaceMatch(interfaces); m != "" {
+		match = append(match, m)
+	}
+	if r.Source != "" {
+		match = append(match, parseSource(r.Source))
+	}
+	protocol := r.Protocol
+	if protocol == "" && r.Port != "" {
+		protocol = "tcp"
+	}
+	if r.Port != "" {
+		match = append(match, protocol+" dport "+r.Port)
+	} else if protocol != "" {
+		match = append(match, "meta l4proto "+protocol)
+	}
+
+	action := r.Action
+	if action == "" {
+		action = "accept"
+	}
+	comment := "comment " + strconv.Quote(owner)
+	prefix := "\t\t" + strings.Join(match, " ")
+	if len(match) > 0 {
+		prefix += " "
+	}
+
+	lines := ""
+	if r.RateLimit != "" {
+		lines += prefix + "ct state new limit rate over " + r.RateLimit + " drop " + comment + "\n"
+	}
+	return lines + prefix + action + " " + comment + "\n", nil
+}
+
+func interfaceMatch(interfaces []string) string {
+	var quoted []string
+	for _, iface := range interfaces {
+		quoted = append(quoted, strconv.Quote(iface))
+	}
+	switch len(quoted) {
+	case 0:
+		return ""
+	case 1:
+		return "iifname " + quoted[0]
+	}
+	return "iifname { " + strings.Join(quoted, ", ") + " }"
+}
+
+// renderForward returns the rule that translates the destination of a
+// forward and the one that masquerades the traffic translated
+func renderForward(f config.PortForward) (string, string, error) {
+	if !validPort.MatchString(f.Port) || strings.Contains(f.Port, "-") {
+		return "", "", fmt.Errorf("invalid port %q", f.Port)
+	}
+	protocol := f.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return "", "", fmt.Errorf("invalid protocol %q", f.Protocol)
+	}
+	host, port, err := net.SplitHostPort(f.To)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil || !validPort.MatchString(port) || strings.Contains(port, "-") {
+		return "", "", fmt.Errorf("invalid to %q, must be address:port", f.To)
+	}
+
+	var match []string
+	if f.Interface != "" {
+		if !validInterface.MatchString(f.Interface) {
+			return "", "", fmt.Errorf("invalid interface %q", f.Interface)
+		}
+		match = append(match, interfaceMatch([]string{f.Interface}))
+	}
+	family, to := "ip", ip.String()+":"+port
+	if ip.To4() == nil {
+		family, to = "ip6", "["+ip.String()+"]:"+port
+	}
+	match = append(match, family+" daddr != "+ip.String(), protocol+" dport "+f.Port)
+	dnat := fmt.Sprintf("\t\t%s dnat %s to %s comment %q\n", strings.Join(match, " "), family, to, configOwner)
+	masquerade := fmt.Sprintf("\t\tct status dnat %s daddr %s %s dport %s masquerade comment %q\n", family, ip, protocol, port, configOwner)
+	return dnat, masquerade, nil
+}
+
+// Status returns the table of maculaos as loaded in the kernel, in JSON if
+// asked to
+func Status(jsonOutput bool) ([]byte, error) {
+	args := []string{"list", "table", "inet", "maculaos"}
+	if jsonOutput {
+		args = append([]string{"-j"}, args...)
+	}
+	out, err := exec.Command("nft", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("nft %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
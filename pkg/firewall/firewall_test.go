@@ -0,0 +1,111 @@
+package firewall
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+)
+
+func TestRender(t *testing.T) {
+	defer func(dir string) { RulesDir = dir }(RulesDir)
+	RulesDir = filepath.Join(t.TempDir(), "firewall.d")
+
+	if err := Register("k3s", []config.FirewallRule{{Port: "6443"}, {Interface: "cni0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register("mesh", []config.FirewallRule{{Port: "443", Protocol: "udp"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register("mesh", nil); err != nil {
+		t.Fatal(err)
+	}
+	owners, err := Owners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 1 || len(owners["k3s"]) != 2 {
+		t.Fatalf("unexpected owners: %+v", owners)
+	}
+
+	fw := &config.Firewall{
+		DefaultPolicy: "drop",
+		Zones:         map[string][]string{"lan": {"eth0", "wlan0"}},
+		Rules: []config.FirewallRule{
+			{Port: "22", Zone: "lan", RateLimit: "10/minute"},
+			{Port: "53", Protocol: "udp", Source: "fd00::/8"},
+			{Source: "10.0.0.1", Action: "reject"},
+		},
+		Forwards: []config.PortForward{{Port: "8080", Interface: "eth0", To: "192.168.1.10:80"}},
+	}
+	ruleset, err := Render(fw, owners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"table inet maculaos\ndelete table inet maculaos\n",
+		"type filter hook input priority filter; policy drop;",
+		`tcp dport 6443 accept comment "k3s"`,
+		`iifname "cni0" accept comment "k3s"`,
+		`iifname { "eth0", "wlan0" } tcp dport 22 ct state new limit rate over 10/minute drop comment "config"`,
+		`iifname { "eth0", "wlan0" } tcp dport 22 accept comment "config"`,
+		`ip6 saddr fd00::/8 udp dport 53 accept comment "config"`,
+		`ip saddr 10.0.0.1 reject comment "config"`,
+		`iifname "eth0" ip daddr != 192.168.1.10 tcp dport 8080 dnat ip to 192.168.1.10:80 comment "config"`,
+		`ct status dnat ip daddr 192.168.1.10 tcp dport 80 masquerade comment "config"`,
+	} {
+		if !strings.Contains(string(ruleset), line) {
+			t.Errorf("ruleset misses %q:\n%s", line, ruleset)
+		}
+	}
+	// the rules of other owners come before the config
+	if strings.Index(string(ruleset), `"k3s"`) > strings.Index(string(ruleset), `"config"`) {
+		t.Errorf("k3s rules should come first:\n%s", ruleset)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, fw := range []config.Firewall{
+		{DefaultPolicy: "reject"},
+		{Rules: []config.FirewallRule{{Port: "ssh"}}},
+		{Rules: []config.FirewallRule{{Port: "22", Zone: "dmz"}}},
+		{Rules: []config.FirewallRule{{Source: "10.0.0.0/33"}}},
+		{Rules: []config.FirewallRule{{Port: "22", RateLimit: "10"}}},
+		{Rules: []config.FirewallRule{{Interface: "eth0", Zone: "lan"}}},
+		{Forwards: []config.PortForward{{Port: "80", To: "192.168.1.10"}}},
+	} {
+		if _, err := Render(&fw, nil); err == nil {
+			t.Errorf("expected an error for %+v", fw)
+		}
+	}
+	if err := Register("config", []config.FirewallRule{{Port: "22"}}); err == nil {
+		t.Error("the config owner should be reserved")
+	}
+}
+
+func TestEnableForwarding(t *testing.T) {
+	for _, key := range []string{"ipv4/ip_forward", "ipv6/conf/all/forwarding"} {
+		if _, err := os.Stat("/proc/sys/net/" + key); err != nil {
+			t.Skipf("no /proc/sys/net/%s", key)
+		}
+	}
+	recorder := effects.Record(true)
+	defer recorder.Stop()
+
+	forwards := []config.PortForward{{Port: "8080", To: "192.168.1.10:80"}, {Port: "8443", To: "[fd00::10]:443"}}
+	if err := enableForwarding(forwards); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range recorder.Effects {
+		if e.Kind == effects.KindSysctl {
+			keys = append(keys, e.Target)
+		}
+	}
+	if strings.Join(keys, ",") != "net.ipv4.ip_forward,net.ipv6.conf.all.forwarding" {
+		t.Errorf("unexpected sysctls %v", keys)
+	}
+}
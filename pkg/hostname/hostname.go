@@ -2,12 +2,12 @@ package hostname
 
 import (
 	"bufio"
-	"io/ioutil"
 	"os"
 	"strings"
 	"syscall"
 
 	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
 )
 
 func SetHostname(c *config.CloudConfig) error {
@@ -15,22 +15,18 @@ func SetHostname(c *config.CloudConfig) error {
 	if hostname == "" {
 		return nil
 	}
-	if err := syscall.Sethostname([]byte(hostname)); err != nil {
-		return err
-	}
-	return syncHostname()
-}
-
-func syncHostname() error {
-	hostname, err := os.Hostname()
+	current, _ := os.Hostname()
+	err := effects.Do(effects.KindSystem, "hostname", "-> "+hostname, current != hostname, func() error {
+		return syscall.Sethostname([]byte(hostname))
+	})
 	if err != nil {
 		return err
 	}
-	if hostname == "" {
-		return nil
-	}
+	return syncHostname(hostname)
+}
 
-	if err := ioutil.WriteFile("/etc/hostname", []byte(hostname+"\n"), 0644); err != nil {
+func syncHostname(hostname string) error {
+	if err := effects.WriteFile("/etc/hostname", []byte(hostname+"\n"), 0644); err != nil {
 		return err
 	}
 
@@ -50,5 +46,5 @@ func syncHostname() error {
 		}
 		content += line + "\n"
 	}
-	return ioutil.WriteFile("/etc/hosts", []byte(content), 0600)
+	return effects.WriteFile("/etc/hosts", []byte(content), 0600)
 }
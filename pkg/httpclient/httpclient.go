@@ -0,0 +1,164 @@
+// Package httpclient provides the HTTP client maculaos makes its outbound
+// requests with, which goes through the proxy of the config.
+package httpclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/macula-io/macula-os/pkg/system"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ProxyFile holds the proxy settings as HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY lines. It lives outside the config so that fetching config
+	// includes honours it, and before the config is read at boot.
+	ProxyFile = system.LocalPath("proxy.env")
+	// CAFile holds the CA of the proxy, which the client trusts beyond the
+	// system ones
+	CAFile = system.LocalPath("proxy-ca.pem")
+	// TrustFile holds the caCerts of the config, which the client trusts
+	// even before the system bundle is updated with them at boot
+	TrustFile = system.LocalPath("ca-certs.pem")
+
+	mu        sync.Mutex
+	transport http.RoundTripper
+	loadedKey string
+)
+
+// Client returns a client for outbound requests. Callers may set a timeout on
+// it; the transport and its connections are shared.
+func Client() *http.Client {
+	return &http.Client{Transport: Transport()}
+}
+
+// Get issues a GET with the shared client
+func Get(url string) (*http.Response, error) {
+	return Client().Get(url)
+}
+
+// Post issues a POST with the shared client
+func Post(url, contentType string, body io.Reader) (*http.Response, error) {
+	return Client().Post(url, contentType, body)
+}
+
+// Transport returns the shared transport, rebuilt when the proxy settings
+// or the trusted CAs changed since it was last built
+func Transport() http.RoundTripper {
+	env, _ := ioutil.ReadFile(ProxyFile)
+	ca, _ := ioutil.ReadFile(CAFile)
+	trust, _ := ioutil.ReadFile(TrustFile)
+
+	mu.Lock()
+	defer mu.Unlock()
+	key := string(env) + "\x00" + string(ca) + "\x00" + string(trust)
+	if transport != nil && key == loadedKey {
+		return transport
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = ProxyFunc(ParseEnv(env))
+	if len(ca) > 0 || len(trust) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for file, pem := range map[string][]byte{CAFile: ca, TrustFile: trust} {
+			if len(pem) > 0 && !pool.AppendCertsFromPEM(pem) {
+				logrus.Warnf("no certificates found in %s", file)
+			}
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	transport, loadedKey = t, key
+	return transport
+}
+
+// ParseEnv reads KEY=value lines, with the value optionally quoted
+func ParseEnv(data []byte) map[string]string {
+	env := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		val := parts[1]
+		if unquoted, err := strconv.Unquote(val); err == nil {
+			val = unquoted
+		}
+		env[strings.TrimSpace(parts[0])] = val
+	}
+	return env
+}
+
+// ProxyFunc returns the proxy for a request following HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY in env. Loopback addresses are always reached
+// directly.
+func ProxyFunc(env map[string]string) func(*http.Request) (*url.URL, error) {
+	noProxy := strings.Split(env["NO_PROXY"], ",")
+	return func(req *http.Request) (*url.URL, error) {
+		proxy := env["HTTP_PROXY"]
+		if req.URL.Scheme == "https" {
+			proxy = env["HTTPS_PROXY"]
+		}
+		if proxy == "" || Bypass(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		if !strings.Contains(proxy, "://") {
+			proxy = "http://" + proxy
+		}
+		return url.Parse(proxy)
+	}
+}
+
+// Bypass reports whether host is to be reached without the proxy. Entries of
+// noProxy are *, addresses, networks and domains, which match their
+// subdomains as well.
+func Bypass(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+		case entry == "*":
+			return true
+		case strings.Contains(entry, "/"):
+			if _, network, err := net.ParseCIDR(entry); err == nil && ip != nil && network.Contains(ip) {
+				return true
+			}
+		case net.ParseIP(entry) != nil:
+			if ip != nil && ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+		default:
+			domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package httpclient
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProxyFunc(t *testing.T) {
+	env := ParseEnv([]byte(`HTTP_PROXY="proxy.corp:3128"
+HTTPS_PROXY="https://secure.corp:3129"
+NO_PROXY="corp.example,10.0.0.0/8,192.168.1.1"
+`))
+	proxy := ProxyFunc(env)
+	for rawurl, want := range map[string]string{
+		"http://boot.macula.io/x":    "http://proxy.corp:3128",
+		"https://boot.macula.io/x":   "https://secure.corp:3129",
+		"https://git.corp.example/x": "",
+		"https://corp.example/x":     "",
+		"http://10.1.2.3/x":          "",
+		"http://192.168.1.1:8080/x":  "",
+		"http://localhost:6443/x":    "",
+		"http://[::1]/x":             "",
+		"http://notcorp.example/x":   "http://proxy.corp:3128",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, rawurl, nil)
+		u, err := proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != want {
+			t.Errorf("%s: got proxy %q, want %q", rawurl, got, want)
+		}
+	}
+}
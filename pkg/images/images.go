@@ -0,0 +1,472 @@
+// Package images puts archives of container images into the images
+// directory of the k3s agent, which k3s imports when it starts, so that
+// air-gapped nodes can run workloads without a registry.
+package images
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/registry"
+	"github.com/macula-io/macula-os/pkg/util"
+)
+
+// SumsFile lists the digests of the archives of a directory, in the format
+// of sha256sum
+const SumsFile = "SHA256SUMS"
+
+var (
+	// Dir is where k3s imports images from when it starts
+	Dir = "/var/lib/rancher/k3s/agent/images"
+	// sumsState holds the size, modification time and digest of the sources
+	// of the archives in Dir. It is kept outside of Dir, which k3s imports
+	// every file of.
+	sumsState = "/var/lib/maculaos/images.json"
+
+	extensions = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tar.zst", ".tar.lz4"}
+)
+
+// Archive is an archive of images in Dir
+type Archive struct {
+	Name     string   `json:"name"`
+	Source   string   `json:"source,omitempty"`
+	SHA256   string   `json:"sha256,omitempty"`
+	Verified bool     `json:"verified"` // the source matched the digest it was pinned with
+	Changed  bool     `json:"changed"`  // copied by this import, rather than up to date
+	Images   []string `json:"images,omitempty"`
+}
+
+// ApplyImages imports the archives of the images section of the config
+func ApplyImages(cfg *config.CloudConfig) error {
+	var errors []string
+	for _, image := range cfg.Images {
+		if _, err := Import(image.Path, image.SHA256); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// Import copies an archive, the archives of a directory, or the ones in the
+// MediaDir of an ISO image, to Dir, with archives compressed with gzip
+// decompressed. An archive is checked against digest, or against the
+// SHA256SUMS of its directory, which then has to list every archive. Archives
+// that are up to date are left as they are.
+func Import(source, digest string) ([]Archive, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() && strings.HasSuffix(source, ".iso") {
+		if digest != "" {
+			return nil, fmt.Errorf("%s: sha256 only applies to an archive, an ISO can hold a %s file", source, SumsFile)
+		}
+		dir, release, err := mountISO(source)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return Import(dir, "")
+	}
+
+	files := []string{source}
+	sums := map[string]string{}
+	if info.IsDir() {
+		if digest != "" {
+			return nil, fmt.Errorf("%s: sha256 only applies to an archive, a directory can hold a %s file", source, SumsFile)
+		}
+		entries, err := ioutil.ReadDir(source)
+		if err != nil {
+			return nil, err
+		}
+		files = nil
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && supported(entry.Name()) {
+				files = append(files, filepath.Join(source, entry.Name()))
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s: no image archives", source)
+		}
+		if sums, err = readSums(filepath.Join(source, SumsFile)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else if !supported(source) {
+		return nil, fmt.Errorf("%s: not an image archive, expected one of %s or .iso", source, strings.Join(extensions, ", "))
+	}
+
+	if err := effects.MkdirAll(Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var result []Archive
+	var errors []string
+	for _, file := range files {
+		d := digest
+		if d == "" {
+			d = sums[filepath.Base(file)]
+			if len(sums) > 0 && d == "" {
+				errors = append(errors, fmt.Sprintf("%s: not listed in %s", file, SumsFile))
+				continue
+			}
+		}
+		archive, err := importArchive(file, d)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", file, err))
+			continue
+		}
+		result = append(result, archive)
+	}
+	if len(errors) > 0 {
+		return result, fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return result, nil
+}
+
+func importArchive(src, digest string) (Archive, error) {
+	name := filepath.Base(src)
+	decompress := strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz")
+	if decompress {
+		name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".tgz")
+		if !strings.HasSuffix(name, ".tar") {
+			name += ".tar"
+		}
+	}
+	dest := filepath.Join(Dir, name)
+	archive := Archive{Name: name, Source: src}
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return archive, err
+	}
+	// the modification time of the source is kept, and its size,
+	// modification time and digest are recorded, so that an archive that was
+	// imported before is neither copied nor hashed again on every boot. A
+	// decompressed one can only be compared by the digest of its source.
+	if destInfo, err := os.Stat(dest); err == nil && destInfo.ModTime().Equal(srcInfo.ModTime()) {
+		sum := ""
+		if source, ok := importedSources()[name]; ok && source.Size == srcInfo.Size() && source.ModTime.Equal(srcInfo.ModTime()) {
+			sum = source.SHA256
+		}
+		if sum != "" || (!decompress && destInfo.Size() == srcInfo.Size()) {
+			if digest != "" {
+				if sum == "" {
+					if sum, err = hashFile(src); err != nil {
+						return archive, err
+					}
+				}
+				if err := verify(sum, digest); err != nil {
+					return archive, err
+				}
+				archive.SHA256, archive.Verified = sum, true
+			}
+			archive.Images, err = imageNames(dest, name)
+			return archive, err
+		}
+	}
+
+	detail := "copy from " + src
+	if decompress {
+		detail = "decompress " + src
+	}
+	archive.Changed = true
+	err = effects.Do(effects.KindSystem, dest, detail, true, func() error {
+		tmp := dest + ".tmp"
+		sum, err := copyArchive(src, tmp, decompress)
+		if err == nil && digest != "" {
+			err = verify(sum, digest)
+		}
+		if err == nil {
+			archive.SHA256, archive.Verified = sum, digest != ""
+			archive.Images, err = imageNames(tmp, name)
+		}
+		if err == nil {
+			err = os.Chtimes(tmp, srcInfo.ModTime(), srcInfo.ModTime())
+		}
+		if err == nil {
+			err = os.Rename(tmp, dest)
+		}
+		if err == nil {
+			err = recordSource(name, sum, srcInfo)
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+		return err
+	})
+	return archive, err
+}
+
+// source is what is recorded of the source of an archive in Dir
+type source struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// importedSources returns the sources of the archives imported into Dir, by
+// the name of the archive
+func importedSources() map[string]source {
+	sources := map[string]source{}
+	if data, err := ioutil.ReadFile(sumsState); err == nil {
+		json.Unmarshal(data, &sources)
+	}
+	return sources
+}
+
+func recordSource(name, sum string, info os.FileInfo) error {
+	sources := importedSources()
+	sources[name] = source{Size: info.Size(), ModTime: info.ModTime(), SHA256: sum}
+	data, err := json.Marshal(sources)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(sumsState), 0755); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(sumsState, data, 0644)
+}
+
+// hashFile returns the sha256 digest of a file
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verify checks the sha256 digest of an archive against the one it is pinned
+// with
+func verify(sum, digest string) error {
+	if !strings.EqualFold(strings.TrimPrefix(digest, "sha256:"), sum) {
+		return fmt.Errorf("sha256 digest %s does not match %s", sum, digest)
+	}
+	return nil
+}
+
+// copyArchive copies src to dest, decompressing it, and returns the sha256
+// digest of src
+func copyArchive(src, dest string, decompress bool) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	hash := sha256.New()
+	tee := io.TeeReader(bufio.NewReader(in), hash)
+	reader := tee
+	if decompress {
+		gz, err := gzip.NewReader(tee)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return "", err
+	}
+	// the digest covers all of src, including what follows the gzip stream
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// List returns the archives in Dir with the images they hold
+func List() ([]Archive, error) {
+	entries, err := ioutil.ReadDir(Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var result []Archive
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !supported(entry.Name()) {
+			continue
+		}
+		archive := Archive{Name: entry.Name()}
+		archive.Images, _ = imageNames(filepath.Join(Dir, entry.Name()), entry.Name())
+		result = append(result, archive)
+	}
+	return result, nil
+}
+
+// Loaded returns the images containerd holds, by full reference such as
+// docker.io/library/nginx:1.27. It fails unless k3s is running.
+func Loaded() (map[string]bool, error) {
+	out, err := exec.Command("k3s", "ctr", "-n", "k8s.io", "images", "ls", "-q").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing the images of containerd: %v", err)
+	}
+	result := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result[Normalize(line)] = true
+		}
+	}
+	return result, nil
+}
+
+// Load imports an archive of Dir into a running containerd, which k3s would
+// otherwise only do when it starts again
+func Load(archive Archive) error {
+	cmd := exec.Command("k3s", "ctr", "-n", "k8s.io", "images", "import", filepath.Join(Dir, archive.Name))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("importing %s: %v: %s", archive.Name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Normalize returns the full reference of an image, as containerd lists it
+func Normalize(ref string) string {
+	image, err := registry.ParseImage(ref)
+	if err != nil {
+		return ref
+	}
+	return image.String()
+}
+
+// imageNames returns the images in the archive at path, which is named name,
+// from the manifest.json of docker save or the index.json of an OCI layout.
+// Archives compressed with zstd or lz4 are not read.
+func imageNames(path, name string) ([]string, error) {
+	if strings.HasSuffix(name, ".zst") || strings.HasSuffix(name, ".lz4") {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var reader io.Reader = bufio.NewReader(f)
+	switch {
+	case strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz"):
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	case strings.HasSuffix(name, ".bz2"):
+		reader = bzip2.NewReader(reader)
+	}
+
+	found := false
+	names := map[string]bool{}
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("not an image archive: %v", err)
+		}
+		switch strings.TrimPrefix(header.Name, "./") {
+		case "manifest.json":
+			var manifest []struct {
+				RepoTags []string
+			}
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, fmt.Errorf("manifest.json: %v", err)
+			}
+			found = true
+			for _, m := range manifest {
+				for _, tag := range m.RepoTags {
+					names[Normalize(tag)] = true
+				}
+			}
+		case "index.json":
+			var index struct {
+				Manifests []struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"manifests"`
+			}
+			if err := json.NewDecoder(tr).Decode(&index); err != nil {
+				return nil, fmt.Errorf("index.json: %v", err)
+			}
+			found = true
+			for _, m := range index.Manifests {
+				if ref := m.Annotations["io.containerd.image.name"]; ref != "" {
+					names[Normalize(ref)] = true
+				}
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("not an image archive, it has no manifest.json or index.json")
+	}
+
+	var result []string
+	for n := range names {
+		result = append(result, n)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// readSums reads a file in the format of sha256sum
+func readSums(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sums := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		sums[filepath.Base(strings.TrimPrefix(fields[1], "*"))] = fields[0]
+	}
+	return sums, nil
+}
+
+func supported(name string) bool {
+	for _, ext := range extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// imageArchive returns an archive in the format of docker save with a
+// manifest.json tagging the images
+func imageArchive(t *testing.T, tags ...string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	manifest := fmt.Sprintf(`[{"Config":"config.json","RepoTags":["%s"],"Layers":[]}]`, strings.Join(tags, `","`))
+	for name, content := range map[string]string{"config.json": "{}", "manifest.json": manifest} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestImport(t *testing.T) {
+	defer func(dir, state string) { Dir, sumsState = dir, state }(Dir, sumsState)
+	Dir = filepath.Join(t.TempDir(), "images")
+	sumsState = filepath.Join(t.TempDir(), "images.json")
+	usb := t.TempDir()
+
+	console := imageArchive(t, "maculacid/macula-console:latest")
+	coredns := imageArchive(t, "coredns/coredns:1.10.1", "ghcr.io/org/dns:v1")
+	gz := &bytes.Buffer{}
+	w := gzip.NewWriter(gz)
+	w.Write(coredns)
+	w.Close()
+
+	files := map[string][]byte{
+		"console.tar":    console,
+		"coredns.tar.gz": gz.Bytes(),
+		"README.txt":     []byte("not an archive"),
+	}
+	files[SumsFile] = []byte(digest(console) + "  console.tar\n" + digest(gz.Bytes()) + " *coredns.tar.gz\n")
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(usb, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archives, err := Import(usb, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 2 || !archives[0].Changed || !archives[0].Verified || archives[1].Name != "coredns.tar" {
+		t.Fatalf("unexpected archives %+v", archives)
+	}
+	want := []string{"docker.io/coredns/coredns:1.10.1", "ghcr.io/org/dns:v1"}
+	if !reflect.DeepEqual(archives[1].Images, want) {
+		t.Errorf("expected %v, got %v", want, archives[1].Images)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(Dir, "coredns.tar")); err != nil || !bytes.Equal(data, coredns) {
+		t.Errorf("coredns.tar.gz should be decompressed, got %v", err)
+	}
+
+	archives, err = Import(usb, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range archives {
+		if a.Changed || !a.Verified {
+			t.Errorf("%s should be up to date and verified", a.Name)
+		}
+	}
+	if _, err := Import(filepath.Join(usb, "console.tar"), digest([]byte("other"))); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected an up to date archive to be verified, got %v", err)
+	}
+
+	// an archive of the same size and modification time is not hashed again
+	info, err := os.Stat(filepath.Join(usb, "console.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(usb, "console.tar"), make([]byte, len(console)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(usb, "console.tar"), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	archives, err = Import(filepath.Join(usb, "console.tar"), digest(console))
+	if err != nil || archives[0].Changed || !archives[0].Verified {
+		t.Errorf("expected the recorded digest to be used, got %+v, %v", archives, err)
+	}
+
+	// a different archive copied with its modification time is imported again
+	info, err = os.Stat(filepath.Join(usb, "coredns.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz.Reset()
+	w = gzip.NewWriter(gz)
+	w.Write(imageArchive(t, "coredns/coredns:1.11.3-with-a-longer-tag"))
+	w.Close()
+	if err := ioutil.WriteFile(filepath.Join(usb, "coredns.tar.gz"), gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(usb, "coredns.tar.gz"), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	archives, err = Import(filepath.Join(usb, "coredns.tar.gz"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !archives[0].Changed || archives[0].Verified {
+		t.Errorf("coredns.tar.gz should be imported again and not verified, got %+v", archives[0])
+	}
+
+	list, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || !reflect.DeepEqual(list[0].Images, []string{"docker.io/maculacid/macula-console:latest"}) {
+		t.Errorf("unexpected list %+v", list)
+	}
+}
+
+func TestImportVerify(t *testing.T) {
+	defer func(dir, state string) { Dir, sumsState = dir, state }(Dir, sumsState)
+	Dir = filepath.Join(t.TempDir(), "images")
+	sumsState = filepath.Join(t.TempDir(), "images.json")
+	src := filepath.Join(t.TempDir(), "console.tar")
+	if err := ioutil.WriteFile(src, imageArchive(t, "maculacid/macula-console:latest"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Import(src, digest([]byte("other")))
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(Dir); len(entries) != 0 {
+		t.Errorf("nothing should be left in the images directory, got %d files", len(entries))
+	}
+
+	notImage := filepath.Join(filepath.Dir(src), "files.tar")
+	if err := ioutil.WriteFile(notImage, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(notImage, ""); err == nil || !strings.Contains(err.Error(), "not an image archive") {
+		t.Errorf("expected an archive without a manifest to be refused, got %v", err)
+	}
+
+	iso := filepath.Join(filepath.Dir(src), "images.iso")
+	if err := ioutil.WriteFile(iso, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(iso, digest(nil)); err == nil || !strings.Contains(err.Error(), "an ISO can hold a "+SumsFile) {
+		t.Errorf("expected sha256 to be refused for an ISO, got %v", err)
+	}
+	os.Remove(iso)
+
+	dir := filepath.Dir(src)
+	if err := ioutil.WriteFile(filepath.Join(dir, SumsFile), []byte(digest(nil)+"  files.tar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(notImage)
+	if _, err := Import(dir, ""); err == nil || !strings.Contains(err.Error(), "console.tar: not listed in "+SumsFile) {
+		t.Errorf("expected an archive missing from %s to be refused, got %v", SumsFile, err)
+	}
+}
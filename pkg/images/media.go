@@ -0,0 +1,138 @@
+package images
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MediaDir is the directory of a USB stick, CD or ISO that images are
+// imported from
+const MediaDir = "maculaos-images"
+
+var (
+	sysBlock   = "/sys/block"
+	procMounts = "/proc/mounts"
+	mediaMount = "/run/maculaos/media"
+)
+
+// Media returns the MediaDir of every USB stick, CD and ISO attached. Media
+// that are not mounted are mounted read-only until release is called.
+func Media() (dirs []string, release func(), err error) {
+	mounted := mountPoints()
+	var ours []string
+	release = func() {
+		for _, path := range ours {
+			if out, err := exec.Command("umount", path).CombinedOutput(); err != nil {
+				logrus.Warnf("failed to unmount %s: %v: %s", path, err, strings.TrimSpace(string(out)))
+			}
+			os.Remove(path)
+		}
+	}
+
+	for _, device := range removableDevices() {
+		path, ok := mounted["/dev/"+device]
+		if !ok {
+			path = filepath.Join(mediaMount, device)
+			if err := os.MkdirAll(path, 0755); err != nil {
+				release()
+				return nil, nil, err
+			}
+			if err := exec.Command("mount", "-o", "ro", "/dev/"+device, path).Run(); err != nil {
+				logrus.Debugf("cannot mount /dev/%s: %v", device, err)
+				os.Remove(path)
+				continue
+			}
+			ours = append(ours, path)
+		}
+		if info, err := os.Stat(filepath.Join(path, MediaDir)); err == nil && info.IsDir() {
+			dirs = append(dirs, filepath.Join(path, MediaDir))
+		}
+	}
+	if len(dirs) == 0 {
+		release()
+		return nil, nil, fmt.Errorf("no USB stick or CD with a %s directory found", MediaDir)
+	}
+	return dirs, release, nil
+}
+
+// mountISO mounts an ISO image read-only and returns its MediaDir, which is
+// there until release is called
+func mountISO(iso string) (dir string, release func(), err error) {
+	path := filepath.Join(mediaMount, filepath.Base(iso))
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", nil, err
+	}
+	if out, err := exec.Command("mount", "-o", "loop,ro", iso, path).CombinedOutput(); err != nil {
+		os.Remove(path)
+		return "", nil, fmt.Errorf("mounting %s: %v: %s", iso, err, strings.TrimSpace(string(out)))
+	}
+	release = func() {
+		if out, err := exec.Command("umount", path).CombinedOutput(); err != nil {
+			logrus.Warnf("failed to unmount %s: %v: %s", path, err, strings.TrimSpace(string(out)))
+		}
+		os.Remove(path)
+	}
+
+	dir = filepath.Join(path, MediaDir)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		release()
+		return "", nil, fmt.Errorf("%s has no %s directory", iso, MediaDir)
+	}
+	return dir, release, nil
+}
+
+// removableDevices returns the partitions, or the whole device if it has
+// none, of the disks on USB and the CD drives
+func removableDevices() []string {
+	entries, err := ioutil.ReadDir(sysBlock)
+	if err != nil {
+		return nil
+	}
+
+	var result []string
+	for _, entry := range entries {
+		disk := entry.Name()
+		removable, _ := ioutil.ReadFile(filepath.Join(sysBlock, disk, "removable"))
+		link, _ := os.Readlink(filepath.Join(sysBlock, disk))
+		if strings.TrimSpace(string(removable)) != "1" && !strings.Contains(link, "/usb") && !strings.HasPrefix(disk, "sr") {
+			continue
+		}
+
+		var partitions []string
+		parts, _ := ioutil.ReadDir(filepath.Join(sysBlock, disk))
+		for _, part := range parts {
+			if strings.HasPrefix(part.Name(), disk) {
+				partitions = append(partitions, part.Name())
+			}
+		}
+		if len(partitions) == 0 {
+			partitions = []string{disk}
+		}
+		result = append(result, partitions...)
+	}
+	return result
+}
+
+// mountPoints returns where devices are mounted
+func mountPoints() map[string]string {
+	result := map[string]string{}
+	data, err := ioutil.ReadFile(procMounts)
+	if err != nil {
+		return result
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "/dev/") {
+			if _, ok := result[fields[0]]; !ok {
+				result[fields[0]] = fields[1]
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,346 @@
+// Package k3s renders the k3s section of the config, along with the server,
+// token, labels and taints under maculaos, to the config.yaml of k3s, and
+// installs the k3s service for the role of the node.
+package k3s
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/firewall"
+	"github.com/macula-io/macula-os/pkg/mode"
+	"github.com/macula-io/macula-os/pkg/proxy"
+	"github.com/macula-io/macula-os/pkg/services"
+	"github.com/macula-io/macula-os/pkg/version"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// header marks the files written from the config, so that others in
+	// config.yaml.d are left alone
+	header = "# Written by maculaos from the config\n"
+)
+
+var (
+	// ConfigFile is where k3s reads its settings from when it starts
+	ConfigFile = "/etc/rancher/k3s/config.yaml"
+	// ArgsFile holds maculaos.k3sArgs. k3s reads it after ConfigFile, so
+	// that they win as they did on the command line.
+	ArgsFile = "/etc/rancher/k3s/config.yaml.d/50-maculaos-k3s-args.yaml"
+
+	serviceFile   = "/etc/init.d/" + services.K3s
+	installScript = "/usr/libexec/macula/k3s-install.sh"
+
+	// listFlags are the flags of k3s that can be given more than once
+	listFlags = map[string]bool{
+		"disable":                           true,
+		"tls-san":                           true,
+		"node-label":                        true,
+		"node-taint":                        true,
+		"kubelet-arg":                       true,
+		"kube-apiserver-arg":                true,
+		"kube-controller-manager-arg":       true,
+		"kube-scheduler-arg":                true,
+		"kube-proxy-arg":                    true,
+		"kube-cloud-controller-manager-arg": true,
+		"etcd-arg":                          true,
+		"node-ip":                           true,
+		"node-external-ip":                  true,
+	}
+	serverOnly = []string{"cluster-init", "datastore-endpoint", "disable", "flannel-backend", "tls-san"}
+)
+
+// ApplyK3S writes the config of k3s and installs its service if it is not
+// installed for the role of the node. With restart, a running k3s is
+// restarted when its config changed. With install, k3s is downloaded if the
+// image does not ship it.
+func ApplyK3S(cfg *config.CloudConfig, restart, install bool) error {
+	mode, err := mode.Get()
+	if err != nil {
+		return err
+	}
+	if mode == "install" {
+		return nil
+	}
+
+	k3sExists := false
+	k3sLocalExists := false
+	if _, err := os.Stat("/sbin/k3s"); err == nil {
+		k3sExists = true
+	}
+	if _, err := os.Stat("/usr/local/bin/k3s"); err == nil {
+		k3sLocalExists = true
+	}
+	if !k3sExists && !restart {
+		return nil
+	}
+	if !k3sExists && !k3sLocalExists && !install {
+		return nil
+	}
+
+	_, argValues, err := parseArgs(cfg.Maculaos.K3sArgs)
+	if err != nil {
+		return err
+	}
+	role := Role(cfg)
+
+	content, err := Render(cfg, role, mode)
+	if err != nil {
+		return err
+	}
+	changed, err := write(ConfigFile, content, true)
+	if err != nil {
+		return err
+	}
+	var args []byte
+	if len(argValues) > 0 {
+		if args, err = marshal(argValues); err != nil {
+			return err
+		}
+	}
+	argsChanged, err := write(ArgsFile, args, false)
+	if err != nil {
+		return err
+	}
+
+	if err := firewall.Register("k3s", firewallRules(role == "server")); err != nil {
+		return err
+	}
+	if err := firewall.Apply(cfg); err != nil {
+		return err
+	}
+
+	if !installed(role) {
+		return runInstall(cfg, role, k3sExists, k3sLocalExists, restart)
+	}
+	if (changed || argsChanged) && restart {
+		return services.RestartIfRunning(services.K3s, "the new config")
+	}
+	return nil
+}
+
+// Role returns the role of the node: the one k3sArgs start with, the one of
+// the k3s section, or agent when it joins a server and server otherwise
+func Role(cfg *config.CloudConfig) string {
+	if args := cfg.Maculaos.K3sArgs; len(args) > 0 && (args[0] == "server" || args[0] == "agent") {
+		return args[0]
+	}
+	if cfg.K3s != nil && cfg.K3s.Role != "" {
+		return cfg.K3s.Role
+	}
+	if cfg.Maculaos.ServerURL != "" {
+		return "agent"
+	}
+	return "server"
+}
+
+// Render returns the config.yaml of k3s for a node of role in mode
+func Render(cfg *config.CloudConfig, role, mode string) ([]byte, error) {
+	values := map[string]interface{}{}
+	if k := cfg.K3s; k != nil {
+		if k.ClusterInit {
+			values["cluster-init"] = true
+		}
+		setString(values, "datastore-endpoint", k.DatastoreEndpoint)
+		setList(values, "disable", k.Disable)
+		setString(values, "flannel-backend", k.FlannelBackend)
+		setList(values, "tls-san", k.TLSSAN)
+		if k.NodeIP != "" {
+			var ips []string
+			for _, ip := range strings.Split(k.NodeIP, ",") {
+				ip = strings.TrimSpace(ip)
+				if net.ParseIP(ip) == nil {
+					return nil, fmt.Errorf("k3s: invalid nodeIp %q", k.NodeIP)
+				}
+				ips = append(ips, ip)
+			}
+			setList(values, "node-ip", ips)
+		}
+		setList(values, "kubelet-arg", k.KubeletArgs)
+	}
+	if role != "server" && role != "agent" {
+		return nil, fmt.Errorf("k3s: invalid role %q, must be server or agent", role)
+	}
+	if role == "agent" {
+		var invalid []string
+		for _, key := range serverOnly {
+			if _, ok := values[key]; ok {
+				invalid = append(invalid, key)
+			}
+		}
+		if len(invalid) > 0 {
+			return nil, fmt.Errorf("k3s: %s only apply to servers", strings.Join(invalid, ", "))
+		}
+	}
+
+	setString(values, "server", cfg.Maculaos.ServerURL)
+	setString(values, "token", cfg.Maculaos.Token)
+
+	var labels []string
+	for k, v := range cfg.Maculaos.Labels {
+		labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+	}
+	if mode != "" {
+		labels = append(labels, fmt.Sprintf("macula.io/mode=%s", mode))
+	}
+	labels = append(labels, fmt.Sprintf("macula.io/version=%s", version.Version))
+	sort.Strings(labels)
+	setList(values, "node-label", labels)
+	setList(values, "node-taint", cfg.Maculaos.Taints)
+
+	return marshal(values)
+}
+
+// parseArgs turns maculaos.k3sArgs, a role followed by flags, into the
+// values of a file of config.yaml.d. Flags given more than once are appended
+// to the ones of config.yaml.
+func parseArgs(args []string) (string, map[string]interface{}, error) {
+	role := ""
+	if len(args) > 0 && (args[0] == "server" || args[0] == "agent") {
+		role, args = args[0], args[1:]
+	}
+
+	values := map[string]interface{}{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") || len(arg) == 2 {
+			return "", nil, fmt.Errorf("k3sArgs: unsupported argument %q, flags must be given as --name or --name=value", arg)
+		}
+		key, value := arg[2:], interface{}(true)
+		if parts := strings.SplitN(key, "=", 2); len(parts) == 2 {
+			key, value = parts[0], parts[1]
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			i++
+			value = args[i]
+		}
+		if listFlags[key] {
+			list, _ := values[key+"+"].([]interface{})
+			values[key+"+"] = append(list, value)
+		} else {
+			values[key] = value
+		}
+	}
+	return role, values, nil
+}
+
+func setString(values map[string]interface{}, key, value string) {
+	if value != "" {
+		values[key] = value
+	}
+}
+
+func setList(values map[string]interface{}, key string, list []string) {
+	if len(list) > 0 {
+		values[key] = list
+	}
+}
+
+func marshal(values map[string]interface{}) ([]byte, error) {
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(header), data...), nil
+}
+
+// write writes content to path, or removes path if content is empty and it
+// was written from the config, and reports whether it changed. A file that
+// was not written from the config is only replaced with replace.
+func write(path string, content []byte, replace bool) (bool, error) {
+	old, err := effects.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	ours := os.IsNotExist(err) || bytes.HasPrefix(old, []byte(header))
+	if bytes.Equal(old, content) || (len(content) == 0 && (os.IsNotExist(err) || !ours)) {
+		return false, nil
+	}
+	if len(content) == 0 {
+		return true, effects.Remove(path)
+	}
+	if !ours {
+		if !replace {
+			return false, fmt.Errorf("%s was not written from the config, remove it to use maculaos.k3sArgs", path)
+		}
+		logrus.Warnf("replacing %s, which was not written from the config", path)
+	}
+	if err := effects.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	// it holds the token of the cluster
+	return true, effects.WriteFile(path, content, 0600)
+}
+
+// installed reports whether the k3s service is installed for role. The
+// install script puts the role on the command_args line of the service, with
+// the flags that were passed to it before they moved to config.yaml.
+func installed(role string) bool {
+	script, err := effects.ReadFile(serviceFile)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(script), "\n") {
+		if line == `command_args="`+role {
+			return true
+		}
+	}
+	return false
+}
+
+// runInstall runs the k3s install script, which writes the service for role
+// and starts it unless restart is false
+func runInstall(cfg *config.CloudConfig, role string, k3sExists, k3sLocalExists, restart bool) error {
+	vars := []string{
+		"INSTALL_K3S_NAME=service",
+	}
+	if k3sExists {
+		vars = append(vars, "INSTALL_K3S_SKIP_DOWNLOAD=true")
+		vars = append(vars, "INSTALL_K3S_BIN_DIR=/sbin")
+		vars = append(vars, "INSTALL_K3S_BIN_DIR_READ_ONLY=true")
+	} else if k3sLocalExists {
+		vars = append(vars, "INSTALL_K3S_SKIP_DOWNLOAD=true")
+	}
+	if !restart {
+		vars = append(vars, "INSTALL_K3S_SKIP_START=true")
+	}
+
+	cmd := exec.Command(installScript, role)
+	// the install script downloads k3s through the proxy of the config, with
+	// the settings of the service rather than the ones of the shell
+	cmd.Env = append(proxy.InstallEnviron(cfg.Proxy, os.Environ()), vars...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	cmd.Stdin = os.Stdin
+	logrus.Debugf("Running %s %v %v", cmd.Path, cmd.Args, vars)
+
+	return effects.Run(cmd)
+}
+
+// firewallRules opens the ports of the control plane, kubelet and flannel,
+// and lets traffic in from the pod network
+func firewallRules(server bool) []config.FirewallRule {
+	rules := []config.FirewallRule{
+		{Port: "10250", Protocol: "tcp"},
+		{Port: "8472", Protocol: "udp"},
+		{Port: "51820-51821", Protocol: "udp"},
+		{Interface: "cni0"},
+		{Interface: "flannel.1"},
+		{Interface: "flannel-wg*"},
+	}
+	if server {
+		rules = append(rules,
+			config.FirewallRule{Port: "6443", Protocol: "tcp"},
+			config.FirewallRule{Port: "2379-2380", Protocol: "tcp"},
+			config.FirewallRule{Port: "5001", Protocol: "tcp"})
+	}
+	return rules
+}
@@ -0,0 +1,150 @@
+package k3s
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/config"
+)
+
+func TestRender(t *testing.T) {
+	cfg := &config.CloudConfig{
+		K3s: &config.K3s{
+			ClusterInit:    true,
+			Disable:        []string{"traefik", "servicelb"},
+			FlannelBackend: "wireguard-native",
+			TLSSAN:         []string{"edge.site.example"},
+			NodeIP:         "10.0.0.5, fd00::5",
+			KubeletArgs:    []string{"max-pods=200"},
+		},
+		Maculaos: config.Maculaos{
+			Token:  "K10secret",
+			Labels: map[string]string{"zone": "lab"},
+			Taints: []string{"edge=true:NoSchedule"},
+		},
+	}
+	data, err := Render(cfg, Role(cfg), "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := header + `cluster-init: true
+disable:
+- traefik
+- servicelb
+flannel-backend: wireguard-native
+kubelet-arg:
+- max-pods=200
+node-ip:
+- 10.0.0.5
+- fd00::5
+node-label:
+- macula.io/mode=local
+- macula.io/version=HEAD
+- zone=lab
+node-taint:
+- edge=true:NoSchedule
+tls-san:
+- edge.site.example
+token: K10secret
+`
+	if string(data) != want {
+		t.Errorf("unexpected config.yaml:\n%s", data)
+	}
+
+	cfg.Maculaos.ServerURL = "https://server.site.example:6443"
+	if role := Role(cfg); role != "agent" {
+		t.Errorf("expected an agent with a server URL, got %s", role)
+	}
+	_, err = Render(cfg, Role(cfg), "local")
+	if err == nil || !strings.Contains(err.Error(), "cluster-init, disable, flannel-backend, tls-san only apply to servers") {
+		t.Errorf("expected server-only options to be rejected for an agent, got %v", err)
+	}
+
+	cfg.K3s = &config.K3s{NodeIP: "10.0.0.300"}
+	if _, err := Render(cfg, Role(cfg), ""); err == nil {
+		t.Error("expected an invalid node IP to be rejected")
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	role, values, err := parseArgs([]string{
+		"server", "--disable=traefik", "--disable", "servicelb", "--flannel-backend=host-gw",
+		"--write-kubeconfig-mode", "0644", "--debug",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != "server" {
+		t.Errorf("expected the server role, got %q", role)
+	}
+	want := map[string]interface{}{
+		"disable+":              []interface{}{"traefik", "servicelb"},
+		"flannel-backend":       "host-gw",
+		"write-kubeconfig-mode": "0644",
+		"debug":                 true,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("unexpected values %v", values)
+	}
+
+	if _, _, err := parseArgs([]string{"-v", "2"}); err == nil {
+		t.Error("expected short flags to be rejected")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml.d", "50-args.yaml")
+	content := []byte(header + "debug: true\n")
+
+	for _, want := range []bool{true, false} {
+		changed, err := write(path, content, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != want {
+			t.Errorf("expected changed to be %v", want)
+		}
+	}
+	if changed, err := write(path, nil, false); err != nil || !changed {
+		t.Fatalf("expected the file to be removed, got %v", err)
+	}
+	if _, err := ioutil.ReadFile(path); err == nil {
+		t.Error("the file should be removed without content")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("debug: false\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := write(path, content, false); err == nil {
+		t.Error("expected a file not written from the config to be kept")
+	}
+	if changed, err := write(path, nil, false); err != nil || changed {
+		t.Errorf("a file not written from the config should not be removed, got %v", err)
+	}
+}
+
+func TestInstalled(t *testing.T) {
+	defer func(file string) { serviceFile = file }(serviceFile)
+	serviceFile = filepath.Join(t.TempDir(), "k3s-service")
+
+	if installed("server") {
+		t.Error("the service should not be installed without an init script")
+	}
+	script := "#!/sbin/openrc-run\ncommand=\"/sbin/k3s\"\ncommand_args=\"server\n    >>/var/log/k3s-service.log 2>&1\"\n"
+	if err := ioutil.WriteFile(serviceFile, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if !installed("server") || installed("agent") {
+		t.Error("expected the service to be installed for the server role only")
+	}
+	legacy := strings.Replace(script, `"server`, `"server \--node-label macula.io/mode=local`, 1)
+	if err := ioutil.WriteFile(serviceFile, []byte(legacy), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if installed("server") {
+		t.Error("a service installed with flags should be installed again")
+	}
+}
@@ -0,0 +1,274 @@
+// Package manifests writes the manifests and Helm charts of the config to the
+// auto-deploy directory of k3s, which applies them, and removes the ones that
+// were taken out of the config.
+package manifests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/k3s"
+	"github.com/macula-io/macula-os/pkg/mode"
+	"github.com/macula-io/macula-os/pkg/util"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// prefix marks the files written from the config, so that the manifests
+// shipped with the image are left alone
+const prefix = "maculaos-"
+
+var (
+	// Dir is the auto-deploy directory of k3s
+	Dir = "/var/lib/rancher/k3s/server/manifests"
+
+	validName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+)
+
+type helmChart struct {
+	APIVersion string        `yaml:"apiVersion"`
+	Kind       string        `yaml:"kind"`
+	Metadata   metadata      `yaml:"metadata"`
+	Spec       helmChartSpec `yaml:"spec"`
+}
+
+type metadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+type helmChartSpec struct {
+	Chart           string `yaml:"chart"`
+	Repo            string `yaml:"repo,omitempty"`
+	Version         string `yaml:"version,omitempty"`
+	TargetNamespace string `yaml:"targetNamespace,omitempty"`
+	CreateNamespace bool   `yaml:"createNamespace,omitempty"`
+	ValuesContent   string `yaml:"valuesContent,omitempty"`
+}
+
+// ApplyManifests writes the manifests and Helm charts of the config on a
+// server. Manifests from URLs are only fetched withNet; until then the copy
+// fetched before is kept.
+func ApplyManifests(cfg *config.CloudConfig, withNet bool) error {
+	mode, err := mode.Get()
+	if err != nil {
+		return err
+	}
+	if mode == "install" || k3s.Role(cfg) != "server" {
+		return nil
+	}
+
+	// file names with their content, nil to keep the file as it is
+	files := map[string][]byte{}
+	var errors []string
+	add := func(kind, name string, content []byte, err error) {
+		file := prefix + name + ".yaml"
+		if kind == "chart" {
+			file = prefix + "chart-" + name + ".yaml"
+		}
+		if _, ok := files[file]; ok && err == nil {
+			err = fmt.Errorf("duplicate name")
+		}
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s %s: %v", kind, name, err))
+		}
+		if _, ok := files[file]; !ok {
+			files[file] = content
+		}
+	}
+
+	for _, m := range cfg.Manifests {
+		name := manifestName(m)
+		content, err := manifest(m, filepath.Join(Dir, prefix+name+".yaml"), withNet)
+		add("manifest", name, content, err)
+	}
+	for _, c := range cfg.HelmCharts {
+		content, err := RenderChart(c)
+		add("chart", c.Name, content, err)
+	}
+
+	if err := effects.MkdirAll(Dir, 0755); err != nil {
+		return err
+	}
+	for _, file := range sortedKeys(files) {
+		content := files[file]
+		if content == nil {
+			continue
+		}
+		path := filepath.Join(Dir, file)
+		if old, err := effects.ReadFile(path); err == nil && bytes.Equal(old, content) {
+			continue
+		}
+		if err := effects.WriteFile(path, content, 0600); err != nil {
+			return err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, ok := files[name]; ok || !entry.Mode().IsRegular() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		logrus.Infof("removing %s, which is no longer in the config", name)
+		if err := effects.Remove(filepath.Join(Dir, name)); err != nil {
+			return err
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// manifestName returns the name of a manifest, or the base name of its path
+// or URL without the extension
+func manifestName(m config.Manifest) string {
+	if m.Name != "" {
+		return m.Name
+	}
+	source := m.Path
+	if u, err := url.Parse(m.URL); err == nil && m.URL != "" {
+		source = u.Path
+	}
+	name := path.Base(source)
+	for _, ext := range []string{".yaml", ".yml", ".json"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return strings.ToLower(name)
+}
+
+// manifest returns the content of a manifest, or nil to keep the copy of a
+// URL that is at file
+func manifest(m config.Manifest, file string, withNet bool) ([]byte, error) {
+	if !validName.MatchString(manifestName(m)) {
+		return nil, fmt.Errorf("invalid name, must be lowercase letters, digits, '-' and '.'")
+	}
+
+	var content []byte
+	switch {
+	case m.Content != "" && m.Path == "" && m.URL == "":
+		content = []byte(m.Content)
+	case m.Path != "" && m.Content == "" && m.URL == "":
+		var err error
+		if content, err = effects.ReadFile(m.Path); err != nil {
+			return nil, err
+		}
+	case m.URL != "" && m.Content == "" && m.Path == "":
+		if u, err := url.Parse(m.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("url must be https")
+		}
+		if m.SHA256 == "" {
+			return nil, fmt.Errorf("a manifest from a URL must be pinned with sha256")
+		}
+		if old, err := effects.ReadFile(file); err == nil && verify(old, m.SHA256) == nil {
+			return nil, nil
+		}
+		if !withNet {
+			return nil, nil
+		}
+		var err error
+		if content, err = util.HTTPLoadBytes(m.URL); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("exactly one of content, path and url must be set")
+	}
+
+	if m.SHA256 != "" {
+		if err := verify(content, m.SHA256); err != nil {
+			return nil, err
+		}
+	}
+	if err := validYAML(content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// RenderChart returns the HelmChart resource of a chart, which the helm
+// controller of k3s installs in its namespace
+func RenderChart(c config.HelmChart) ([]byte, error) {
+	if !validName.MatchString(c.Name) {
+		return nil, fmt.Errorf("invalid name, must be lowercase letters, digits, '-' and '.'")
+	}
+	if c.Chart == "" {
+		return nil, fmt.Errorf("no chart")
+	}
+	if c.Repo == "" && !strings.HasPrefix(c.Chart, "https://") && !strings.HasPrefix(c.Chart, "oci://") {
+		return nil, fmt.Errorf("chart %s needs a repo, or must be an https or oci URL", c.Chart)
+	}
+
+	chart := helmChart{
+		APIVersion: "helm.cattle.io/v1",
+		Kind:       "HelmChart",
+		Metadata: metadata{
+			Name:      c.Name,
+			Namespace: "kube-system",
+		},
+		Spec: helmChartSpec{
+			Chart:           c.Chart,
+			Repo:            c.Repo,
+			Version:         c.Version,
+			TargetNamespace: c.Namespace,
+			CreateNamespace: c.Namespace != "",
+		},
+	}
+	if len(c.Values) > 0 {
+		values, err := yaml.Marshal(c.Values)
+		if err != nil {
+			return nil, err
+		}
+		chart.Spec.ValuesContent = string(values)
+	}
+	return yaml.Marshal(chart)
+}
+
+func verify(content []byte, digest string) error {
+	sum := sha256.Sum256(content)
+	if !strings.EqualFold(strings.TrimPrefix(digest, "sha256:"), hex.EncodeToString(sum[:])) {
+		return fmt.Errorf("sha256 digest %x does not match %s", sum, digest)
+	}
+	return nil
+}
+
+// validYAML checks that every document of a manifest parses
+func validYAML(content []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc interface{}
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid YAML: %v", err)
+		}
+	}
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+package manifests
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/config"
+)
+
+func TestApplyManifests(t *testing.T) {
+	defer func(dir string) { Dir = dir }(Dir)
+	Dir = t.TempDir()
+	source := filepath.Join(t.TempDir(), "spegel.yaml")
+	spegel := "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: spegel\n"
+	if err := ioutil.WriteFile(source, []byte(spegel), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fetched := "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: remote\n"
+	sum := sha256.Sum256([]byte(fetched))
+	for file, content := range map[string]string{
+		"maculaos-remote.yaml":    fetched,
+		"maculaos-old.yaml":       "kind: ConfigMap\n",
+		"system-upgrade-ctl.yaml": "kind: Deployment\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(Dir, file), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.CloudConfig{
+		Manifests: []config.Manifest{
+			{Name: "console", Content: "apiVersion: v1\nkind: Namespace\n---\napiVersion: v1\nkind: ConfigMap\n"},
+			{Path: source},
+			{URL: "https://manifests.example.com/remote.yaml", SHA256: hex.EncodeToString(sum[:])},
+		},
+		HelmCharts: []config.HelmChart{{
+			Name:      "monitoring",
+			Chart:     "kube-prometheus-stack",
+			Repo:      "https://prometheus-community.github.io/helm-charts",
+			Version:   "58.0.0",
+			Namespace: "monitoring",
+			Values:    map[string]interface{}{"grafana": map[string]interface{}{"enabled": false}},
+		}},
+	}
+	if err := ApplyManifests(cfg, false); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ioutil.ReadDir(Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, entry := range entries {
+		files = append(files, entry.Name())
+	}
+	sort.Strings(files)
+	want := []string{"maculaos-chart-monitoring.yaml", "maculaos-console.yaml", "maculaos-remote.yaml", "maculaos-spegel.yaml", "system-upgrade-ctl.yaml"}
+	if strings.Join(files, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v, got %v", want, files)
+	}
+
+	chart, err := ioutil.ReadFile(filepath.Join(Dir, "maculaos-chart-monitoring.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantChart := `apiVersion: helm.cattle.io/v1
+kind: HelmChart
+metadata:
+  name: monitoring
+  namespace: kube-system
+spec:
+  chart: kube-prometheus-stack
+  repo: https://prometheus-community.github.io/helm-charts
+  version: 58.0.0
+  targetNamespace: monitoring
+  createNamespace: true
+  valuesContent: |
+    grafana:
+      enabled: false
+`
+	if string(chart) != wantChart {
+		t.Errorf("unexpected HelmChart:\n%s", chart)
+	}
+
+	if err := ApplyManifests(&config.CloudConfig{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := ioutil.ReadDir(Dir); len(entries) != 1 {
+		t.Errorf("only the manifest not written from the config should be left, got %d files", len(entries))
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	defer func(dir string) { Dir = dir }(Dir)
+	Dir = t.TempDir()
+
+	cfg := &config.CloudConfig{
+		Manifests: []config.Manifest{
+			{Name: "Console", Content: "kind: Namespace\n"},
+			{Name: "broken", Content: "kind: [Namespace\n"},
+			{URL: "https://manifests.example.com/unpinned.yaml"},
+			{Name: "both", Content: "kind: Namespace\n", Path: "/etc/both.yaml"},
+		},
+		HelmCharts: []config.HelmChart{{Name: "norepo", Chart: "podinfo"}},
+	}
+	err := ApplyManifests(cfg, false)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"manifest Console: invalid name", "manifest broken: invalid YAML", "manifest unpinned: a manifest from a URL must be pinned", "manifest both: exactly one", "chart norepo: chart podinfo needs a repo"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
@@ -2,12 +2,15 @@ package module
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
-	"github.com/paultag/go-modprobe"
 	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/paultag/go-modprobe"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,6 +18,14 @@ const (
 	procModulesFile = "/proc/modules"
 )
 
+var (
+	// ConfFile holds the module options and blacklist of the config
+	ConfFile = "/etc/modprobe.d/90-maculaos.conf"
+)
+
+// LoadModules writes the options and blacklist of the config to ConfFile and
+// loads the modules that are not loaded yet. A module that fails to load
+// does not stop the others.
 func LoadModules(cfg *config.CloudConfig) error {
 	loaded := map[string]bool{}
 	f, err := os.Open(procModulesFile)
@@ -26,17 +37,69 @@ func LoadModules(cfg *config.CloudConfig) error {
 	for sc.Scan() {
 		loaded[strings.SplitN(sc.Text(), " ", 2)[0]] = true
 	}
-	modules := cfg.Maculaos.Modules
-	for _, m := range modules {
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	var errors []string
+	blacklisted := map[string]bool{}
+	conf := &bytes.Buffer{}
+	for _, m := range cfg.Maculaos.BlacklistModules {
+		blacklisted[m] = true
+		fmt.Fprintf(conf, "blacklist %s\n", m)
 		if loaded[m] {
+			logrus.Warnf("module %s is blacklisted but loaded, it is unloaded at the next boot", m)
+		}
+	}
+	for _, m := range cfg.Maculaos.Modules {
+		params := strings.Fields(m)
+		if len(params) == 0 {
+			continue
+		}
+		if blacklisted[params[0]] {
+			errors = append(errors, fmt.Sprintf("module %s is both loaded and blacklisted", params[0]))
+		} else if len(params) > 1 {
+			fmt.Fprintf(conf, "options %s\n", strings.Join(params, " "))
+		}
+	}
+	if err := writeConf(conf.Bytes()); err != nil {
+		return err
+	}
+
+	for _, m := range cfg.Maculaos.Modules {
+		params := strings.Fields(m)
+		if len(params) == 0 || blacklisted[params[0]] {
+			continue
+		}
+		if loaded[params[0]] {
 			continue
 		}
-		params := strings.SplitN(m, " ", -1)
 		logrus.Debugf("module %s with parameters [%s] is loading", m, params)
-		if err := modprobe.Load(params[0], strings.Join(params[1:], " ")); err != nil {
-			return fmt.Errorf("could not load module %s with parameters [%s], err %v", m, params, err)
+		err := effects.Do(effects.KindModule, params[0], strings.Join(params[1:], " "), true, func() error {
+			return modprobe.Load(params[0], strings.Join(params[1:], " "))
+		})
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("could not load module %s with parameters [%s], err %v", m, params, err))
+			continue
 		}
 		logrus.Debugf("module %s is loaded", m)
 	}
-	return sc.Err()
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+func writeConf(content []byte) error {
+	if len(content) == 0 {
+		if _, err := os.Stat(ConfFile); os.IsNotExist(err) {
+			return nil
+		}
+		return effects.Remove(ConfFile)
+	}
+	if err := effects.MkdirAll(filepath.Dir(ConfFile), 0755); err != nil {
+		return err
+	}
+	return effects.WriteFile(ConfFile, content, 0644)
 }
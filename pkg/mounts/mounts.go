@@ -0,0 +1,213 @@
+package mounts
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+)
+
+const (
+	// blockName marks the mounts of the config in /etc/fstab
+	blockName = "mounts"
+
+	// emptyCheckSize is how much of a device must be zeroes for it to be
+	// formatted when blkid finds nothing on it
+	emptyCheckSize = 1 << 20
+)
+
+var (
+	fstabFile  = "/etc/fstab"
+	mountsFile = "/proc/mounts"
+)
+
+// ApplyMounts finds the devices of the config, formats the empty ones that
+// ask for it, writes the mounts to /etc/fstab and mounts what is not mounted
+// yet. Devices with data on them are never formatted. A device that is
+// missing, such as an unplugged USB disk, does not stop the others.
+func ApplyMounts(cfg *config.CloudConfig) error {
+	var errors []string
+	var entries []string
+	var ready []config.Mount
+	for _, m := range cfg.Mounts {
+		if err := prepare(m); err != nil {
+			errors = append(errors, fmt.Sprintf("mount %s: %v", m.Path, err))
+			continue
+		}
+		entries = append(entries, fstabEntries(m)...)
+		ready = append(ready, m)
+	}
+
+	if err := writeFstab(entries); err != nil {
+		return err
+	}
+
+	for _, m := range ready {
+		if err := mount(m); err != nil {
+			errors = append(errors, fmt.Sprintf("mount %s: %v", m.Path, err))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// prepare validates a mount, finds its device and formats it if asked to
+func prepare(m config.Mount) error {
+	if m.Device == "" || !filepath.IsAbs(m.Path) {
+		return fmt.Errorf("device and an absolute path are required")
+	}
+	if m.Bind != "" && !filepath.IsAbs(m.Bind) {
+		return fmt.Errorf("bind must be an absolute path")
+	}
+	if strings.ContainsAny(m.Device+m.Path+m.Bind+strings.Join(m.Options, ""), " \t") {
+		return fmt.Errorf("device, path, bind and options cannot contain whitespace")
+	}
+	if m.Format && m.FSType == "" {
+		return fmt.Errorf("format needs fsType")
+	}
+
+	device, err := findDevice(m.Device)
+	if err != nil {
+		return err
+	}
+	if !m.Format || isMounted(m.Path) {
+		return nil
+	}
+
+	fsType, err := probe(device)
+	if err != nil {
+		return err
+	}
+	switch fsType {
+	case m.FSType:
+		return nil
+	case "":
+		return format(device, m)
+	}
+	return fmt.Errorf("%s is not empty, it has %s on it, refusing to format it", device, fsType)
+}
+
+// findDevice resolves a device spec to the device node
+func findDevice(spec string) (string, error) {
+	if strings.HasPrefix(spec, "/") {
+		device, err := filepath.EvalSymlinks(spec)
+		if err != nil {
+			return "", fmt.Errorf("device %s not found", spec)
+		}
+		return device, nil
+	}
+	if !strings.Contains(spec, "=") {
+		return "", fmt.Errorf("invalid device %q, must be LABEL=, UUID=, PARTUUID= or a path", spec)
+	}
+	out, err := exec.Command("blkid", "-l", "-t", spec, "-o", "device").Output()
+	if device := strings.TrimSpace(string(out)); err == nil && device != "" {
+		return device, nil
+	}
+	return "", fmt.Errorf("device %s not found", spec)
+}
+
+// probe returns what blkid finds on a device, a filesystem or a partition
+// table, and refuses devices that hold data blkid does not recognise
+func probe(device string) (string, error) {
+	out, _ := exec.Command("blkid", "-p", "-o", "export", device).Output()
+	for _, line := range strings.Split(string(out), "\n") {
+		for _, key := range []string{"TYPE=", "PTTYPE="} {
+			if strings.HasPrefix(line, key) {
+				return strings.TrimPrefix(line, key), nil
+			}
+		}
+	}
+
+	f, err := os.Open(device)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, emptyCheckSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if !bytes.Equal(buf[:n], make([]byte, n)) {
+		return "", fmt.Errorf("%s holds data that is not a known filesystem, refusing to format it", device)
+	}
+	return "", nil
+}
+
+func format(device string, m config.Mount) error {
+	args := []string{}
+	if m.Label != "" {
+		flag := "-L"
+		if m.FSType == "vfat" || m.FSType == "exfat" {
+			flag = "-n"
+		}
+		args = append(args, flag, m.Label)
+	}
+	return effects.RunOutput(exec.Command("mkfs."+m.FSType, append(args, device)...))
+}
+
+func fstabEntries(m config.Mount) []string {
+	fsType := m.FSType
+	if fsType == "" {
+		fsType = "auto"
+	}
+	options := "defaults,nofail"
+	if len(m.Options) > 0 {
+		options = strings.Join(m.Options, ",")
+	}
+	entries := []string{fmt.Sprintf("%s\t%s\t%s\t%s\t0 0", m.Device, m.Path, fsType, options)}
+	if m.Bind != "" {
+		entries = append(entries, fmt.Sprintf("%s\t%s\tnone\tbind,nofail\t0 0", m.Path, m.Bind))
+	}
+	return entries
+}
+
+// writeFstab replaces the block of /etc/fstab that holds the mounts of the
+// config, keeping the rest of the file
+func writeFstab(entries []string) error {
+	_, err := effects.WriteBlock(fstabFile, blockName, entries, 0644)
+	return err
+}
+
+// mount mounts a filesystem and its bind mount from /etc/fstab unless they
+// are mounted already
+func mount(m config.Mount) error {
+	for _, path := range []string{m.Path, m.Bind} {
+		if path == "" || isMounted(path) {
+			continue
+		}
+		if err := effects.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		if err := effects.RunOutput(exec.Command("mount", path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isMounted(path string) bool {
+	f, err := os.Open(mountsFile)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 1 && fields[1] == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package mounts
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+)
+
+func TestWriteFstab(t *testing.T) {
+	dir := t.TempDir()
+	defer func(fstab string) { fstabFile = fstab }(fstabFile)
+	fstabFile = filepath.Join(dir, "fstab")
+	shipped := "/dev/cdrom\t/media/cdrom\tiso9660\tnoauto,ro 0 0\n"
+	if err := ioutil.WriteFile(fstabFile, []byte(shipped), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := effects.Record(true)
+	defer recorder.Stop()
+
+	m := config.Mount{Device: "LABEL=DATA", Path: "/mnt/data", FSType: "ext4", Bind: "/var/lib/rancher/k3s/storage"}
+	for i := 0; i < 2; i++ {
+		if err := writeFstab(fstabEntries(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := effects.ReadFile(fstabFile)
+	want := shipped + "# BEGIN maculaos mounts\n" +
+		"LABEL=DATA\t/mnt/data\text4\tdefaults,nofail\t0 0\n" +
+		"/mnt/data\t/var/lib/rancher/k3s/storage\tnone\tbind,nofail\t0 0\n" +
+		"# END maculaos mounts\n"
+	if string(data) != want {
+		t.Errorf("unexpected fstab:\n%s", data)
+	}
+
+	if err := writeFstab(nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := effects.ReadFile(fstabFile); string(data) != shipped {
+		t.Errorf("expected the block to be removed:\n%s", data)
+	}
+}
+
+func TestProbeRefusesData(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.img")
+	used := filepath.Join(dir, "used.img")
+	if err := ioutil.WriteFile(empty, make([]byte, 4<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4<<20)
+	copy(data[4096:], "some data that is not a filesystem")
+	if err := ioutil.WriteFile(used, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if fsType, err := probe(empty); err != nil || fsType != "" {
+		t.Errorf("expected an empty device, got %q, %v", fsType, err)
+	}
+	if _, err := probe(used); err == nil || !strings.Contains(err.Error(), "refusing to format") {
+		t.Errorf("expected data to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultRollbackTimeout = 30 * time.Second
+
+var (
+	// settleDelay is how long connman is given to apply a configuration
+	// without static addresses to wait for
+	settleDelay = 5 * time.Second
+
+	// connmanConfig is the provisioning file connman picks up as it changes
+	connmanConfig = "/var/lib/connman/network.config"
+	sysNet        = "/sys/class/net"
+	routeFile     = "/proc/net/route"
+
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		return iface.Addrs()
+	}
+
+	validName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+)
+
+// ApplyNetwork creates the VLANs and bonds of the config, sets MTUs and
+// provisions the addresses of the interfaces in connman. With rollback, the
+// connman provisioning and the link changes are reverted when the new
+// addresses do not show up or the gateways stop answering after the change.
+func ApplyNetwork(cfg *config.CloudConfig, rollback bool) error {
+	network := cfg.Network
+	if network == nil {
+		network = &config.Network{}
+	}
+	for _, iface := range network.Interfaces {
+		if err := validate(iface); err != nil {
+			return fmt.Errorf("interface %s: %v", iface.Name, err)
+		}
+	}
+
+	timeout := defaultRollbackTimeout
+	if network.RollbackTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(network.RollbackTimeout); err != nil {
+			return fmt.Errorf("invalid rollbackTimeout: %v", err)
+		}
+	}
+	rollback = rollback && network.SafeApply && !effects.DryRun()
+	gateways := staticGateways(network.Interfaces)
+	if rollback && len(gateways) == 0 {
+		if gw := defaultGateway(); gw != "" {
+			gateways = []string{gw}
+		}
+	}
+
+	old, err := effects.ReadFile(connmanConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	oldExists := err == nil
+
+	undo, linkErr := createLinks(network.Interfaces)
+	content := render(network.Interfaces)
+	if err := writeConfig(content); err != nil {
+		return err
+	}
+
+	changed := len(undo) > 0 || oldExists != (content != nil) || !bytes.Equal(old, content)
+	if rollback && changed {
+		if len(gateways) == 0 {
+			logrus.Warn("network: no gateway to check the new configuration against, not rolling back")
+			return linkErr
+		}
+		// the old configuration answers until connman applied the new one
+		deadline := time.Now().Add(timeout)
+		err := waitApplied(network.Interfaces, deadline)
+		if err == nil {
+			err = waitReachable(gateways, deadline)
+		}
+		if err != nil {
+			if !oldExists {
+				old = nil
+			}
+			revert(old, undo)
+			return fmt.Errorf("network configuration rolled back after %s: %v", timeout, err)
+		}
+	}
+	return linkErr
+}
+
+func validate(iface config.NetworkInterface) error {
+	if !validName.MatchString(iface.Name) {
+		return fmt.Errorf("invalid interface name")
+	}
+	if err := validateAddress(iface.IPv4, iface.Gateway, "dhcp", false); err != nil {
+		return fmt.Errorf("ipv4: %v", err)
+	}
+	if err := validateAddress(iface.IPv6, iface.Gateway6, "auto", true); err != nil {
+		return fmt.Errorf("ipv6: %v", err)
+	}
+	for _, dns := range iface.DNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("invalid nameserver %q", dns)
+		}
+	}
+	if iface.MTU < 0 || iface.MTU > 65535 {
+		return fmt.Errorf("invalid mtu %d", iface.MTU)
+	}
+	if (iface.Link == "") != (iface.VLANID == 0) {
+		return fmt.Errorf("a VLAN needs both link and vlanId")
+	}
+	if iface.VLANID < 0 || iface.VLANID > 4094 {
+		return fmt.Errorf("invalid vlanId %d", iface.VLANID)
+	}
+	if iface.Link != "" && len(iface.BondInterfaces) > 0 {
+		return fmt.Errorf("an interface cannot be both a VLAN and a bond")
+	}
+	if iface.BondMode != "" && len(iface.BondInterfaces) == 0 {
+		return fmt.Errorf("bondMode needs bondInterfaces")
+	}
+	return nil
+}
+
+// validateAddress checks an address setting, which is auto, off or an
+// address in CIDR form, and the gateway that goes with it
+func validateAddress(address, gateway, auto string, v6 bool) error {
+	if address == "" || address == auto || address == "off" {
+		if gateway != "" {
+			return fmt.Errorf("a gateway needs a static address")
+		}
+		return nil
+	}
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil || (ip.To4() == nil) != v6 {
+		return fmt.Errorf("invalid address %q, must be %s, off or an address in CIDR form", address, auto)
+	}
+	if gateway == "" {
+		return nil
+	}
+	if gw := net.ParseIP(gateway); gw == nil || (gw.To4() == nil) != v6 {
+		return fmt.Errorf("invalid gateway %q", gateway)
+	}
+	return nil
+}
+
+// render returns the connman provisioning of the interfaces, or nil if they
+// only use the defaults
+func render(interfaces []config.NetworkInterface) []byte {
+	buf := &bytes.Buffer{}
+	service := func(name string) {
+		buf.WriteString("\n[service_")
+		buf.WriteString(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+		buf.WriteString("]\n")
+		buf.WriteString("Type=ethernet\n")
+		buf.WriteString("DeviceName=")
+		buf.WriteString(name)
+		buf.WriteString("\n")
+	}
+
+	for _, iface := range interfaces {
+		// the members of a bond carry no addresses of their own
+		for _, member := range iface.BondInterfaces {
+			service(member)
+			buf.WriteString("IPv4=off\nIPv6=off\n")
+		}
+		if iface.IPv4 == "" && iface.IPv6 == "" && len(iface.DNS) == 0 {
+			continue
+		}
+		service(iface.Name)
+		if iface.IPv4 != "" {
+			buf.WriteString("IPv4=")
+			buf.WriteString(connmanAddress(iface.IPv4, iface.Gateway))
+			buf.WriteString("\n")
+		}
+		if iface.IPv6 != "" {
+			buf.WriteString("IPv6=")
+			buf.WriteString(connmanAddress(iface.IPv6, iface.Gateway6))
+			buf.WriteString("\n")
+		}
+		if len(iface.DNS) > 0 {
+			buf.WriteString("Nameservers=")
+			buf.WriteString(strings.Join(iface.DNS, ","))
+			buf.WriteString("\n")
+		}
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+	return append([]byte("[global]\nName=network\nDescription=Interfaces defined in the cloud-config\n"), buf.Bytes()...)
+}
+
+// connmanAddress formats a CIDR address as connman expects it: with a dotted
+// netmask for IPv4, a prefix length for IPv6, and the gateway appended
+func connmanAddress(address, gateway string) string {
+	ip, ipNet, err := net.ParseCIDR(address)
+	if err != nil {
+		// dhcp, auto or off
+		return address
+	}
+	result := ip.String() + "/"
+	if ip.To4() != nil {
+		result += net.IP(ipNet.Mask).String()
+	} else {
+		ones, _ := ipNet.Mask.Size()
+		result += strconv.Itoa(ones)
+	}
+	if gateway != "" {
+		result += "/" + gateway
+	}
+	return result
+}
+
+func writeConfig(content []byte) error {
+	if content == nil {
+		if _, err := os.Stat(connmanConfig); os.IsNotExist(err) {
+			return nil
+		}
+		return effects.Remove(connmanConfig)
+	}
+	if err := effects.MkdirAll(filepath.Dir(connmanConfig), 0755); err != nil {
+		return err
+	}
+	return effects.WriteFile(connmanConfig, content, 0600)
+}
+
+// createLinks creates the bonds and VLANs that do not exist yet and sets the
+// MTU of all interfaces. Bonds go first, as VLANs may sit on top of them. It
+// returns the ip commands that undo the changes, to be run last to first.
+func createLinks(interfaces []config.NetworkInterface) ([][]string, error) {
+	var undo [][]string
+	var errors []string
+	for _, kind := range []string{"bond", "ethernet", "vlan"} {
+		for _, iface := range interfaces {
+			if linkKind(iface) != kind {
+				continue
+			}
+			isNew, linkUndo, err := createLink(iface)
+			undo = append(undo, linkUndo...)
+			if mtu := readLink(iface.Name, "mtu"); err == nil && iface.MTU > 0 && mtu != strconv.Itoa(iface.MTU) {
+				err = ip("link", "set", "dev", iface.Name, "mtu", strconv.Itoa(iface.MTU))
+				if err == nil && !isNew && mtu != "" {
+					undo = append(undo, []string{"link", "set", "dev", iface.Name, "mtu", mtu})
+				}
+			}
+			if err == nil && isNew {
+				err = ip("link", "set", "dev", iface.Name, "up")
+			}
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("interface %s: %v", iface.Name, err))
+			}
+		}
+	}
+
+	if len(errors) > 0 {
+		return undo, fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return undo, nil
+}
+
+func linkKind(iface config.NetworkInterface) string {
+	switch {
+	case len(iface.BondInterfaces) > 0:
+		return "bond"
+	case iface.Link != "":
+		return "vlan"
+	}
+	return "ethernet"
+}
+
+// createLink creates a bond or VLAN and enslaves the members of a bond,
+// reporting whether the link is new and the ip commands that undo the changes
+func createLink(iface config.NetworkInterface) (bool, [][]string, error) {
+	var undo [][]string
+	exists := linkExists(iface.Name)
+	switch linkKind(iface) {
+	case "bond":
+		if !exists {
+			args := []string{"link", "add", "name", iface.Name, "type", "bond"}
+			if iface.BondMode != "" {
+				args = append(args, "mode", iface.BondMode)
+			}
+			if err := ip(args...); err != nil {
+				return false, nil, err
+			}
+			undo = append(undo, []string{"link", "delete", "dev", iface.Name})
+		}
+		for _, member := range iface.BondInterfaces {
+			master, _ := os.Readlink(filepath.Join(sysNet, member, "master"))
+			if filepath.Base(master) == iface.Name {
+				continue
+			}
+			// run last to first: the member leaves the bond, then comes up
+			undo = append(undo, []string{"link", "set", "dev", member, "up"})
+			if master == "" {
+				undo = append(undo, []string{"link", "set", "dev", member, "nomaster"})
+			} else {
+				undo = append(undo, []string{"link", "set", "dev", member, "master", filepath.Base(master)})
+			}
+			// a link has to be down to be enslaved
+			if err := ip("link", "set", "dev", member, "down"); err != nil {
+				return !exists, undo, err
+			}
+			if err := ip("link", "set", "dev", member, "master", iface.Name); err != nil {
+				return !exists, undo, err
+			}
+			if err := ip("link", "set", "dev", member, "up"); err != nil {
+				return !exists, undo, err
+			}
+		}
+	case "vlan":
+		if !exists {
+			if err := ip("link", "add", "link", iface.Link, "name", iface.Name, "type", "vlan", "id", strconv.Itoa(iface.VLANID)); err != nil {
+				return false, nil, err
+			}
+			undo = append(undo, []string{"link", "delete", "dev", iface.Name})
+		}
+	default:
+		// connman provisions the addresses whenever the interface shows up,
+		// but the MTU can only be set once it is there
+		if !exists && iface.MTU > 0 {
+			return false, nil, fmt.Errorf("no such interface to set the MTU of")
+		}
+	}
+	return !exists, undo, nil
+}
+
+func linkExists(name string) bool {
+	_, err := os.Stat(filepath.Join(sysNet, name))
+	return err == nil
+}
+
+func readLink(name, attribute string) string {
+	data, _ := ioutil.ReadFile(filepath.Join(sysNet, name, attribute))
+	return strings.TrimSpace(string(data))
+}
+
+func ip(args ...string) error {
+	cmd := exec.Command("ip", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return effects.Run(cmd)
+}
+
+func staticGateways(interfaces []config.NetworkInterface) []string {
+	var gateways []string
+	for _, iface := range interfaces {
+		for _, gw := range []string{iface.Gateway, iface.Gateway6} {
+			if gw != "" {
+				gateways = append(gateways, gw)
+			}
+		}
+	}
+	return gateways
+}
+
+// defaultGateway returns the IPv4 default gateway from the routing table
+func defaultGateway() string {
+	f, err := os.Open(routeFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway ..., in little endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != 4 || binary.LittleEndian.Uint32(gw) == 0 {
+			continue
+		}
+		return net.IPv4(gw[3], gw[2], gw[1], gw[0]).String()
+	}
+	return ""
+}
+
+// waitApplied waits until the static addresses of the config are on their
+// links, which shows connman applied the new configuration. Without static
+// addresses it waits settleDelay.
+func waitApplied(interfaces []config.NetworkInterface, deadline time.Time) error {
+	addresses := map[string][]net.IP{}
+	for _, iface := range interfaces {
+		for _, address := range []string{iface.IPv4, iface.IPv6} {
+			if ip, _, err := net.ParseCIDR(address); err == nil {
+				addresses[iface.Name] = append(addresses[iface.Name], ip)
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		time.Sleep(settleDelay)
+		return nil
+	}
+
+	for {
+		var missing []string
+		for name, ips := range addresses {
+			for _, ip := range ips {
+				if !hasAddress(name, ip) {
+					missing = append(missing, ip.String()+" on "+name)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			sort.Strings(missing)
+			return fmt.Errorf("%s not configured", strings.Join(missing, ", "))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func hasAddress(name string, ip net.IP) bool {
+	addrs, err := interfaceAddrs(name)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitReachable pings the gateways until all of them answer or the deadline
+// passes
+func waitReachable(gateways []string, deadline time.Time) error {
+	for {
+		var unreachable []string
+		for _, gw := range gateways {
+			if err := exec.Command("ping", "-c", "1", "-W", "2", gw).Run(); err != nil {
+				unreachable = append(unreachable, gw)
+			}
+		}
+		if len(unreachable) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gateway %s unreachable", strings.Join(unreachable, ", "))
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// revert restores the previous connman provisioning and undoes the link
+// changes
+func revert(old []byte, undo [][]string) {
+	if err := writeConfig(old); err != nil {
+		logrus.Errorf("network: failed to restore %s: %v", connmanConfig, err)
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := ip(undo[i]...); err != nil {
+			logrus.Errorf("network: failed to run ip %s: %v", strings.Join(undo[i], " "), err)
+		}
+	}
+}
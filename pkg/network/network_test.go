@@ -0,0 +1,158 @@
+package network
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+)
+
+func TestApplyNetwork(t *testing.T) {
+	dir := t.TempDir()
+	defer func(conf, sys string) { connmanConfig, sysNet = conf, sys }(connmanConfig, sysNet)
+	connmanConfig = filepath.Join(dir, "connman", "network.config")
+	sysNet = filepath.Join(dir, "net")
+	for _, name := range []string{"eth0", "eth1", "eth2"} {
+		if err := os.MkdirAll(filepath.Join(sysNet, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := effects.Record(true)
+	defer recorder.Stop()
+
+	cfg := &config.CloudConfig{Network: &config.Network{
+		SafeApply: true,
+		Interfaces: []config.NetworkInterface{
+			{Name: "eth0", IPv4: "192.168.1.10/24", Gateway: "192.168.1.1", IPv6: "off", DNS: []string{"1.1.1.1"}},
+			{Name: "bond0", BondInterfaces: []string{"eth1", "eth2"}, BondMode: "active-backup", MTU: 9000},
+			{Name: "bond0.20", Link: "bond0", VLANID: 20, IPv6: "2001:db8::2/64", Gateway6: "2001:db8::1"},
+		},
+	}}
+	if err := ApplyNetwork(cfg, true); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := effects.ReadFile(connmanConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"[service_eth0]\nType=ethernet\nDeviceName=eth0\nIPv4=192.168.1.10/255.255.255.0/192.168.1.1\nIPv6=off\nNameservers=1.1.1.1\n",
+		"[service_eth1]\nType=ethernet\nDeviceName=eth1\nIPv4=off\nIPv6=off\n",
+		"[service_bond0_20]\nType=ethernet\nDeviceName=bond0.20\nIPv6=2001:db8::2/64/2001:db8::1\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %s in\n%s", want, data)
+		}
+	}
+
+	var commands []string
+	for _, e := range recorder.Effects {
+		if e.Kind == effects.KindCommand {
+			commands = append(commands, e.Target)
+		}
+	}
+	want := []string{
+		"ip link add name bond0 type bond mode active-backup",
+		"ip link set dev eth1 down",
+		"ip link set dev eth1 master bond0",
+		"ip link set dev eth1 up",
+		"ip link set dev eth2 down",
+		"ip link set dev eth2 master bond0",
+		"ip link set dev eth2 up",
+		"ip link set dev bond0 mtu 9000",
+		"ip link set dev bond0 up",
+		"ip link add link bond0 name bond0.20 type vlan id 20",
+		"ip link set dev bond0.20 up",
+	}
+	if strings.Join(commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected commands:\n%s", strings.Join(commands, "\n"))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, iface := range []config.NetworkInterface{
+		{Name: "eth0", IPv4: "192.168.1.10"},
+		{Name: "eth0", IPv4: "2001:db8::2/64"},
+		{Name: "eth0", Gateway: "192.168.1.1"},
+		{Name: "eth0", IPv4: "192.168.1.10/24", Gateway: "2001:db8::1"},
+		{Name: "eth0.10", VLANID: 10},
+		{Name: "bond0", BondMode: "802.3ad"},
+		{Name: "a-very-long-interface-name"},
+	} {
+		if err := validate(iface); err == nil {
+			t.Errorf("expected %+v to be invalid", iface)
+		}
+	}
+}
+
+func TestUndoLinks(t *testing.T) {
+	dir := t.TempDir()
+	defer func(sys string) { sysNet = sys }(sysNet)
+	sysNet = filepath.Join(dir, "net")
+	for name, mtu := range map[string]string{"eth0": "1500", "eth1": "1500", "eth2": "1500", "bond1": "1500"} {
+		if err := os.MkdirAll(filepath.Join(sysNet, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(sysNet, name, "mtu"), []byte(mtu+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// eth2 moves over from another bond
+	if err := os.Symlink("../bond1", filepath.Join(sysNet, "eth2", "master")); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := effects.Record(true)
+	defer recorder.Stop()
+
+	undo, err := createLinks([]config.NetworkInterface{
+		{Name: "eth0", MTU: 9000},
+		{Name: "bond0", BondInterfaces: []string{"eth1", "eth2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	for i := len(undo) - 1; i >= 0; i-- {
+		commands = append(commands, strings.Join(undo[i], " "))
+	}
+	want := []string{
+		"link set dev eth0 mtu 1500",
+		"link set dev eth2 master bond1",
+		"link set dev eth2 up",
+		"link set dev eth1 nomaster",
+		"link set dev eth1 up",
+		"link delete dev bond0",
+	}
+	if strings.Join(commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected undo:\n%s", strings.Join(commands, "\n"))
+	}
+}
+
+func TestWaitApplied(t *testing.T) {
+	defer func(f func(string) ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	var addrs []net.Addr
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		return addrs, nil
+	}
+
+	interfaces := []config.NetworkInterface{{Name: "eth0", IPv4: "192.168.1.10/24", IPv6: "auto"}}
+	err := waitApplied(interfaces, time.Now())
+	if err == nil || err.Error() != "192.168.1.10 on eth0 not configured" {
+		t.Errorf("expected the address to be missing, got %v", err)
+	}
+
+	_, ipNet, _ := net.ParseCIDR("192.168.1.0/24")
+	addrs = []net.Addr{&net.IPNet{IP: net.ParseIP("192.168.1.10"), Mask: ipNet.Mask}}
+	if err := waitApplied(interfaces, time.Now()); err != nil {
+		t.Error(err)
+	}
+}
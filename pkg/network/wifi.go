@@ -0,0 +1,196 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+)
+
+var (
+	connmanSettings = "/var/lib/connman/settings"
+	wifiConfig      = "/var/lib/connman/cloud-config.config"
+	connmanctl      = "connmanctl"
+)
+
+// ApplyWifi enables wifi in connman and provisions the networks of the
+// config. When connman is running and a network of a higher priority than the
+// connected one is in range, it switches to it.
+func ApplyWifi(cfg *config.CloudConfig) error {
+	if len(cfg.Maculaos.Wifi) == 0 {
+		return nil
+	}
+
+	var errors []string
+	for i, w := range cfg.Maculaos.Wifi {
+		if err := validateWifi(cfg, w); err != nil {
+			errors = append(errors, fmt.Sprintf("wifi %d (%s): %v", i, w.Name, err))
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+
+	dir := filepath.Dir(connmanSettings)
+	if err := effects.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to mkdir %s: %v", dir, err)
+	}
+	if err := effects.WriteFile(connmanSettings, []byte("[WiFi]\nEnable=true\nTethering=false\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write to %s: %v", connmanSettings, err)
+	}
+
+	content := renderWifi(cfg.Maculaos.Wifi)
+	// the passphrases are in there
+	err := effects.File(wifiConfig, content, 0600, func() error {
+		if err := ioutil.WriteFile(wifiConfig, content, 0600); err != nil {
+			return err
+		}
+		return os.Chmod(wifiConfig, 0600)
+	})
+	if err != nil {
+		return err
+	}
+
+	return preferWifi(cfg.Maculaos.Wifi)
+}
+
+func validateWifi(cfg *config.CloudConfig, w config.Wifi) error {
+	if w.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch w.EAP {
+	case "":
+		if w.Identity != "" || w.ClientCert != "" || w.CACert != "" {
+			return fmt.Errorf("identity and certificates need eap")
+		}
+	case "peap", "ttls":
+		if w.Identity == "" || w.Passphrase == "" {
+			return fmt.Errorf("%s needs identity and passphrase", w.EAP)
+		}
+	case "tls":
+		if w.Identity == "" || w.ClientCert == "" || w.PrivateKey == "" {
+			return fmt.Errorf("tls needs identity, clientCert and privateKey")
+		}
+	default:
+		return fmt.Errorf("invalid eap %q, must be one of: peap, ttls, tls", w.EAP)
+	}
+	for _, path := range []string{w.CACert, w.ClientCert, w.PrivateKey} {
+		if path != "" && !config.Provided(cfg, path) {
+			return fmt.Errorf("%s does not exist and is not in writeFiles", path)
+		}
+	}
+	if err := validateAddress(w.IPv4, w.Gateway, "dhcp", false); err != nil {
+		return fmt.Errorf("ipv4: %v", err)
+	}
+	return validateAddress(w.IPv6, w.Gateway6, "auto", true)
+}
+
+func renderWifi(networks []config.Wifi) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("[global]\n")
+	buf.WriteString("Name=cloud-config\n")
+	buf.WriteString("Description=Services defined in the cloud-config\n")
+
+	set := func(key, value string) {
+		if value != "" {
+			buf.WriteString(key)
+			buf.WriteString("=")
+			buf.WriteString(value)
+			buf.WriteString("\n")
+		}
+	}
+
+	for i, w := range byPriority(networks) {
+		buf.WriteString("[service_wifi")
+		buf.WriteString(strconv.Itoa(i))
+		buf.WriteString("]\n")
+		set("Type", "wifi")
+		set("Name", w.Name)
+		if w.Hidden {
+			set("Hidden", "true")
+		}
+		if w.EAP != "" {
+			set("Security", "ieee8021x")
+			set("EAP", w.EAP)
+			set("Phase2", w.Phase2)
+			set("Identity", w.Identity)
+			set("AnonymousIdentity", w.AnonymousIdentity)
+			set("CACertFile", w.CACert)
+			set("ClientCertFile", w.ClientCert)
+			set("PrivateKeyFile", w.PrivateKey)
+			set("PrivateKeyPassphrase", w.PrivateKeyPassphrase)
+		}
+		set("Passphrase", w.Passphrase)
+		if w.IPv4 != "" {
+			set("IPv4", connmanAddress(w.IPv4, w.Gateway))
+		}
+		if w.IPv6 != "" {
+			set("IPv6", connmanAddress(w.IPv6, w.Gateway6))
+		}
+		set("Nameservers", strings.Join(w.DNS, ","))
+	}
+	return buf.Bytes()
+}
+
+// byPriority returns the networks highest priority first, otherwise in the
+// order of the config
+func byPriority(networks []config.Wifi) []config.Wifi {
+	sorted := append([]config.Wifi{}, networks...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	return sorted
+}
+
+// preferWifi connects to the network of the highest priority in range when
+// it beats the connected one. connman has no priorities of its own, and is
+// left alone when it is not running.
+func preferWifi(networks []config.Wifi) error {
+	priorities := map[string]int{}
+	prioritized := false
+	for _, w := range networks {
+		priorities[w.Name] = w.Priority
+		prioritized = prioritized || w.Priority != 0
+	}
+	if !prioritized {
+		return nil
+	}
+
+	out, err := exec.Command(connmanctl, "services").Output()
+	if err != nil {
+		return nil
+	}
+
+	best, bestPriority := "", 0
+	connected := false
+	connectedPriority := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		// "*AO Name                 wifi_..._managed_psk"
+		fields := strings.Fields(line)
+		if len(line) < 4 || len(fields) < 2 || !strings.HasPrefix(fields[len(fields)-1], "wifi_") {
+			continue
+		}
+		id := fields[len(fields)-1]
+		name := strings.TrimSpace(strings.TrimSuffix(line[4:], id))
+		priority, ok := priorities[name]
+		if line[2] == 'O' || line[2] == 'R' {
+			connected, connectedPriority = true, priority
+		}
+		if ok && (best == "" || priority > bestPriority) {
+			best, bestPriority = id, priority
+		}
+	}
+
+	if best == "" || (connected && connectedPriority >= bestPriority) {
+		return nil
+	}
+	return effects.Run(exec.Command(connmanctl, "connect", best))
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+)
+
+func TestApplyWifi(t *testing.T) {
+	dir := t.TempDir()
+	defer func(settings, wifi string) { connmanSettings, wifiConfig = settings, wifi }(connmanSettings, wifiConfig)
+	connmanSettings = filepath.Join(dir, "settings")
+	wifiConfig = filepath.Join(dir, "cloud-config.config")
+	defer func(ctl string) { connmanctl = ctl }(connmanctl)
+	connmanctl = filepath.Join(dir, "connmanctl")
+	script := `#!/bin/sh
+case "$1" in
+services)
+	echo "*AO guest                 wifi_0011_6775657374_managed_psk"
+	echo "    corp                  wifi_0011_636f7270_managed_ieee8021x" ;;
+connect)
+	echo "$2" > "$0.connected" ;;
+esac
+`
+	if err := ioutil.WriteFile(connmanctl, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.CloudConfig{
+		WriteFiles: []config.File{{Path: "/etc/ssl/site/ca.pem"}},
+		Maculaos: config.Maculaos{Wifi: []config.Wifi{
+			{Name: "guest", Passphrase: "secret123"},
+			{Name: "corp", Passphrase: "hunter2", Priority: 10, Hidden: true, EAP: "peap", Phase2: "MSCHAPV2", Identity: "node1", CACert: "/etc/ssl/site/ca.pem", IPv4: "10.1.0.5/16", Gateway: "10.1.0.1"},
+		}},
+	}
+	if err := ApplyWifi(cfg); err != nil {
+		t.Fatal(err)
+	}
+	// corp has the higher priority
+	if connected, _ := ioutil.ReadFile(connmanctl + ".connected"); string(connected) != "wifi_0011_636f7270_managed_ieee8021x\n" {
+		t.Errorf("expected to connect to corp, got %q", connected)
+	}
+
+	data, err := ioutil.ReadFile(wifiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[service_wifi0]
+Type=wifi
+Name=corp
+Hidden=true
+Security=ieee8021x
+EAP=peap
+Phase2=MSCHAPV2
+Identity=node1
+CACertFile=/etc/ssl/site/ca.pem
+Passphrase=hunter2
+IPv4=10.1.0.5/255.255.0.0/10.1.0.1
+[service_wifi1]
+Type=wifi
+Name=guest
+Passphrase=secret123
+`
+	if !strings.HasSuffix(string(data), want) {
+		t.Errorf("unexpected connman config:\n%s", data)
+	}
+	if info, err := os.Stat(wifiConfig); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode())
+	}
+
+	cfg.Maculaos.Wifi = []config.Wifi{{Name: "corp", EAP: "tls", Identity: "node1", ClientCert: "/missing.pem", PrivateKey: "/missing.key"}}
+	recorder := effects.Record(true)
+	defer recorder.Stop()
+	if err := ApplyWifi(cfg); err == nil || !strings.Contains(err.Error(), "/missing.pem does not exist") {
+		t.Errorf("expected missing certificate to fail, got %v", err)
+	}
+}
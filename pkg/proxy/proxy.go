@@ -0,0 +1,274 @@
+// Package proxy applies the proxy section of the config to the shared HTTP
+// client of maculaos, login shells, and the k3s service and its containerd.
+package proxy
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/httpclient"
+	"github.com/macula-io/macula-os/pkg/services"
+	"github.com/macula-io/macula-os/pkg/system"
+)
+
+const (
+	// blockName marks the proxy settings in the conf.d file of k3s
+	blockName = "proxy"
+)
+
+var (
+	// BundleFile holds the system CAs along with the one of the proxy, for
+	// k3s and containerd, which only read a single file
+	BundleFile = system.LocalPath("proxy-bundle.pem")
+
+	k3sConfFile = "/etc/conf.d/k3s-service"
+	// k3sEnvFile is sourced by the k3s service after k3sConfFile. The k3s
+	// install script copies the proxy settings it ran with to it.
+	k3sEnvFile     = "/etc/rancher/k3s/k3s-service.env"
+	profileFile    = "/etc/profile.d/maculaos-proxy.sh"
+	systemCAFile   = "/etc/ssl/certs/ca-certificates.crt"
+	clusterNoProxy = []string{"127.0.0.1", "localhost", "10.42.0.0/16", "10.43.0.0/16", ".svc", ".cluster.local"}
+	proxyVar       = regexp.MustCompile(`(?i)^(export )?(CONTAINERD_)?(NO|HTTP|HTTPS)_PROXY=`)
+)
+
+// ApplyProxy writes the proxy settings for every consumer, or removes them
+// when the config has none. With restart, a running k3s is restarted when its
+// settings changed.
+func ApplyProxy(cfg *config.CloudConfig, restart bool) error {
+	p := cfg.Proxy
+	if p == nil {
+		p = &config.Proxy{}
+	}
+	if err := validate(p); err != nil {
+		return err
+	}
+	ca, err := readCA(p.CABundle)
+	if err != nil {
+		return err
+	}
+
+	env := Env(p)
+	if err := writeOrRemove(httpclient.ProxyFile, envLines(env, ""), 0600); err != nil {
+		return err
+	}
+	if err := writeOrRemove(httpclient.CAFile, string(ca), 0644); err != nil {
+		return err
+	}
+	bundle := ""
+	if len(ca) > 0 {
+		systemCAs, err := effects.ReadFile(systemCAFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		bundle = strings.TrimRight(string(systemCAs), "\n") + "\n" + string(ca)
+	}
+	if err := writeOrRemove(BundleFile, bundle, 0644); err != nil {
+		return err
+	}
+
+	profile := ""
+	if len(env) > 0 {
+		lower := map[string]string{}
+		for k, v := range env {
+			lower[strings.ToLower(k)] = v
+		}
+		profile = envLines(env, "export ") + envLines(lower, "export ")
+	}
+	if err := writeOrRemove(profileFile, profile, 0644); err != nil {
+		return err
+	}
+
+	changed, err := writeK3sConf(k3sEnv(p, len(ca) > 0))
+	if err != nil {
+		return err
+	}
+	envChanged, err := cleanK3sEnvFile()
+	if err != nil {
+		return err
+	}
+	if (changed || envChanged) && restart {
+		return services.RestartIfRunning(services.K3s, "the new proxy settings")
+	}
+	return nil
+}
+
+// Env returns HTTP_PROXY, HTTPS_PROXY and NO_PROXY for the proxy, with the
+// HTTP proxy used for HTTPS as well unless one is set for it
+func Env(p *config.Proxy) map[string]string {
+	env := map[string]string{}
+	if p == nil || (p.HTTPProxy == "" && p.HTTPSProxy == "") {
+		return env
+	}
+	if p.HTTPProxy != "" {
+		env["HTTP_PROXY"] = p.HTTPProxy
+	}
+	env["HTTPS_PROXY"] = p.HTTPSProxy
+	if env["HTTPS_PROXY"] == "" {
+		env["HTTPS_PROXY"] = p.HTTPProxy
+	}
+	if len(p.NoProxy) > 0 {
+		env["NO_PROXY"] = strings.Join(p.NoProxy, ",")
+	}
+	return env
+}
+
+// k3sEnv returns the environment of the k3s service, which passes the
+// CONTAINERD_ variables on to containerd for pulling images. The pod and
+// service networks are never proxied.
+func k3sEnv(p *config.Proxy, ca bool) map[string]string {
+	env := Env(p)
+	if len(env) == 0 {
+		return env
+	}
+	env["NO_PROXY"] = strings.Join(append(append([]string{}, clusterNoProxy...), p.NoProxy...), ",")
+	for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+		if val, ok := env[key]; ok {
+			env["CONTAINERD_"+key] = val
+		}
+	}
+	if ca {
+		env["SSL_CERT_FILE"] = BundleFile
+	}
+	return env
+}
+
+// InstallEnviron returns environ with the proxy settings of the k3s service
+// in place of the ones it holds, for the k3s install script. The script
+// downloads k3s through them and copies them to k3sEnvFile, where they match
+// the ones of conf.d until ApplyProxy removes them.
+func InstallEnviron(p *config.Proxy, environ []string) []string {
+	var result []string
+	for _, kv := range environ {
+		if !proxyVar.MatchString(kv) {
+			result = append(result, kv)
+		}
+	}
+	env := k3sEnv(p, false)
+	var keys []string
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		result = append(result, k+"="+env[k])
+	}
+	return result
+}
+
+func validate(p *config.Proxy) error {
+	for name, proxy := range map[string]string{"httpProxy": p.HTTPProxy, "httpsProxy": p.HTTPSProxy} {
+		if proxy == "" {
+			continue
+		}
+		u, err := url.Parse(proxy)
+		if !strings.Contains(proxy, "://") {
+			u, err = url.Parse("http://" + proxy)
+		}
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return fmt.Errorf("invalid %s %q", name, proxy)
+		}
+	}
+	for _, entry := range p.NoProxy {
+		if entry == "" || strings.ContainsAny(entry, ", \t") {
+			return fmt.Errorf("invalid noProxy entry %q", entry)
+		}
+	}
+	return nil
+}
+
+// readCA returns the PEM of caBundle, which is either the PEM itself or the
+// path of a file holding it
+func readCA(caBundle string) ([]byte, error) {
+	if caBundle == "" {
+		return nil, nil
+	}
+	pem := []byte(caBundle)
+	if !strings.Contains(caBundle, "-----BEGIN") {
+		var err error
+		if pem, err = effects.ReadFile(caBundle); err != nil {
+			return nil, fmt.Errorf("caBundle: %v", err)
+		}
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("caBundle: no certificates found")
+	}
+	return []byte(strings.TrimRight(string(pem), "\n") + "\n"), nil
+}
+
+func envLines(env map[string]string, prefix string) string {
+	var keys []string
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := &strings.Builder{}
+	for _, k := range keys {
+		fmt.Fprintf(buf, "%s%s=%s\n", prefix, k, strconv.Quote(env[k]))
+	}
+	return buf.String()
+}
+
+// writeOrRemove writes content to path, or removes path if content is empty
+func writeOrRemove(path, content string, perm os.FileMode) error {
+	old, err := effects.ReadFile(path)
+	if os.IsNotExist(err) {
+		if content == "" {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+	if content == "" {
+		return effects.Remove(path)
+	}
+	if string(old) == content {
+		return nil
+	}
+	if err := effects.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return effects.WriteFile(path, []byte(content), perm)
+}
+
+// cleanK3sEnvFile removes the proxy settings the k3s install script copied
+// to k3sEnvFile, which would override the ones of conf.d, and reports whether
+// it changed
+func cleanK3sEnvFile() (bool, error) {
+	old, err := effects.ReadFile(k3sEnvFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	buf := &strings.Builder{}
+	for _, line := range strings.SplitAfter(string(old), "\n") {
+		if !proxyVar.MatchString(line) {
+			buf.WriteString(line)
+		}
+	}
+	if buf.String() == string(old) {
+		return false, nil
+	}
+	return true, effects.WriteFile(k3sEnvFile, []byte(buf.String()), 0600)
+}
+
+// writeK3sConf replaces the block of the conf.d file of k3s that exports the
+// proxy settings, keeping the rest of the file, and reports whether it
+// changed
+func writeK3sConf(env map[string]string) (bool, error) {
+	var lines []string
+	if len(env) > 0 {
+		lines = strings.Split(strings.TrimSuffix(envLines(env, "export "), "\n"), "\n")
+	}
+	return effects.WriteBlock(k3sConfFile, blockName, lines, 0644)
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/certtest"
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/httpclient"
+)
+
+func TestApplyProxy(t *testing.T) {
+	dir := t.TempDir()
+	defer func(proxyFile, caFile, bundle, conf, env, profile, systemCA string) {
+		httpclient.ProxyFile, httpclient.CAFile, BundleFile = proxyFile, caFile, bundle
+		k3sConfFile, k3sEnvFile, profileFile, systemCAFile = conf, env, profile, systemCA
+	}(httpclient.ProxyFile, httpclient.CAFile, BundleFile, k3sConfFile, k3sEnvFile, profileFile, systemCAFile)
+	httpclient.ProxyFile = filepath.Join(dir, "local", "proxy.env")
+	httpclient.CAFile = filepath.Join(dir, "local", "proxy-ca.pem")
+	BundleFile = filepath.Join(dir, "local", "proxy-bundle.pem")
+	k3sConfFile = filepath.Join(dir, "k3s-service")
+	k3sEnvFile = filepath.Join(dir, "k3s-service.env")
+	profileFile = filepath.Join(dir, "maculaos-proxy.sh")
+	systemCAFile = filepath.Join(dir, "ca-certificates.crt")
+
+	conf := "rc_need=\"!net !net-online\"\nrc_after=\"ccapply\"\n"
+	if err := ioutil.WriteFile(k3sConfFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(systemCAFile, []byte(certtest.CA(t, "system")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// as left by the install script, which would override conf.d
+	installEnv := InstallEnviron(&config.Proxy{HTTPProxy: "http://old:3128"}, []string{"K3S_TOKEN=x", "https_proxy=http://shell:3128"})
+	if strings.Join(installEnv, " ") != "K3S_TOKEN=x CONTAINERD_HTTPS_PROXY=http://old:3128 CONTAINERD_HTTP_PROXY=http://old:3128 CONTAINERD_NO_PROXY=127.0.0.1,localhost,10.42.0.0/16,10.43.0.0/16,.svc,.cluster.local HTTPS_PROXY=http://old:3128 HTTP_PROXY=http://old:3128 NO_PROXY=127.0.0.1,localhost,10.42.0.0/16,10.43.0.0/16,.svc,.cluster.local" {
+		t.Errorf("unexpected install environment %v", installEnv)
+	}
+	if err := ioutil.WriteFile(k3sEnvFile, []byte(strings.Join(installEnv, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.CloudConfig{Proxy: &config.Proxy{
+		HTTPProxy: "http://proxy.corp:3128",
+		NoProxy:   []string{".corp.example"},
+		CABundle:  certtest.CA(t, "proxy"),
+	}}
+	if err := ApplyProxy(cfg, false); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(k3sConfFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		conf + "# BEGIN maculaos proxy\n",
+		`export CONTAINERD_HTTPS_PROXY="http://proxy.corp:3128"`,
+		`export NO_PROXY="127.0.0.1,localhost,10.42.0.0/16,10.43.0.0/16,.svc,.cluster.local,.corp.example"`,
+		`export SSL_CERT_FILE="` + BundleFile + `"`,
+	} {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("k3s-service misses %q:\n%s", line, data)
+		}
+	}
+	if data, _ := ioutil.ReadFile(k3sEnvFile); string(data) != "K3S_TOKEN=x\n" {
+		t.Errorf("proxy settings should be removed from %s:\n%s", k3sEnvFile, data)
+	}
+	env, _ := ioutil.ReadFile(httpclient.ProxyFile)
+	if want := "HTTPS_PROXY=\"http://proxy.corp:3128\"\nHTTP_PROXY=\"http://proxy.corp:3128\"\nNO_PROXY=\".corp.example\"\n"; string(env) != want {
+		t.Errorf("unexpected %s:\n%s", httpclient.ProxyFile, env)
+	}
+	if bundle, _ := ioutil.ReadFile(BundleFile); strings.Count(string(bundle), "BEGIN CERTIFICATE") != 2 {
+		t.Errorf("bundle should hold the system and proxy CAs:\n%s", bundle)
+	}
+
+	// without a proxy everything is cleaned up again
+	if err := ApplyProxy(&config.CloudConfig{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(k3sConfFile); string(data) != conf {
+		t.Errorf("k3s-service not restored:\n%s", data)
+	}
+	for _, path := range []string{httpclient.ProxyFile, httpclient.CAFile, BundleFile, profileFile} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed", path)
+		}
+	}
+
+	if err := ApplyProxy(&config.CloudConfig{Proxy: &config.Proxy{HTTPProxy: "ftp://proxy"}}, false); err == nil {
+		t.Error("expected an error for an ftp proxy")
+	}
+}
@@ -0,0 +1,337 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/httpclient"
+)
+
+const (
+	defaultRegistry = "docker.io"
+	dockerHub       = "https://registry-1.docker.io"
+)
+
+var (
+	manifestTypes = []string{
+		"application/vnd.oci.image.index.v1+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+	}
+	authParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// Image is a reference to an image, split the way a registry needs it
+type Image struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Reference  string `json:"reference"` // tag or digest
+}
+
+func (i Image) String() string {
+	if strings.HasPrefix(i.Reference, "sha256:") {
+		return i.Registry + "/" + i.Repository + "@" + i.Reference
+	}
+	return i.Registry + "/" + i.Repository + ":" + i.Reference
+}
+
+// Result is the outcome of resolving an image at one endpoint
+type Result struct {
+	Endpoint string `json:"endpoint"`
+	Digest   string `json:"digest,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ParseImage splits an image reference such as nginx, ghcr.io/org/app:v1 or
+// app@sha256:..., completing it the way containerd does
+func ParseImage(ref string) (Image, error) {
+	image := Image{Registry: defaultRegistry, Reference: "latest"}
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, image.Reference = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, image.Reference = name[:i], name[i+1:]
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			image.Registry, name = host, name[i+1:]
+		}
+	}
+	if image.Registry == defaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" || image.Reference == "" || strings.ContainsAny(name, " :@") {
+		return Image{}, fmt.Errorf("invalid image %q", ref)
+	}
+	image.Repository = name
+	return image, nil
+}
+
+// Endpoints returns the endpoints containerd tries for a registry: its
+// mirrors, or those of *, then the registry itself
+func Endpoints(r *config.Registries, registry string) []string {
+	var endpoints []string
+	if r != nil {
+		m, ok := r.Mirrors[registry]
+		if !ok {
+			m = r.Mirrors["*"]
+		}
+		endpoints = append(endpoints, m.Endpoints...)
+	}
+	upstream := upstream(registry)
+	for _, e := range endpoints {
+		if strings.TrimSuffix(e, "/") == upstream {
+			return endpoints
+		}
+	}
+	return append(endpoints, upstream)
+}
+
+// upstream returns the endpoint of the registry itself
+func upstream(registry string) string {
+	if registry == defaultRegistry {
+		return dockerHub
+	}
+	return "https://" + registry
+}
+
+// Check resolves image at every endpoint of its registry, with the
+// credentials and TLS settings configured for each
+func Check(r *config.Registries, image Image) []Result {
+	var results []Result
+	for _, endpoint := range Endpoints(r, image.Registry) {
+		result := Result{Endpoint: endpoint}
+		digest, err := resolve(r, endpoint, image)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Digest = digest
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func resolve(r *config.Registries, endpoint string, image Image) (string, error) {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	c := configFor(r, u.Host)
+	client, err := newClient(c.TLS)
+	if err != nil {
+		return "", err
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/v2") + "/v2/" + image.Repository + "/manifests/" + image.Reference
+	if endpoint != upstream(image.Registry) {
+		// mirrors learn which registry is meant from ns, as with containerd
+		u.RawQuery = url.Values{"ns": {image.Registry}}.Encode()
+	}
+
+	resp, err := head(client, u.String(), "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		authorization, err := authorize(client, resp.Header.Get("WWW-Authenticate"), image, c.Auth)
+		if err != nil {
+			return "", fmt.Errorf("authentication failed: %v", err)
+		}
+		if resp, err = head(client, u.String(), authorization); err != nil {
+			return "", err
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+			return digest, nil
+		}
+		return "found", nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", fmt.Errorf("authentication failed: %s", resp.Status)
+	case http.StatusNotFound:
+		return "", fmt.Errorf("not found")
+	}
+	return "", fmt.Errorf("unexpected response: %s", resp.Status)
+}
+
+func head(client *http.Client, rawurl, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// authorize answers the challenge of a registry, returning the Authorization
+// header to retry with
+func authorize(client *http.Client, challenge string, image Image, auth *config.RegistryAuth) (string, error) {
+	username, password := credentials(auth)
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	if scheme == "basic" {
+		if username == "" {
+			return "", fmt.Errorf("registry requires credentials")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	}
+	if scheme != "bearer" {
+		return "", fmt.Errorf("unsupported challenge %q", challenge)
+	}
+
+	params := map[string]string{}
+	for _, m := range authParam.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("no realm in challenge %q", challenge)
+	}
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", "repository:"+image.Repository+":pull")
+
+	var req *http.Request
+	var err error
+	if auth != nil && auth.IdentityToken != "" {
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", auth.IdentityToken)
+		query.Set("client_id", "maculaos")
+		req, err = http.NewRequest(http.MethodPost, params["realm"], strings.NewReader(query.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+		if req != nil && username != "" {
+			req.SetBasicAuth(username, password)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", fmt.Errorf("token request: %v", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("token request: no token returned")
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// credentials returns the username and password of auth, which may be given
+// as the base64 auth field of a docker config
+func credentials(auth *config.RegistryAuth) (string, string) {
+	if auth == nil {
+		return "", ""
+	}
+	if auth.Username != "" {
+		return auth.Username, auth.Password
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(auth.Auth); err == nil {
+		if parts := strings.SplitN(string(decoded), ":", 2); len(parts) == 2 {
+			return parts[0], parts[1]
+		}
+	}
+	return "", ""
+}
+
+func configFor(r *config.Registries, host string) config.RegistryConfig {
+	if r == nil {
+		return config.RegistryConfig{}
+	}
+	return r.Configs[host]
+}
+
+// newClient returns a client on the shared transport, with the TLS settings
+// of a registry
+func newClient(t *config.RegistryTLS) (*http.Client, error) {
+	client := httpclient.Client()
+	client.Timeout = 30 * time.Second
+	if t == nil {
+		return client, nil
+	}
+
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return client, nil
+	}
+	transport = transport.Clone()
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	tlsConfig.InsecureSkipVerify = t.InsecureSkipVerify
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := tlsConfig.RootCAs
+		if pool == nil {
+			if pool, err = x509.SystemCertPool(); err != nil {
+				pool = x509.NewCertPool()
+			}
+		} else {
+			pool = pool.Clone()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	client.Transport = transport
+	return client, nil
+}
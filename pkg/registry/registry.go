@@ -0,0 +1,189 @@
+// Package registry writes the registries section of the config to the
+// registries.yaml of k3s, from which it configures containerd.
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/services"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// header marks the file as written from the config, so that a
+	// registries.yaml from writeFiles is left alone
+	header = "# Written by maculaos from the registries section of the config\n"
+)
+
+// RegistriesFile is where k3s reads the registries from
+var RegistriesFile = "/etc/rancher/k3s/registries.yaml"
+
+// registriesFile is registries.yaml in the format of k3s
+type registriesFile struct {
+	Mirrors map[string]mirror         `yaml:"mirrors,omitempty"`
+	Configs map[string]registryConfig `yaml:"configs,omitempty"`
+}
+
+type mirror struct {
+	Endpoint []string `yaml:"endpoint,omitempty"`
+}
+
+type registryConfig struct {
+	Auth *authConfig `yaml:"auth,omitempty"`
+	TLS  *tlsConfig  `yaml:"tls,omitempty"`
+}
+
+type authConfig struct {
+	Username      string `yaml:"username,omitempty"`
+	Password      string `yaml:"password,omitempty"`
+	Auth          string `yaml:"auth,omitempty"`
+	IdentityToken string `yaml:"identity_token,omitempty"`
+}
+
+type tlsConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// ApplyRegistries writes registries.yaml, which k3s reads when it starts.
+// With restart, a running k3s is restarted when the file changed.
+func ApplyRegistries(cfg *config.CloudConfig, restart bool) error {
+	r := cfg.Registries
+	if r == nil || (len(r.Mirrors) == 0 && len(r.Configs) == 0) {
+		old, err := effects.ReadFile(RegistriesFile)
+		if err != nil || !bytes.HasPrefix(old, []byte(header)) {
+			return nil
+		}
+		if err := effects.Remove(RegistriesFile); err != nil {
+			return err
+		}
+		return restartK3s(restart)
+	}
+
+	if err := validate(cfg); err != nil {
+		return err
+	}
+	content, err := Render(r)
+	if err != nil {
+		return err
+	}
+
+	old, _ := effects.ReadFile(RegistriesFile)
+	if bytes.Equal(old, content) {
+		return nil
+	}
+	if len(old) > 0 && !bytes.HasPrefix(old, []byte(header)) {
+		logrus.Warnf("replacing %s, which was not written from the registries section", RegistriesFile)
+	}
+	if err := effects.MkdirAll(filepath.Dir(RegistriesFile), 0755); err != nil {
+		return err
+	}
+	// it holds the credentials of the registries
+	if err := effects.WriteFile(RegistriesFile, content, 0600); err != nil {
+		return err
+	}
+	return restartK3s(restart)
+}
+
+func restartK3s(restart bool) error {
+	if !restart {
+		return nil
+	}
+	return services.RestartIfRunning(services.K3s, "the new registries")
+}
+
+// Render returns registries.yaml for the registries of the config
+func Render(r *config.Registries) ([]byte, error) {
+	file := registriesFile{
+		Mirrors: map[string]mirror{},
+		Configs: map[string]registryConfig{},
+	}
+	for name, m := range r.Mirrors {
+		file.Mirrors[name] = mirror{Endpoint: m.Endpoints}
+	}
+	for name, c := range r.Configs {
+		rc := registryConfig{}
+		if c.Auth != nil {
+			a := authConfig(*c.Auth)
+			rc.Auth = &a
+		}
+		if c.TLS != nil {
+			t := tlsConfig(*c.TLS)
+			rc.TLS = &t
+		}
+		file.Configs[name] = rc
+	}
+	data, err := yaml.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(header), data...), nil
+}
+
+func validate(cfg *config.CloudConfig) error {
+	var errors []string
+	for _, name := range sortedKeys(cfg.Registries.Mirrors) {
+		if len(cfg.Registries.Mirrors[name].Endpoints) == 0 {
+			errors = append(errors, fmt.Sprintf("mirror %s: no endpoints", name))
+		}
+		for _, endpoint := range cfg.Registries.Mirrors[name].Endpoints {
+			if u, err := url.Parse(endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+				errors = append(errors, fmt.Sprintf("mirror %s: invalid endpoint %q, must be an http or https URL", name, endpoint))
+			}
+		}
+	}
+	for name, c := range cfg.Registries.Configs {
+		if err := validateConfig(cfg, c); err != nil {
+			errors = append(errors, fmt.Sprintf("config %s: %v", name, err))
+		}
+	}
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+func validateConfig(cfg *config.CloudConfig, c config.RegistryConfig) error {
+	if a := c.Auth; a != nil {
+		if a.Username != "" && a.Password == "" {
+			return fmt.Errorf("username without password")
+		}
+		if a.Auth != "" {
+			if _, err := base64.StdEncoding.DecodeString(a.Auth); err != nil {
+				return fmt.Errorf("auth must be base64 of username:password")
+			}
+		}
+	}
+	if t := c.TLS; t != nil {
+		if (t.CertFile == "") != (t.KeyFile == "") {
+			return fmt.Errorf("certFile and keyFile go together")
+		}
+		for _, path := range []string{t.CAFile, t.CertFile, t.KeyFile} {
+			if path != "" && !config.Provided(cfg, path) {
+				return fmt.Errorf("%s does not exist and is not in writeFiles", path)
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]config.RegistryMirror) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
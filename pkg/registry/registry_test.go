@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/config"
+)
+
+func TestApplyRegistries(t *testing.T) {
+	defer func(file string) { RegistriesFile = file }(RegistriesFile)
+	RegistriesFile = filepath.Join(t.TempDir(), "k3s", "registries.yaml")
+
+	cfg := &config.CloudConfig{
+		Registries: &config.Registries{
+			Mirrors: map[string]config.RegistryMirror{
+				"docker.io": {Endpoints: []string{"https://harbor.site.example"}},
+			},
+			Configs: map[string]config.RegistryConfig{
+				"harbor.site.example": {
+					Auth: &config.RegistryAuth{Username: "robot", Password: "secret"},
+					TLS:  &config.RegistryTLS{CAFile: "/etc/ssl/harbor.pem", InsecureSkipVerify: true},
+				},
+			},
+		},
+		WriteFiles: []config.File{{Path: "/etc/ssl/harbor.pem"}},
+	}
+	if err := ApplyRegistries(cfg, false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(RegistriesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := header + `mirrors:
+  docker.io:
+    endpoint:
+    - https://harbor.site.example
+configs:
+  harbor.site.example:
+    auth:
+      username: robot
+      password: secret
+    tls:
+      ca_file: /etc/ssl/harbor.pem
+      insecure_skip_verify: true
+`
+	if string(data) != want {
+		t.Errorf("unexpected registries.yaml:\n%s", data)
+	}
+
+	if err := ApplyRegistries(&config.CloudConfig{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(RegistriesFile); err == nil {
+		t.Error("registries.yaml should be removed with the registries section")
+	}
+
+	cfg.Registries.Mirrors["ghcr.io"] = config.RegistryMirror{Endpoints: []string{"harbor.site.example"}}
+	cfg.WriteFiles = nil
+	err = ApplyRegistries(cfg, false)
+	if err == nil || !strings.Contains(err.Error(), "invalid endpoint") || !strings.Contains(err.Error(), "/etc/ssl/harbor.pem does not exist") {
+		t.Errorf("expected endpoint and CA errors, got %v", err)
+	}
+}
+
+func TestParseImage(t *testing.T) {
+	for ref, want := range map[string]string{
+		"nginx":                        "docker.io/library/nginx:latest",
+		"org/app:v1":                   "docker.io/org/app:v1",
+		"ghcr.io/org/app:v1":           "ghcr.io/org/app:v1",
+		"localhost:5000/app":           "localhost:5000/app:latest",
+		"registry.local/a/b@sha256:ab": "registry.local/a/b@sha256:ab",
+	} {
+		image, err := ParseImage(ref)
+		if err != nil {
+			t.Errorf("%s: %v", ref, err)
+		} else if image.String() != want {
+			t.Errorf("%s: got %s, want %s", ref, image, want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if user, pass, _ := r.BasicAuth(); user != "robot" || pass != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token":"t0k3n"}`))
+		case r.Header.Get("Authorization") != "Bearer t0k3n":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="harbor"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/org/app/manifests/v1":
+			w.Header().Set("Docker-Content-Digest", "sha256:abc")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &config.Registries{
+		Mirrors: map[string]config.RegistryMirror{"docker.io": {Endpoints: []string{"https://mirror.example", dockerHub}}},
+		Configs: map[string]config.RegistryConfig{host: {
+			Auth: &config.RegistryAuth{Username: "robot", Password: "secret"},
+			TLS:  &config.RegistryTLS{CAFile: ca},
+		}},
+	}
+	if endpoints := Endpoints(r, "docker.io"); len(endpoints) != 2 {
+		t.Errorf("the registry itself should not be tried twice: %v", endpoints)
+	}
+
+	for ref, want := range map[string]string{
+		host + "/org/app:v1": "sha256:abc",
+		host + "/org/app:v2": "not found",
+	} {
+		image, _ := ParseImage(ref)
+		results := Check(r, image)
+		if len(results) != 1 || (results[0].Digest != want && results[0].Error != want) {
+			t.Errorf("%s: unexpected results %+v", ref, results)
+		}
+	}
+
+	r.Configs[host].Auth.Password = "wrong"
+	image, _ := ParseImage(host + "/org/app:v1")
+	if results := Check(r, image); !strings.Contains(results[0].Error, "authentication failed") {
+		t.Errorf("expected an authentication error, got %+v", results[0])
+	}
+}
@@ -0,0 +1,256 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultRunlevel = "default"
+
+// K3s is the service that runs k3s
+const K3s = "k3s-service"
+
+var (
+	initDir     = "/etc/init.d"
+	runlevelDir = "/etc/runlevels"
+	confDir     = "/etc/conf.d"
+
+	validName = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+	validKey  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// ApplyServices adds the services of the config to their runlevel or removes
+// them from all runlevels, and sets their variables in /etc/conf.d. /etc is
+// rebuilt on every boot, so this has to run on every boot as well. With
+// restart, services are also started, stopped or restarted to match.
+func ApplyServices(cfg *config.CloudConfig, restart bool) error {
+	var names []string
+	for name := range cfg.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errors []string
+	for _, name := range names {
+		if err := apply(name, cfg.Services[name], restart); err != nil {
+			errors = append(errors, fmt.Sprintf("service %s: %v", name, err))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+func apply(name string, svc config.Service, restart bool) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid service name")
+	}
+	if _, err := os.Stat(filepath.Join(initDir, name)); err != nil {
+		return fmt.Errorf("no such service")
+	}
+
+	confChanged, err := writeConf(name, svc.ConfD)
+	if err != nil {
+		return err
+	}
+
+	runlevel := svc.Runlevel
+	if runlevel == "" {
+		runlevel = defaultRunlevel
+	}
+	if svc.Enabled != nil {
+		if *svc.Enabled {
+			err = Enable(name, runlevel)
+		} else {
+			err = Disable(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !restart {
+		return nil
+	}
+	running := Running(name)
+	switch {
+	case svc.Enabled != nil && !*svc.Enabled:
+		if running {
+			return rcService(name, "stop")
+		}
+	case svc.Enabled != nil && !running && (runlevel == "boot" || runlevel == defaultRunlevel):
+		return rcService(name, "start")
+	case running && confChanged:
+		return rcService(name, "restart")
+	}
+	return nil
+}
+
+// Runlevels returns the runlevels a service is in
+func Runlevels(name string) []string {
+	var runlevels []string
+	links, _ := filepath.Glob(filepath.Join(runlevelDir, "*", name))
+	for _, link := range links {
+		runlevels = append(runlevels, filepath.Base(filepath.Dir(link)))
+	}
+	return runlevels
+}
+
+// Enable adds a service to runlevel, and removes it from any other
+func Enable(name, runlevel string) error {
+	found := false
+	for _, current := range Runlevels(name) {
+		if current == runlevel {
+			found = true
+			continue
+		}
+		if err := rcUpdate("del", name, current); err != nil {
+			return err
+		}
+	}
+	if found {
+		return nil
+	}
+	return rcUpdate("add", name, runlevel)
+}
+
+// Disable removes a service from all runlevels
+func Disable(name string) error {
+	for _, runlevel := range Runlevels(name) {
+		if err := rcUpdate("del", name, runlevel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Running reports whether a service is started
+func Running(name string) bool {
+	return exec.Command("rc-service", name, "status").Run() == nil
+}
+
+// Restart restarts a service, or starts it if it is stopped
+func Restart(name string) error {
+	return rcService(name, "restart")
+}
+
+// RestartIfRunning restarts a service that is started, logging why, and
+// leaves a stopped one alone
+func RestartIfRunning(name, reason string) error {
+	if !Running(name) {
+		return nil
+	}
+	logrus.Infof("restarting %s for %s", name, reason)
+	return Restart(name)
+}
+
+func rcUpdate(action, name, runlevel string) error {
+	return effects.RunOutput(exec.Command("rc-update", action, name, runlevel))
+}
+
+func rcService(name, action string) error {
+	return effects.RunOutput(exec.Command("rc-service", name, action))
+}
+
+// writeConf sets variables in the conf.d file of a service, keeping the
+// rest of the file as shipped, and reports whether it changed
+func writeConf(name string, vars map[string]string) (bool, error) {
+	if len(vars) == 0 {
+		return false, nil
+	}
+
+	var keys []string
+	for k := range vars {
+		if !validKey.MatchString(k) {
+			return false, fmt.Errorf("invalid conf.d variable %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	path := filepath.Join(confDir, name)
+	old, err := effects.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	var lines []string
+	if len(old) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(old), "\n"), "\n")
+	}
+	for _, k := range keys {
+		line := k + "=" + quote(vars[k])
+		replaced := false
+		for i, l := range lines {
+			if strings.HasPrefix(strings.TrimSpace(l), k+"=") {
+				lines[i], replaced = line, true
+			}
+		}
+		if !replaced {
+			lines = append(lines, line)
+		}
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	if content == string(old) {
+		return false, nil
+	}
+	if err := effects.MkdirAll(confDir, 0755); err != nil {
+		return false, err
+	}
+	return true, effects.WriteFile(path, []byte(content), 0644)
+}
+
+// ConfValue returns the value a variable is set to in the conf.d file of a
+// service, or def if the file does not set it
+func ConfValue(name, key, def string) string {
+	content, err := effects.ReadFile(filepath.Join(confDir, name))
+	if err != nil {
+		return def
+	}
+	value := def
+	for _, l := range strings.Split(string(content), "\n") {
+		l = strings.TrimPrefix(strings.TrimSpace(l), "export ")
+		if strings.HasPrefix(l, key+"=") {
+			value = unquote(strings.TrimPrefix(l, key+"="))
+		}
+	}
+	return value
+}
+
+// unquote reverts quote, and strips the single quotes of shipped files
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1]
+	}
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	var b strings.Builder
+	escaped := false
+	for _, c := range value[1 : len(value)-1] {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// quote quotes a value for the shell that sources conf.d files
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(value) + `"`
+}
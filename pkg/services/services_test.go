@@ -0,0 +1,83 @@
+package services
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+)
+
+func TestApplyServices(t *testing.T) {
+	dir := t.TempDir()
+	defer func(init, runlevels, conf string) { initDir, runlevelDir, confDir = init, runlevels, conf }(initDir, runlevelDir, confDir)
+	initDir = filepath.Join(dir, "init.d")
+	runlevelDir = filepath.Join(dir, "runlevels")
+	confDir = filepath.Join(dir, "conf.d")
+	for _, d := range []string{initDir, confDir, filepath.Join(runlevelDir, "default"), filepath.Join(runlevelDir, "boot")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"nats-server", "spegel", "watchdog"} {
+		if err := ioutil.WriteFile(filepath.Join(initDir, name), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, link := range []string{"default/watchdog", "default/spegel"} {
+		if err := os.Symlink("/etc/init.d/x", filepath.Join(runlevelDir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(confDir, "nats-server"), []byte("# shipped\nNATS_OPTS=\"\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := effects.Record(true)
+	defer recorder.Stop()
+
+	enabled, disabled := true, false
+	cfg := &config.CloudConfig{Services: map[string]config.Service{
+		"nats-server": {Enabled: &enabled, ConfD: map[string]string{"NATS_OPTS": `--name "$HOST"`, "NATS_PORT": "4222"}},
+		"spegel":      {Enabled: &enabled, Runlevel: "boot"},
+		"watchdog":    {Enabled: &disabled},
+		"missing":     {Enabled: &enabled},
+	}}
+	err := ApplyServices(cfg, false)
+	if err == nil || err.Error() != "service missing: no such service" {
+		t.Errorf("expected the missing service to fail, got %v", err)
+	}
+
+	var commands []string
+	for _, e := range recorder.Effects {
+		if e.Kind == effects.KindCommand {
+			commands = append(commands, e.Target)
+		}
+	}
+	want := []string{
+		"rc-update add nats-server default",
+		"rc-update del spegel default",
+		"rc-update add spegel boot",
+		"rc-update del watchdog default",
+	}
+	if strings.Join(commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected commands:\n%s", strings.Join(commands, "\n"))
+	}
+
+	data, err := effects.ReadFile(filepath.Join(confDir, "nats-server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "# shipped\nNATS_OPTS=\"--name \\\"\\$HOST\\\"\"\nNATS_PORT=\"4222\"\n" {
+		t.Errorf("unexpected conf.d file:\n%s", data)
+	}
+	if v := ConfValue("nats-server", "NATS_OPTS", ""); v != `--name "$HOST"` {
+		t.Errorf("unexpected NATS_OPTS %q", v)
+	}
+	if v := ConfValue("nats-server", "NATS_CLUSTER", "none"); v != "none" {
+		t.Errorf("unexpected NATS_CLUSTER %q", v)
+	}
+}
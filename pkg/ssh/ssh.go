@@ -12,6 +12,8 @@ import (
 	"time"
 
 	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/httpclient"
 	"github.com/macula-io/macula-os/pkg/util"
 	"github.com/sirupsen/logrus"
 )
@@ -22,27 +24,36 @@ const (
 )
 
 func SetAuthorizedKeys(cfg *config.CloudConfig, withNet bool) error {
-	bytes, err := ioutil.ReadFile("/etc/passwd")
+	return AuthorizeKeys("macula", cfg.SSHAuthorizedKeys, withNet)
+}
+
+// AuthorizeKeys adds keys to the authorized_keys of a user. Keys may be
+// github:user or gitlab:user, or URLs, which are fetched withNet.
+func AuthorizeKeys(username string, keys []string, withNet bool) error {
+	bytes, err := effects.ReadFile("/etc/passwd")
 	if err != nil {
 		return err
 	}
-	uid, gid, homeDir, err := findUserHomeDir(bytes, "macula")
+	uid, gid, homeDir, err := findUserHomeDir(bytes, username)
 	if err != nil {
 		return err
 	}
+	if homeDir == "" {
+		return fmt.Errorf("user %s does not exist", username)
+	}
 	userSSHDir := path.Join(homeDir, sshDir)
 	if _, err := os.Stat(userSSHDir); os.IsNotExist(err) {
-		if err = os.Mkdir(userSSHDir, 0700); err != nil {
+		if err = effects.MkdirAll(userSSHDir, 0700); err != nil {
 			return err
 		}
 	} else if err != nil {
 		return err
 	}
-	if err = os.Chown(userSSHDir, uid, gid); err != nil {
+	if err = effects.Chown(userSSHDir, uid, gid); err != nil {
 		return err
 	}
 	userAuthorizedFile := path.Join(userSSHDir, authorizedFile)
-	for _, key := range cfg.SSHAuthorizedKeys {
+	for _, key := range keys {
 		if err = authorizeSSHKey(key, userAuthorizedFile, uid, gid, withNet); err != nil {
 			logrus.Errorf("failed to authorize SSH key %s: %v", key, err)
 		}
@@ -72,7 +83,7 @@ func getKey(key string, withNet bool) (string, error) {
 	var resp *http.Response
 	for i := 0; i < 10; time.Sleep(time.Second) {
 		// network interface(s) can be up before DNS is ready, so let's try up to 10 times
-		resp, err = http.Get(key)
+		resp, err = httpclient.Get(key)
 		if err == nil || strings.Contains(err.Error(), "unsupported protocol scheme") {
 			break
 		}
@@ -97,43 +108,31 @@ func authorizeSSHKey(key, file string, uid, gid int, withNet bool) error {
 		return err
 	}
 
-	info, err := os.Stat(file)
-	if os.IsNotExist(err) {
-		f, err := os.Create(file)
-		if err != nil {
-			return err
-		}
-		if err = f.Chmod(0600); err != nil {
-			return err
-		}
-		if err = f.Close(); err != nil {
-			return err
-		}
-		info, err = os.Stat(file)
-		if err != nil {
-			return err
-		}
-	} else if err != nil {
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(file); err == nil {
+		perm = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
 		return err
 	}
-	bytes, err := ioutil.ReadFile(file)
-	if err != nil {
+	bytes, err := effects.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	if !strings.Contains(string(bytes), key) {
 		bytes = append(bytes, []byte(key)...)
 		bytes = append(bytes, '\n')
 	}
-	perm := info.Mode().Perm()
-	if err = util.WriteFileAtomic(file, bytes, perm); err != nil {
-		return err
-	}
-	return os.Chown(file, uid, gid)
+	return effects.File(file, bytes, perm, func() error {
+		if err := util.WriteFileAtomic(file, bytes, perm); err != nil {
+			return err
+		}
+		return os.Chown(file, uid, gid)
+	})
 }
 
 func findUserHomeDir(bytes []byte, username string) (uid, gid int, homeDir string, err error) {
 	for _, line := range strings.Split(string(bytes), "\n") {
-		if strings.HasPrefix(line, username) {
+		if strings.HasPrefix(line, username+":") {
 			split := strings.Split(line, ":")
 			if len(split) < 6 {
 				break
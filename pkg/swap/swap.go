@@ -0,0 +1,266 @@
+package swap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/go-units"
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/system"
+	"github.com/paultag/go-modprobe"
+)
+
+const (
+	zramDevice          = "zram0"
+	defaultZramPercent  = 50
+	defaultZramPriority = 100
+)
+
+var (
+	procSwaps       = "/proc/swaps"
+	sysBlock        = "/sys/block"
+	defaultSwapFile = system.LocalPath("swapfile")
+)
+
+// ApplySwap sets up the zram device and swapfile of the config and turns
+// them on. Swap that is on already is left as it is, so a new size takes
+// effect at the next boot.
+func ApplySwap(cfg *config.CloudConfig) error {
+	if cfg.Swap == nil {
+		return nil
+	}
+
+	var errors []string
+	if cfg.Swap.Zram != nil {
+		if err := applyZram(cfg.Swap.Zram); err != nil {
+			errors = append(errors, fmt.Sprintf("zram: %v", err))
+		}
+	}
+	if cfg.Swap.File != nil {
+		if err := applyFile(cfg.Swap.File); err != nil {
+			errors = append(errors, fmt.Sprintf("swapfile: %v", err))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+func applyZram(z *config.ZramSwap) error {
+	device := "/dev/" + zramDevice
+	if active(device) {
+		return nil
+	}
+
+	percent := z.Percent
+	if percent == 0 {
+		percent = defaultZramPercent
+	}
+	if percent < 0 || percent > 400 {
+		return fmt.Errorf("invalid percent %d", percent)
+	}
+	priority := z.Priority
+	if priority == 0 {
+		priority = defaultZramPriority
+	}
+
+	var si syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&si); err != nil {
+		return err
+	}
+	size := uint64(si.Totalram) * uint64(si.Unit) / 100 * uint64(percent)
+
+	dir := filepath.Join(sysBlock, zramDevice)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err := effects.Do(effects.KindModule, "zram", "", true, func() error {
+			return modprobe.Load("zram", "")
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// the algorithm can only be changed while the device has no size
+	if disksize := readAttribute(dir, "disksize"); disksize != "" && disksize != "0" {
+		if err := writeAttribute(dir, "reset", "1"); err != nil {
+			return err
+		}
+	}
+	if z.Algorithm != "" {
+		if err := writeAttribute(dir, "comp_algorithm", z.Algorithm); err != nil {
+			return err
+		}
+	}
+	if err := writeAttribute(dir, "disksize", strconv.FormatUint(size, 10)); err != nil {
+		return err
+	}
+	if err := effects.RunOutput(exec.Command("mkswap", device)); err != nil {
+		return err
+	}
+	return effects.RunOutput(exec.Command("swapon", "-p", strconv.Itoa(priority), device))
+}
+
+func applyFile(f *config.SwapFile) error {
+	path := f.Path
+	if path == "" {
+		path = defaultSwapFile
+	}
+	size, err := units.RAMInBytes(f.Size)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid size %q", f.Size)
+	}
+	if active(path) {
+		return nil
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Size() != size || !isSwap(path) {
+		err := effects.Do(effects.KindSystem, path, "allocate "+units.BytesSize(float64(size)), true, func() error {
+			return allocate(path, size)
+		})
+		if err != nil {
+			return err
+		}
+		if err := effects.RunOutput(exec.Command("mkswap", path)); err != nil {
+			return err
+		}
+	}
+
+	args := []string{path}
+	if f.Priority > 0 {
+		args = append([]string{"-p", strconv.Itoa(f.Priority)}, args...)
+	}
+	return effects.RunOutput(exec.Command("swapon", args...))
+}
+
+// allocate creates a file of size with all of its blocks allocated, as swap
+// cannot have holes
+func allocate(path string, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Fallocate(int(f.Fd()), 0, 0, size); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to allocate %s: %v", path, err)
+	}
+	return nil
+}
+
+// isSwap reports whether a file carries a swap signature at the end of its
+// first page
+func isSwap(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	signature := make([]byte, 10)
+	if _, err := f.ReadAt(signature, int64(os.Getpagesize()-len(signature))); err != nil {
+		return false
+	}
+	return bytes.Equal(signature, []byte("SWAPSPACE2"))
+}
+
+func active(path string) bool {
+	swaps, _ := Swaps()
+	for _, s := range swaps {
+		if s.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func readAttribute(dir, name string) string {
+	data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+	return strings.TrimSpace(string(data))
+}
+
+func writeAttribute(dir, name, value string) error {
+	path := filepath.Join(dir, name)
+	return effects.Do(effects.KindSystem, path, value, true, func() error {
+		return ioutil.WriteFile(path, []byte(value), 0644)
+	})
+}
+
+// Device is an active swap device or file
+type Device struct {
+	Path     string
+	Type     string
+	Size     uint64 // bytes
+	Used     uint64 // bytes
+	Priority int
+}
+
+// Swaps returns the active swap, as listed in /proc/swaps
+func Swaps() ([]Device, error) {
+	f, err := os.Open(procSwaps)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var devices []Device
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Filename Type Size Used Priority, sizes in KiB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] == "Filename" {
+			continue
+		}
+		size, _ := strconv.ParseUint(fields[2], 10, 64)
+		used, _ := strconv.ParseUint(fields[3], 10, 64)
+		priority, _ := strconv.Atoi(fields[4])
+		devices = append(devices, Device{
+			Path:     fields[0],
+			Type:     fields[1],
+			Size:     size * 1024,
+			Used:     used * 1024,
+			Priority: priority,
+		})
+	}
+	return devices, scanner.Err()
+}
+
+// ZramStats is the compression of a zram device
+type ZramStats struct {
+	Algorithm  string
+	Original   uint64 // bytes stored
+	Compressed uint64 // bytes they take compressed
+	Memory     uint64 // bytes of memory used, including overhead
+}
+
+// Zram returns the stats of the zram swap device, or false if there is none
+func Zram() (ZramStats, bool) {
+	dir := filepath.Join(sysBlock, zramDevice)
+	// orig_data_size compr_data_size mem_used_total ...
+	fields := strings.Fields(readAttribute(dir, "mm_stat"))
+	if len(fields) < 3 {
+		return ZramStats{}, false
+	}
+	stats := ZramStats{}
+	stats.Original, _ = strconv.ParseUint(fields[0], 10, 64)
+	stats.Compressed, _ = strconv.ParseUint(fields[1], 10, 64)
+	stats.Memory, _ = strconv.ParseUint(fields[2], 10, 64)
+	// the algorithm in use is the one in brackets, as in "lzo [lz4] zstd"
+	for _, alg := range strings.Fields(readAttribute(dir, "comp_algorithm")) {
+		if strings.HasPrefix(alg, "[") {
+			stats.Algorithm = strings.Trim(alg, "[]")
+		}
+	}
+	return stats, true
+}
@@ -0,0 +1,86 @@
+package swap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+)
+
+func TestUsage(t *testing.T) {
+	dir := t.TempDir()
+	defer func(swaps, block string) { procSwaps, sysBlock = swaps, block }(procSwaps, sysBlock)
+	procSwaps = filepath.Join(dir, "swaps")
+	sysBlock = filepath.Join(dir, "block")
+	if err := os.MkdirAll(filepath.Join(sysBlock, "zram0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		procSwaps: "Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n" +
+			"/dev/zram0                              partition\t1048572\t\t524288\t\t100\n" +
+			"/var/lib/maculaos/swapfile              file\t\t2097148\t\t0\t\t-2\n",
+		filepath.Join(sysBlock, "zram0", "mm_stat"):        "536870912 134217728 140000000 0 140000000 0 0 0 0\n",
+		filepath.Join(sysBlock, "zram0", "comp_algorithm"): "lzo lzo-rle [lz4] zstd\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	swaps, err := Swaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(swaps) != 2 || swaps[0].Path != "/dev/zram0" || swaps[0].Used != 512<<20 || swaps[1].Priority != -2 {
+		t.Errorf("unexpected swaps: %+v", swaps)
+	}
+
+	zram, ok := Zram()
+	if !ok || zram.Algorithm != "lz4" || zram.Original != 512<<20 || zram.Compressed != 128<<20 {
+		t.Errorf("unexpected zram stats: %+v", zram)
+	}
+
+	// swap that is on is left alone
+	recorder := effects.Record(true)
+	defer recorder.Stop()
+	cfg := &config.CloudConfig{Swap: &config.Swap{
+		Zram: &config.ZramSwap{Percent: 25},
+		File: &config.SwapFile{Size: "2G"},
+	}}
+	if err := ApplySwap(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Effects) != 0 {
+		t.Errorf("expected no changes, got %+v", recorder.Effects)
+	}
+}
+
+func TestApplySwapFile(t *testing.T) {
+	dir := t.TempDir()
+	defer func(swaps string) { procSwaps = swaps }(procSwaps)
+	procSwaps = filepath.Join(dir, "swaps")
+
+	recorder := effects.Record(true)
+	defer recorder.Stop()
+	path := filepath.Join(dir, "swapfile")
+	if err := ApplySwap(&config.CloudConfig{Swap: &config.Swap{File: &config.SwapFile{Path: path, Size: "512M", Priority: 5}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var plan []string
+	for _, e := range recorder.Effects {
+		plan = append(plan, e.Target+" "+e.Detail)
+	}
+	want := []string{path + " allocate 512MiB", "mkswap " + path + " ", "swapon -p 5 " + path + " "}
+	if len(plan) != len(want) {
+		t.Fatalf("unexpected plan: %q", plan)
+	}
+	for i := range want {
+		if plan[i] != want[i] {
+			t.Errorf("unexpected plan: %q", plan)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package sysctl
+
+// Profile is a set of sysctls tuned for a kind of node
+type Profile struct {
+	Name        string
+	Description string
+	Sysctls     map[string]string
+}
+
+// Profiles are the presets of maculaos sysctl profile
+var Profiles = []Profile{
+	{
+		Name:        "low-memory",
+		Description: "edge nodes with 1-2 GiB of memory: reclaim caches early and write back sooner",
+		Sysctls: map[string]string{
+			"vm.swappiness":                "100",
+			"vm.vfs_cache_pressure":        "200",
+			"vm.dirty_ratio":               "10",
+			"vm.dirty_background_ratio":    "5",
+			"vm.min_free_kbytes":           "16384",
+			"vm.overcommit_memory":         "1",
+			"kernel.panic":                 "10",
+			"kernel.panic_on_oops":         "1",
+			"net.core.somaxconn":           "1024",
+			"net.ipv4.tcp_max_syn_backlog": "1024",
+		},
+	},
+	{
+		Name:        "gateway",
+		Description: "mesh gateways and bootstraps with many connections: large backlogs, buffers and conntrack table",
+		Sysctls: map[string]string{
+			"net.ipv4.ip_forward":            "1",
+			"net.core.somaxconn":             "65535",
+			"net.core.netdev_max_backlog":    "16384",
+			"net.core.rmem_max":              "16777216",
+			"net.core.wmem_max":              "16777216",
+			"net.ipv4.tcp_max_syn_backlog":   "65535",
+			"net.ipv4.ip_local_port_range":   "1024 65535",
+			"net.ipv4.tcp_fin_timeout":       "15",
+			"net.ipv4.tcp_tw_reuse":          "1",
+			"net.netfilter.nf_conntrack_max": "1048576",
+			"fs.file-max":                    "2097152",
+		},
+	},
+}
+
+// FindProfile returns the profile called name
+func FindProfile(name string) (Profile, bool) {
+	for _, p := range Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
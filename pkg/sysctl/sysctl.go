@@ -1,21 +1,84 @@
 package sysctl
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"path"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
 )
 
+// ErrNoSuchKey is returned for a sysctl the kernel does not have
+var ErrNoSuchKey = errors.New("no such key")
+
+var (
+	procSys = "/proc/sys"
+	// ConfFile holds the sysctls of the config for the sysctl service
+	ConfFile = "/etc/sysctl.d/90-maculaos.conf"
+)
+
+// ConfigureSysctl sets the sysctls of the config and writes them to ConfFile.
+// A key that does not exist or cannot be set does not stop the others.
 func ConfigureSysctl(cfg *config.CloudConfig) error {
-	for k, v := range cfg.Maculaos.Sysctls {
-		elements := []string{"/proc", "sys"}
-		elements = append(elements, strings.Split(k, ".")...)
-		path := path.Join(elements...)
-		if err := ioutil.WriteFile(path, []byte(v), 0644); err != nil {
-			return err
+	var keys []string
+	for k := range cfg.Maculaos.Sysctls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errors []string
+	conf := &bytes.Buffer{}
+	for _, k := range keys {
+		v := cfg.Maculaos.Sysctls[k]
+		if err := Set(k, v); err != nil {
+			errors = append(errors, fmt.Sprintf("sysctl %s: %v", k, err))
+			if err == ErrNoSuchKey {
+				continue
+			}
 		}
+		fmt.Fprintf(conf, "%s = %s\n", k, v)
+	}
+
+	if err := writeConf(conf.Bytes()); err != nil {
+		errors = append(errors, err.Error())
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
 	}
 	return nil
 }
+
+// Set sets a sysctl unless it has the value already
+func Set(key, value string) error {
+	path := filepath.Join(procSys, strings.Replace(key, ".", "/", -1))
+	old, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ErrNoSuchKey
+	} else if err != nil {
+		return err
+	}
+
+	current := strings.Join(strings.Fields(string(old)), " ")
+	return effects.Do(effects.KindSysctl, key, fmt.Sprintf("%s -> %s", current, value), current != strings.Join(strings.Fields(value), " "), func() error {
+		return ioutil.WriteFile(path, []byte(value), 0644)
+	})
+}
+
+func writeConf(content []byte) error {
+	if len(content) == 0 {
+		if _, err := os.Stat(ConfFile); os.IsNotExist(err) {
+			return nil
+		}
+		return effects.Remove(ConfFile)
+	}
+	if err := effects.MkdirAll(filepath.Dir(ConfFile), 0755); err != nil {
+		return err
+	}
+	return effects.WriteFile(ConfFile, content, 0644)
+}
@@ -0,0 +1,44 @@
+package sysctl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+)
+
+func TestConfigureSysctl(t *testing.T) {
+	dir := t.TempDir()
+	defer func(proc, conf string) { procSys, ConfFile = proc, conf }(procSys, ConfFile)
+	procSys = filepath.Join(dir, "proc")
+	ConfFile = filepath.Join(dir, "sysctl.d", "90-maculaos.conf")
+	if err := os.MkdirAll(filepath.Join(procSys, "vm"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(procSys, "vm", "swappiness"), []byte("60\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := effects.Record(true)
+	defer recorder.Stop()
+
+	cfg := &config.CloudConfig{Maculaos: config.Maculaos{Sysctls: map[string]string{
+		"vm.swappiness":    "10",
+		"vm.no_such_thing": "1",
+		"net.ipv4.nothing": "1",
+	}}}
+	err := ConfigureSysctl(cfg)
+	if err == nil || err.Error() != "sysctl net.ipv4.nothing: no such key; sysctl vm.no_such_thing: no such key" {
+		t.Errorf("expected both unknown keys to be reported, got %v", err)
+	}
+
+	if len(recorder.Effects) != 2 || recorder.Effects[0].Target != "vm.swappiness" || recorder.Effects[0].Detail != "60 -> 10" {
+		t.Errorf("expected only vm.swappiness to be set, got %+v", recorder.Effects)
+	}
+	if data, err := effects.ReadFile(ConfFile); err != nil || string(data) != "vm.swappiness = 10\n" {
+		t.Errorf("unexpected %s: %q, %v", ConfFile, data, err)
+	}
+}
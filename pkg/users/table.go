@@ -0,0 +1,107 @@
+package users
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/util"
+)
+
+// table is a colon separated account file such as /etc/passwd, edited in
+// place so that lines it does not change are written back as they were
+type table struct {
+	path    string
+	fields  int
+	lines   [][]string
+	content []byte
+}
+
+func readTable(path string, fields int) (*table, error) {
+	content, err := effects.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	t := &table{path: path, fields: fields, content: content}
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := strings.Split(line, ":")
+		for len(entry) < fields {
+			entry = append(entry, "")
+		}
+		t.lines = append(t.lines, entry)
+	}
+	return t, nil
+}
+
+func (t *table) find(name string) []string {
+	for _, entry := range t.lines {
+		if entry[0] == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (t *table) has(name string) bool {
+	return t.find(name) != nil
+}
+
+// findID returns the entry with id in field
+func (t *table) findID(field, id int) []string {
+	for _, entry := range t.lines {
+		if entry[field] == strconv.Itoa(id) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// nextID returns the lowest free id in field from firstUID up
+func (t *table) nextID(field int) int {
+	id := firstUID
+	for t.findID(field, id) != nil {
+		id++
+	}
+	return id
+}
+
+func (t *table) add(entry []string) {
+	t.lines = append(t.lines, entry)
+}
+
+func (t *table) write() error {
+	buf := &strings.Builder{}
+	for _, entry := range t.lines {
+		buf.WriteString(strings.Join(entry, ":"))
+		buf.WriteString("\n")
+	}
+	if buf.String() == string(t.content) {
+		return nil
+	}
+	perm := os.FileMode(0644)
+	if t.path == shadowFile {
+		perm = 0640
+	}
+	// replaced in one step, a failed write never leaves a truncated account
+	// database behind
+	return effects.File(t.path, []byte(buf.String()), perm, func() error {
+		info, err := os.Stat(t.path)
+		if err != nil {
+			return util.WriteFileAtomic(t.path, []byte(buf.String()), perm)
+		}
+		// the mode and owner of the file are kept, such as root:shadow
+		if err := util.WriteFileAtomic(t.path, []byte(buf.String()), info.Mode().Perm()); err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			return os.Chown(t.path, int(stat.Uid), int(stat.Gid))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,271 @@
+package users
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+	"github.com/macula-io/macula-os/pkg/ssh"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// firstUID is where new users and groups are numbered from
+	firstUID     = 1000
+	defaultShell = "/bin/bash"
+)
+
+var (
+	passwdFile  = "/etc/passwd"
+	groupFile   = "/etc/group"
+	shadowFile  = "/etc/shadow"
+	sudoersFile = "/etc/sudoers.d/90-maculaos-users"
+	homeDir     = "/home"
+
+	validName = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+)
+
+// ApplyUsers creates the users of the config, or brings existing ones in
+// line with it, including the groups they are members of. Users that are no
+// longer configured are left alone.
+func ApplyUsers(cfg *config.CloudConfig, withNet bool) error {
+	if len(cfg.Users) == 0 {
+		return nil
+	}
+
+	db, err := readDB()
+	if err != nil {
+		return err
+	}
+
+	var errors []string
+	var sudoers []string
+	for _, u := range cfg.Users {
+		if err := db.apply(u); err != nil {
+			errors = append(errors, fmt.Sprintf("user %s: %v", u.Name, err))
+			continue
+		}
+		for _, rule := range u.Sudo {
+			sudoers = append(sudoers, u.Name+" "+rule)
+		}
+	}
+
+	if err := db.write(); err != nil {
+		return err
+	}
+	if err := writeSudoers(sudoers); err != nil {
+		return err
+	}
+
+	for _, u := range cfg.Users {
+		if !db.passwd.has(u.Name) {
+			continue
+		}
+		if err := createHome(db, u.Name); err != nil {
+			errors = append(errors, fmt.Sprintf("user %s: %v", u.Name, err))
+			continue
+		}
+		if len(u.SSHAuthorizedKeys) == 0 {
+			continue
+		}
+		if err := ssh.AuthorizeKeys(u.Name, u.SSHAuthorizedKeys, withNet); err != nil {
+			errors = append(errors, fmt.Sprintf("user %s: %v", u.Name, err))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// db holds the account files as they are edited
+type db struct {
+	passwd, group, shadow *table
+}
+
+func readDB() (*db, error) {
+	passwd, err := readTable(passwdFile, 7)
+	if err != nil {
+		return nil, err
+	}
+	group, err := readTable(groupFile, 4)
+	if err != nil {
+		return nil, err
+	}
+	shadow, err := readTable(shadowFile, 9)
+	if err != nil {
+		return nil, err
+	}
+	return &db{passwd: passwd, group: group, shadow: shadow}, nil
+}
+
+func (d *db) write() error {
+	for _, t := range []*table{d.passwd, d.group, d.shadow} {
+		if err := t.write(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *db) apply(u config.User) error {
+	if !validName.MatchString(u.Name) {
+		return fmt.Errorf("invalid user name %q", u.Name)
+	}
+	if u.Name == "root" {
+		return fmt.Errorf("root cannot be managed")
+	}
+	if u.HashedPassword != "" && !strings.HasPrefix(u.HashedPassword, "$") {
+		return fmt.Errorf("hashedPassword must be a crypt(3) hash")
+	}
+
+	entry := d.passwd.find(u.Name)
+	if entry == nil {
+		uid := u.UID
+		if uid == 0 {
+			uid = d.passwd.nextID(2)
+		} else if owner := d.passwd.findID(2, uid); owner != nil {
+			return fmt.Errorf("uid %d is taken by %s", uid, owner[0])
+		}
+		gid, err := d.primaryGroup(u.Name, uid)
+		if err != nil {
+			return err
+		}
+		entry = []string{u.Name, "x", strconv.Itoa(uid), strconv.Itoa(gid), "", filepath.Join(homeDir, u.Name), defaultShell}
+		d.passwd.add(entry)
+		logrus.Infof("creating user %s with uid %d", u.Name, uid)
+	} else if u.UID != 0 && entry[2] != strconv.Itoa(u.UID) {
+		return fmt.Errorf("exists with uid %s, not %d", entry[2], u.UID)
+	}
+	if u.Shell != "" {
+		entry[6] = u.Shell
+	}
+
+	shadow := d.shadow.find(u.Name)
+	if shadow == nil {
+		shadow = []string{u.Name, "*", "0", "0", "99999", "7", "", "", ""}
+		d.shadow.add(shadow)
+	}
+	// "*" allows SSH keys but no password, "!" disables the account
+	password := strings.TrimPrefix(shadow[1], "!")
+	if u.HashedPassword != "" {
+		password = u.HashedPassword
+	}
+	if u.Locked {
+		password = "!" + password
+	}
+	shadow[1] = password
+
+	for _, name := range u.Groups {
+		group := d.group.find(name)
+		if group == nil {
+			group = []string{name, "x", strconv.Itoa(d.group.nextID(2)), ""}
+			d.group.add(group)
+			logrus.Infof("creating group %s", name)
+		}
+		if group[2] == entry[3] {
+			continue
+		}
+		members := splitList(group[3])
+		if !contains(members, u.Name) {
+			group[3] = strings.Join(append(members, u.Name), ",")
+		}
+	}
+	// the user is left in no group the config does not list any more
+	for _, group := range d.group.lines {
+		members := splitList(group[3])
+		if contains(u.Groups, group[0]) || !contains(members, u.Name) {
+			continue
+		}
+		var kept []string
+		for _, m := range members {
+			if m != u.Name {
+				kept = append(kept, m)
+			}
+		}
+		group[3] = strings.Join(kept, ",")
+		logrus.Infof("removing user %s from group %s", u.Name, group[0])
+	}
+	return nil
+}
+
+// primaryGroup returns the gid of the group named after a new user, creating
+// it with the uid as gid when it is free
+func (d *db) primaryGroup(name string, uid int) (int, error) {
+	if group := d.group.find(name); group != nil {
+		return strconv.Atoi(group[2])
+	}
+	gid := uid
+	if d.group.findID(2, gid) != nil {
+		gid = d.group.nextID(2)
+	}
+	d.group.add([]string{name, "x", strconv.Itoa(gid), ""})
+	return gid, nil
+}
+
+func createHome(d *db, name string) error {
+	entry := d.passwd.find(name)
+	home := entry[5]
+	if _, err := os.Stat(home); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	uid, _ := strconv.Atoi(entry[2])
+	gid, _ := strconv.Atoi(entry[3])
+	if err := effects.MkdirAll(home, 0700); err != nil {
+		return err
+	}
+	return effects.Chown(home, uid, gid)
+}
+
+func writeSudoers(rules []string) error {
+	if len(rules) == 0 {
+		if _, err := os.Stat(sudoersFile); os.IsNotExist(err) {
+			return nil
+		}
+		return effects.Remove(sudoersFile)
+	}
+	sort.Strings(rules)
+	if err := effects.MkdirAll(filepath.Dir(sudoersFile), 0750); err != nil {
+		return err
+	}
+	content := []byte(strings.Join(rules, "\n") + "\n")
+	return effects.File(sudoersFile, content, 0440, func() error {
+		// sudo skips files with a dot in their name, so a bad rule is never live
+		tmp := sudoersFile + ".new"
+		if err := ioutil.WriteFile(tmp, content, 0440); err != nil {
+			return err
+		}
+		if visudo, err := exec.LookPath("visudo"); err == nil {
+			if out, err := exec.Command(visudo, "-c", "-q", "-f", tmp).CombinedOutput(); err != nil {
+				os.Remove(tmp)
+				return fmt.Errorf("invalid sudo rules: %s", strings.TrimSpace(string(out)))
+			}
+		}
+		return os.Rename(tmp, sudoersFile)
+	})
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
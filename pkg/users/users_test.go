@@ -0,0 +1,80 @@
+package users
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
+)
+
+func TestApplyUsers(t *testing.T) {
+	dir := t.TempDir()
+	defer func(passwd, group, shadow, sudoers, home string) {
+		passwdFile, groupFile, shadowFile, sudoersFile, homeDir = passwd, group, shadow, sudoers, home
+	}(passwdFile, groupFile, shadowFile, sudoersFile, homeDir)
+	passwdFile = filepath.Join(dir, "passwd")
+	groupFile = filepath.Join(dir, "group")
+	shadowFile = filepath.Join(dir, "shadow")
+	sudoersFile = filepath.Join(dir, "sudoers.d", "90-maculaos-users")
+	homeDir = filepath.Join(dir, "home")
+
+	files := map[string]string{
+		passwdFile: "root:x:0:0:root:/root:/bin/bash\nmacula:x:1000:1000::/home/macula:/bin/bash\n",
+		groupFile:  "root:x:0:\nwheel:x:10:admin,macula\nmacula:x:1000:\n",
+		shadowFile: "root:*:0:0:99999:7:::\nmacula:$6$old:0:0:99999:7:::\n",
+	}
+	for path, content := range files {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := effects.Record(true)
+	defer recorder.Stop()
+
+	cfg := &config.CloudConfig{Users: []config.User{
+		{Name: "ops", Groups: []string{"wheel", "docker"}, HashedPassword: "$6$new", Sudo: []string{"ALL=(ALL) ALL"}},
+		{Name: "macula", Locked: true},
+		{Name: "Bad"},
+	}}
+	// applying twice must not add anything the first run did not
+	for i := 0; i < 2; i++ {
+		err := ApplyUsers(cfg, false)
+		if err == nil || !strings.Contains(err.Error(), `invalid user name "Bad"`) {
+			t.Fatalf("expected the invalid user to fail, got %v", err)
+		}
+	}
+
+	for path, want := range map[string]string{
+		passwdFile:  "ops:x:1001:1001::" + filepath.Join(homeDir, "ops") + ":/bin/bash\n",
+		groupFile:   "wheel:x:10:admin,ops\nmacula:x:1000:\nops:x:1001:\ndocker:x:1002:ops\n",
+		shadowFile:  "macula:!$6$old:0:0:99999:7:::\nops:$6$new:0:0:99999:7:::\n",
+		sudoersFile: "ops ALL=(ALL) ALL\n",
+	} {
+		data, err := effects.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(data), want) {
+			t.Errorf("%s is\n%s\nexpected it to end with\n%s", filepath.Base(path), data, want)
+		}
+	}
+
+	// a group dropped from the config is left, members that are not
+	// configured stay
+	cfg.Users[0].Groups = []string{"docker"}
+	cfg.Users = cfg.Users[:1]
+	if err := ApplyUsers(cfg, false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := effects.ReadFile(groupFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "root:x:0:\nwheel:x:10:admin\nmacula:x:1000:\nops:x:1001:\ndocker:x:1002:ops\n"; string(data) != want {
+		t.Errorf("group is\n%s\nexpected\n%s", data, want)
+	}
+}
@@ -0,0 +1,152 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// UnifiedDiff renders the changes from one text to another in unified diff
+// format, or returns an empty string when they are equal
+func UnifiedDiff(fromName, toName string, from, to []byte) string {
+	if string(from) == string(to) {
+		return ""
+	}
+
+	lines := diffLines(splitLines(string(from)), splitLines(string(to)))
+
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", fromName, toName)
+
+	// walk the edit script, emitting hunks of changes with their context
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			i++
+			continue
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			// a run of unchanged lines longer than twice the context ends the hunk
+			run := end
+			for run < len(lines) && lines[run].op == ' ' {
+				run++
+			}
+			if run == len(lines) || run-end > 2*diffContext {
+				end += diffContext
+				if end > len(lines) {
+					end = len(lines)
+				}
+				break
+			}
+			end = run
+		}
+
+		fromStart, toStart := 1, 1
+		for _, l := range lines[:start] {
+			if l.op != '+' {
+				fromStart++
+			}
+			if l.op != '-' {
+				toStart++
+			}
+		}
+		fromCount, toCount := 0, 0
+		for _, l := range lines[start:end] {
+			if l.op != '+' {
+				fromCount++
+			}
+			if l.op != '-' {
+				toCount++
+			}
+		}
+		if fromCount == 0 {
+			fromStart--
+		}
+		if toCount == 0 {
+			toStart--
+		}
+
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(fromStart, fromCount), hunkRange(toStart, toCount))
+		for _, l := range lines[start:end] {
+			buf.WriteByte(l.op)
+			buf.WriteString(l.text)
+			buf.WriteByte('\n')
+		}
+		i = end
+	}
+
+	return buf.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines returns the edit script from a to b, using the longest common
+// subsequence of their lines
+func diffLines(a, b []string) []diffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var result []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			result = append(result, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			result = append(result, diffLine{'-', a[i]})
+			i++
+		default:
+			result = append(result, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		result = append(result, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		result = append(result, diffLine{'+', b[j]})
+	}
+	return result
+}
@@ -7,6 +7,9 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"time"
+
+	"github.com/macula-io/macula-os/pkg/httpclient"
 )
 
 func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
@@ -29,7 +32,7 @@ func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
 }
 
 func HTTPDownloadToFile(url, dest string) error {
-	res, err := http.Get(url)
+	res, err := httpclient.Get(url)
 	if err != nil {
 		return err
 	}
@@ -42,8 +45,16 @@ func HTTPDownloadToFile(url, dest string) error {
 }
 
 func HTTPLoadBytes(url string) ([]byte, error) {
+	return HTTPLoadBytesTimeout(url, 0)
+}
+
+// HTTPLoadBytesTimeout is HTTPLoadBytes giving up after timeout, or never
+// with 0
+func HTTPLoadBytesTimeout(url string, timeout time.Duration) ([]byte, error) {
+	client := httpclient.Client()
+	client.Timeout = timeout
 	var resp *http.Response
-	resp, err := http.Get(url)
+	resp, err := client.Get(url)
 	if err == nil {
 		defer resp.Body.Close()
 		if resp.StatusCode != http.StatusOK {
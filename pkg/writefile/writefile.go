@@ -8,6 +8,7 @@ import (
 	"path"
 
 	"github.com/macula-io/macula-os/pkg/config"
+	"github.com/macula-io/macula-os/pkg/effects"
 	"github.com/macula-io/macula-os/pkg/util"
 	"github.com/sirupsen/logrus"
 )
@@ -26,7 +27,9 @@ func WriteFiles(cfg *config.CloudConfig) {
 			logrus.WithFields(logrus.Fields{"err": err, "path": p}).Errorln("failed to write file")
 			continue
 		}
-		logrus.Infof("wrote file %s to filesystem", p)
+		if !effects.DryRun() {
+			logrus.Infof("wrote file %s to filesystem", p)
+		}
 	}
 }
 
@@ -35,39 +38,43 @@ func WriteFile(f *config.File, root string) (string, error) {
 		return "", fmt.Errorf("unable to write file with encoding %s", f.Encoding)
 	}
 	p := path.Join(root, f.Path)
-	d := path.Dir(p)
-	logrus.Infof("writing file to %q", d)
-	if err := util.EnsureDirectoryExists(d); err != nil {
-		return "", err
-	}
 	perm, err := f.Permissions()
 	if err != nil {
 		return "", err
 	}
+	return p, effects.File(p, []byte(f.Content), perm, func() error {
+		return writeFile(f, p, perm)
+	})
+}
+
+func writeFile(f *config.File, p string, perm os.FileMode) error {
+	d := path.Dir(p)
+	logrus.Infof("writing file to %q", d)
+	if err := util.EnsureDirectoryExists(d); err != nil {
+		return err
+	}
 	var tmp *os.File
+	var err error
 	// create a temporary file in the same directory to ensure it's on the same filesystem
 	if tmp, err = ioutil.TempFile(d, "wfs-temp"); err != nil {
-		return "", err
+		return err
 	}
 	if err := ioutil.WriteFile(tmp.Name(), []byte(f.Content), perm); err != nil {
-		return "", err
+		return err
 	}
 	if err := tmp.Close(); err != nil {
-		return "", err
+		return err
 	}
 	// ensure the permissions are as requested (since WriteFile can be affected by sticky bit)
 	if err := os.Chmod(tmp.Name(), perm); err != nil {
-		return "", err
+		return err
 	}
 	if f.Owner != "" {
 		// we shell out since we don't have a way to look up unix groups natively
 		cmd := exec.Command("chown", f.Owner, tmp.Name())
 		if err := cmd.Run(); err != nil {
-			return "", err
+			return err
 		}
 	}
-	if err := os.Rename(tmp.Name(), p); err != nil {
-		return "", err
-	}
-	return p, nil
+	return os.Rename(tmp.Name(), p)
 }